@@ -1,15 +1,27 @@
 #include "common.h"
+#include "ggml.h"
 #include "llama.h"
 #include "binding.h"
+#include "grammar.h"
 
+#include <algorithm>
+#include <atomic>
 #include <cassert>
+#include <chrono>
 #include <cinttypes>
 #include <cmath>
+#include <cstdarg>
 #include <cstdio>
 #include <cstring>
 #include <fstream>
+#include <functional>
 #include <iostream>
+#include <map>
+#include <memory>
+#include <mutex>
+#include <random>
 #include <string>
+#include <thread>
 #include <vector>
 #include <sstream>
 
@@ -23,6 +35,11 @@
 #include <signal.h>
 #endif
 
+#if defined (__linux__)
+#include <pthread.h>
+#include <sched.h>
+#endif
+
 #if defined (__unix__) || (defined (__APPLE__) && defined (__MACH__)) || defined (_WIN32)
 void sigint_handler(int signo) {
     if (signo == SIGINT) {
@@ -31,10 +48,302 @@ void sigint_handler(int signo) {
 }
 #endif
 
-int get_embeddings(void* params_ptr, void* state_pr, float * res_embeddings) {
-    gpt_params* params_p = (gpt_params*) params_ptr;
+// binding_log formats a message of the bindings and hands it to the Go logger, see SetLogFunc.
+static void binding_log(int level, const char * fmt, ...) {
+    char msg[1024];
+    va_list args;
+    va_start(args, fmt);
+    vsnprintf(msg, sizeof(msg), fmt, args);
+    va_end(args);
+    logCallback(level, msg);
+}
+
+// prompt_cache keeps the context state once a prompt is evaluated, so the next predictions of
+// the same prompt do not evaluate it again.
+struct prompt_cache {
+    bool valid = false;
+    std::vector<llama_token> tokens;
+    std::vector<uint8_t> state;
+    int n_past = 0;
+    std::vector<llama_token> last_n_tokens;
+    std::string res;
+};
+
+// context_tokens are the tokens evaluated at the start of each context, so a prediction only
+// evaluates the part of its prompt which differs from what the context already holds.
+static std::mutex context_tokens_mutex;
+static std::map<llama_context *, std::vector<llama_token>> context_tokens;
+
+// take_context_tokens returns the tokens held by the context and forgets them, they are stored
+// again with store_context_tokens once the context is known to hold them.
+static std::vector<llama_token> take_context_tokens(llama_context * ctx) {
+    std::lock_guard<std::mutex> lock(context_tokens_mutex);
+    std::vector<llama_token> tokens;
+    auto it = context_tokens.find(ctx);
+    if (it != context_tokens.end()) {
+        tokens.swap(it->second);
+        context_tokens.erase(it);
+    }
+    return tokens;
+}
+
+static void store_context_tokens(llama_context * ctx, std::vector<llama_token> tokens) {
+    std::lock_guard<std::mutex> lock(context_tokens_mutex);
+    context_tokens[ctx] = std::move(tokens);
+}
+
+// system_prompts are the tokens set with llama_set_system_prompt, they start the prompts of the
+// predictions of the context.
+static std::map<llama_context *, std::vector<llama_token>> system_prompts;
+
+static std::vector<llama_token> get_system_prompt(llama_context * ctx) {
+    std::lock_guard<std::mutex> lock(context_tokens_mutex);
+    auto it = system_prompts.find(ctx);
+    return it != system_prompts.end() ? it->second : std::vector<llama_token>();
+}
+
+// binding_params extends the llama.cpp parameters with the options handled by the bindings.
+struct binding_params : gpt_params {
+    float min_p = 0.0f;
+    std::vector<int> sampler_order;
+    std::string grammar;
+    // biases for texts, they are resolved to tokens once the model is known
+    std::vector<std::pair<std::string, float>> token_bias;
+    // number of alternatives reported for each sampled token
+    int n_probs = 0;
+    // set by llama_cancel_predict, shared by the copies of the parameters
+    std::shared_ptr<std::atomic<bool>> canceled = std::make_shared<std::atomic<bool>>(false);
+    // wall clock limit of a prediction in microseconds, 0 for no limit
+    int64_t max_duration_us = 0;
+    // limit of the rate of the generated tokens, 0 for no limit
+    float max_tokens_per_second = 0.0f;
+    // token ending the generation in place of the end of stream token of the model, -1 for none
+    int eos_token = -1;
+    // more tokens ending the generation
+    std::vector<int> stop_token_ids;
+    // never sample the end of stream token
+    bool ignore_eos = false;
+    // prepend the beginning of stream token to the prompt and parse the texts of the special
+    // tokens in the prompt
+    bool add_bos = true;
+    bool parse_special = false;
+    // pass the special tokens to the token callback and keep them in the output
+    bool special_tokens = false;
+    // stop when the average entropy of the sampled positions rises above max_entropy or the sum
+    // of the log probabilities of the sampled tokens falls below min_logprob, 0 disables them
+    float max_entropy = 0.0f;
+    float min_logprob = 0.0f;
+    // texts and tokens activating the grammar, it applies from the start when there are none
+    std::vector<std::string> grammar_triggers;
+    std::vector<int> grammar_trigger_tokens;
+    // do not update the prompt cache file set with path_session
+    bool prompt_cache_ro = false;
+    // number of tokens at the start of the context kept by context shifts, overrides n_keep
+    int n_sinks = 0;
+    // beam search instead of sampling when more than 0
+    int n_beams = 0;
+    float length_penalty = 1.0f;
+    bool beam_early_stopping = false;
+    // classifier-free guidance, disabled with a scale of 1. The guidance sequence is evaluated in
+    // ctx_guidance, a context of the same model.
+    std::string cfg_negative_prompt;
+    float cfg_scale = 1.0f;
+    llama_context * ctx_guidance = nullptr;
+    // always sample the most likely token, bypassing the samplers
+    bool greedy = false;
+    // shared by the predictions of the choices of a prompt, may be null
+    prompt_cache * cache = nullptr;
+    // strings which are never generated
+    std::vector<std::string> banned_strings;
+    // call the logits processor registered on the Go side before sampling
+    bool logits_processor = false;
+    // draw the sampled tokens with the random source registered on the Go side
+    bool go_rand = false;
+    // report the phases of the prediction to the tracer registered on the Go side
+    bool trace = false;
+    // threads evaluating the prompts, 0 uses n_threads
+    int n_threads_batch = 0;
+    // CPUs the threads run on, all of them when empty, and their priority
+    std::vector<int> cpu_mask;
+    int priority = PRIORITY_NORMAL;
+    // number of tokens passed at once to the Go token callback, see token_batch
+    int token_batch = 1;
+    // report the evaluation of the prompt to the progress callback registered on the Go side
+    bool prompt_progress = false;
+    // the prompt, when it is already tokenized
+    std::vector<llama_token> prompt_tokens;
+    // fill-in-the-middle prompt, the special tokens are looked up in the vocabulary unless set
+    bool infill = false;
+    std::string infill_prefix;
+    std::string infill_suffix;
+    int fim_pre = -1;
+    int fim_suf = -1;
+    int fim_mid = -1;
+    int fim_eot = -1;
+};
+
+// trace reports the beginning or the end of a phase of a prediction to the Go tracer, n_tokens
+// is the number of tokens the phase handled.
+static void trace(const binding_params & params, void * state_pr, int phase, int n_tokens, bool end) {
+    if (params.trace) {
+        traceCallback(state_pr, phase, n_tokens, end);
+    }
+}
+
+// prompt_progress reports to the Go progress callback that done of the total tokens of the prompt
+// are evaluated, those reused from the context included.
+static void prompt_progress(const binding_params & params, void * state_pr, int done, int total) {
+    if (params.prompt_progress) {
+        promptProgressCallback(state_pr, done, total);
+    }
+}
+
+// thread_settings applies the CPU mask and the priority of a prediction to the calling thread,
+// the threads ggml starts to evaluate the tokens inherit them, and restores the previous ones
+// when it is destroyed. They are only supported on Linux, raising the priority needs the
+// CAP_SYS_NICE capability.
+struct thread_settings {
+#if defined (__linux__)
+    bool mask_set = false;
+    cpu_set_t saved_mask;
+    bool sched_set = false;
+    int saved_policy = SCHED_OTHER;
+    sched_param saved_param;
+#endif
+
+    explicit thread_settings(const binding_params & params) {
+#if defined (__linux__)
+        if (!params.cpu_mask.empty() && pthread_getaffinity_np(pthread_self(), sizeof(saved_mask), &saved_mask) == 0) {
+            cpu_set_t mask;
+            CPU_ZERO(&mask);
+            for (int cpu : params.cpu_mask) {
+                if (cpu >= 0 && cpu < CPU_SETSIZE) {
+                    CPU_SET(cpu, &mask);
+                }
+            }
+            mask_set = pthread_setaffinity_np(pthread_self(), sizeof(mask), &mask) == 0;
+            if (!mask_set) {
+                binding_log(LOG_LEVEL_WARN, "%s : failed to set the CPU mask\n", __func__);
+            }
+        }
+        if (params.priority != PRIORITY_NORMAL && pthread_getschedparam(pthread_self(), &saved_policy, &saved_param) == 0) {
+            // the real-time priorities llama.cpp uses for its levels
+            sched_param param;
+            param.sched_priority = params.priority == PRIORITY_MEDIUM ? 40 : params.priority == PRIORITY_HIGH ? 80 : 90;
+            sched_set = pthread_setschedparam(pthread_self(), SCHED_FIFO, &param) == 0;
+            if (!sched_set) {
+                binding_log(LOG_LEVEL_WARN, "%s : failed to set the thread priority\n", __func__);
+            }
+        }
+#else
+        if (!params.cpu_mask.empty() || params.priority != PRIORITY_NORMAL) {
+            binding_log(LOG_LEVEL_WARN, "%s : the CPU mask and the thread priority are only supported on Linux\n", __func__);
+        }
+#endif
+    }
+
+    ~thread_settings() {
+#if defined (__linux__)
+        if (mask_set) {
+            pthread_setaffinity_np(pthread_self(), sizeof(saved_mask), &saved_mask);
+        }
+        if (sched_set) {
+            pthread_setschedparam(pthread_self(), saved_policy, &saved_param);
+        }
+#endif
+    }
+};
+
+// max_batch is the largest number of tokens evaluated at once.
+static const int max_batch = 512;
+
+// batch_threads returns the number of threads evaluating the batches of a prompt.
+static int batch_threads(const binding_params & params) {
+    return params.n_threads_batch > 0 ? params.n_threads_batch : params.n_threads;
+}
+
+static const int default_sampler_order[] = {
+    SAMPLER_PENALTIES,
+    SAMPLER_TOP_K,
+    SAMPLER_TAIL_FREE,
+    SAMPLER_TYPICAL,
+    SAMPLER_TOP_P,
+    SAMPLER_MIN_P,
+    SAMPLER_TEMPERATURE,
+};
+
+// sample_token_uniform samples a token like llama_sample_token, using u drawn uniformly from [0, 1)
+// instead of the random number generator of the context.
+static llama_token sample_token_uniform(llama_context * ctx, llama_token_data_array * candidates, double u) {
+    llama_sample_softmax(ctx, candidates);
+    double cumulative = 0.0;
+    for (size_t i = 0; i < candidates->size; i++) {
+        cumulative += candidates->data[i].p;
+        if (u < cumulative) {
+            return candidates->data[i].id;
+        }
+    }
+    return candidates->data[candidates->size - 1].id;
+}
+
+// sample_min_p keeps the tokens whose probability is at least p times the probability of the
+// most likely token.
+static void sample_min_p(llama_context * ctx, llama_token_data_array * candidates, float p, size_t min_keep) {
+    if (p <= 0.0f || candidates->size == 0) {
+        return;
+    }
+
+    llama_sample_softmax(ctx, candidates);
+
+    const float threshold = candidates->data[0].p * p;
+    size_t keep = 1;
+    while (keep < candidates->size && (candidates->data[keep].p >= threshold || keep < min_keep)) {
+        keep++;
+    }
+    candidates->size = keep;
+}
+
+// sample_penalties applies the repetition, frequency and presence penalties over the last
+// repeat_last_n tokens.
+static void sample_penalties(llama_context * ctx, llama_token_data_array * candidates, const binding_params & params,
+                             const std::vector<llama_token> & last_n_tokens) {
+    const int n_ctx = llama_n_ctx(ctx);
+    const int32_t repeat_last_n = params.repeat_last_n < 0 ? n_ctx : params.repeat_last_n;
+    const auto last_n_repeat = std::min(std::min((int)last_n_tokens.size(), repeat_last_n), n_ctx);
+
+    llama_token_data * nl = nullptr;
+    float nl_logit = 0.0f;
+    for (size_t i = 0; i < candidates->size; i++) {
+        if (candidates->data[i].id == llama_token_nl()) {
+            nl = &candidates->data[i];
+            nl_logit = nl->logit;
+            break;
+        }
+    }
+
+    llama_sample_repetition_penalty(ctx, candidates,
+        last_n_tokens.data() + last_n_tokens.size() - last_n_repeat,
+        last_n_repeat, params.repeat_penalty);
+    llama_sample_frequency_and_presence_penalties(ctx, candidates,
+        last_n_tokens.data() + last_n_tokens.size() - last_n_repeat,
+        last_n_repeat, params.frequency_penalty, params.presence_penalty);
+
+    if (!params.penalize_nl && nl != nullptr) {
+        nl->logit = nl_logit;
+    }
+}
+
+// random_seed returns a positive seed which differs between calls made in the same second.
+static int random_seed() {
+    std::random_device rd;
+    return (int) (rd() & 0x7fffffff) | 1;
+}
+
+int get_embeddings(void* params_ptr, void* state_pr, float * res_embeddings, int pooling) {
+    binding_params* params_p = (binding_params*) params_ptr;
     llama_context* ctx = (llama_context*) state_pr;
-    gpt_params params = *params_p;
+    binding_params params = *params_p;
+    take_context_tokens(ctx);
 
     if (params.seed <= 0) {
         params.seed = time(NULL);
@@ -53,15 +362,48 @@ int get_embeddings(void* params_ptr, void* state_pr, float * res_embeddings) {
     // determine newline token
     auto llama_token_newline = ::llama_tokenize(ctx, "\n", false);
 
+    if ((int) embd_inp.size() > llama_n_ctx(ctx)) {
+        return 2;
+    }
+
+    const int n_embd = llama_n_embd(ctx);
+
+    // the embedding of the first token of the text is the one of the evaluation ending with it,
+    // the beginning of stream token added by the tokenizer comes before it
+    if (pooling == POOLING_CLS) {
+        const size_t n = !embd_inp.empty() && embd_inp[0] == llama_token_bos() ? 2 : 1;
+        if (embd_inp.size() > n) {
+            embd_inp.resize(n);
+        }
+    }
+
+    if (pooling == POOLING_MEAN) {
+        // the context only outputs the embedding of the last token of each evaluation, so the
+        // tokens are evaluated one by one to average all of them
+        std::vector<float> sum(n_embd, 0.0f);
+        for (size_t i = 0; i < embd_inp.size(); i++) {
+            if (llama_eval(ctx, &embd_inp[i], 1, n_past++, params.n_threads)) {
+                binding_log(LOG_LEVEL_ERROR, "%s : failed to eval\n", __func__);
+                return 1;
+            }
+            const float * embeddings = llama_get_embeddings(ctx);
+            for (int j = 0; j < n_embd; j++) {
+                sum[j] += embeddings[j];
+            }
+        }
+        for (int j = 0; j < n_embd; j++) {
+            res_embeddings[j] = embd_inp.empty() ? 0.0f : sum[j] / embd_inp.size();
+        }
+        return 0;
+    }
+
     if (embd_inp.size() > 0) {
-        if (llama_eval(ctx, embd_inp.data(), embd_inp.size(), n_past, params.n_threads)) {
-            fprintf(stderr, "%s : failed to eval\n", __func__);
+        if (llama_eval(ctx, embd_inp.data(), embd_inp.size(), n_past, batch_threads(params))) {
+            binding_log(LOG_LEVEL_ERROR, "%s : failed to eval\n", __func__);
             return 1;
         }
     }
 
-    const int n_embd = llama_n_embd(ctx);
-
     const auto embeddings = llama_get_embeddings(ctx);
 
     for (int i = 0; i < n_embd; i++) {
@@ -72,10 +414,11 @@ int get_embeddings(void* params_ptr, void* state_pr, float * res_embeddings) {
 }
 
 
-int get_token_embeddings(void* params_ptr, void* state_pr,  int *tokens, int tokenSize, float * res_embeddings) {
-    gpt_params* params_p = (gpt_params*) params_ptr;
+int get_token_embeddings(void* params_ptr, void* state_pr,  int *tokens, int tokenSize, float * res_embeddings, int pooling) {
+    binding_params* params_p = (binding_params*) params_ptr;
     llama_context* ctx = (llama_context*) state_pr;
-    gpt_params params = *params_p;
+    binding_params params = *params_p;
+    take_context_tokens(ctx);
  
     for (int i = 0; i < tokenSize; i++) {
         auto token_str = llama_token_to_str(ctx, tokens[i]);
@@ -87,27 +430,669 @@ int get_token_embeddings(void* params_ptr, void* state_pr,  int *tokens, int tok
         params_p->prompt += str_token;
     }
 
-  return get_embeddings(params_ptr,state_pr,res_embeddings);
+  return get_embeddings(params_ptr,state_pr,res_embeddings,pooling);
+}
+
+int get_embeddings_per_token(void* params_ptr, void* state_pr, float * res_embeddings, int max_tokens, int* n_tokens) {
+    binding_params* params_p = (binding_params*) params_ptr;
+    llama_context* ctx = (llama_context*) state_pr;
+    binding_params params = *params_p;
+
+    // the prompt is tokenized like in get_embeddings
+    params.prompt.insert(0, 1, ' ');
+    auto embd_inp = ::llama_tokenize(ctx, params.prompt, true);
+    *n_tokens = embd_inp.size();
+    if ((int) embd_inp.size() > llama_n_ctx(ctx)) {
+        return 2;
+    }
+    if ((int) embd_inp.size() > max_tokens) {
+        return 4;
+    }
+    take_context_tokens(ctx);
+
+    // the context only outputs the embedding of the last token of each evaluation
+    const int n_embd = llama_n_embd(ctx);
+    for (size_t i = 0; i < embd_inp.size(); i++) {
+        if (llama_eval(ctx, &embd_inp[i], 1, i, params.n_threads)) {
+            binding_log(LOG_LEVEL_ERROR, "%s : failed to eval\n", __func__);
+            return 1;
+        }
+        const float * embeddings = llama_get_embeddings(ctx);
+        std::copy(embeddings, embeddings + n_embd, res_embeddings + i * n_embd);
+    }
+    return 0;
+}
+
+int get_embeddings_batch(void* params_ptr, void* state_pr, const char** texts, int count, float * res_embeddings, int pooling, int* failed) {
+    binding_params* params_p = (binding_params*) params_ptr;
+    const int n_embd = llama_n_embd((llama_context*) state_pr);
+
+    // the revision of llama.cpp evaluates a single sequence at a time, the texts share the
+    // parameters and the context
+    for (int i = 0; i < count; i++) {
+        params_p->prompt = texts[i];
+        const int ret = get_embeddings(params_ptr, state_pr, res_embeddings + (size_t) i * n_embd, pooling);
+        if (ret != 0) {
+            *failed = i;
+            return ret;
+        }
+    }
+    return 0;
+}
+
+
+// sampled_tokens collects the information about the sampled tokens reported in the result.
+struct sampled_tokens {
+    int n_prompt_tokens = 0;
+    int prompt_text_len = 0;
+    int finish_reason = FINISH_LENGTH;
+    int seed = 0;
+    int64_t t_prompt_us = 0;
+    int64_t t_predict_us = 0;
+    int64_t t_sample_us = 0;
+    int n_prompt_eval = 0;
+    int n_predicted = 0;
+
+    std::vector<int> ids;
+    std::string pieces;
+    std::vector<int> piece_lens;
+    std::vector<float> logprobs;
+
+    // the n_probs most likely alternatives of each token
+    int n_probs = 0;
+    std::vector<int> top_ids;
+    std::string top_pieces;
+    std::vector<int> top_piece_lens;
+    std::vector<float> top_logprobs;
+
+    // the hypotheses of a beam search, best first
+    std::vector<std::string> beam_texts;
+    std::vector<std::vector<int>> beam_ids;
+    std::vector<float> beam_scores;
+};
+
+// token_batch collects the sampled tokens to pass them to the Go token callback in a single call,
+// instead of crossing into Go for each token.
+struct token_batch {
+    std::vector<int> ids;
+    std::string pieces;
+    std::vector<int> piece_lens;
+    std::vector<float> logprobs;
+    std::vector<int> positions;
+    std::vector<unsigned char> specials;
+
+    // the sizes of the output and of the sampled tokens before each token, to drop the tokens
+    // following a cancellation
+    struct mark {
+        size_t res_len;
+        size_t n_ids;
+        size_t pieces_len;
+        size_t n_top;
+        size_t top_pieces_len;
+    };
+    std::vector<mark> marks;
+
+    // add appends a token, before its text is added to res and it is added to sampled.
+    void add(llama_token id, const char * piece, float logprob, int position, bool special,
+             const std::string & res, const sampled_tokens & sampled) {
+        const std::string text = piece != nullptr ? piece : "";
+        ids.push_back(id);
+        pieces += text;
+        piece_lens.push_back((int) text.size());
+        logprobs.push_back(logprob);
+        positions.push_back(position);
+        specials.push_back(special);
+        marks.push_back({res.size(), sampled.ids.size(), sampled.pieces.size(), sampled.top_ids.size(), sampled.top_pieces.size()});
+    }
+
+    // flush passes the tokens to the callback and returns whether the prediction continues. When
+    // the callback stops it, the tokens from the one it stopped at are removed from res and
+    // sampled, like the token the unbatched callback stops at.
+    bool flush(void * state_pr, std::string & res, sampled_tokens & sampled) {
+        if (ids.empty()) {
+            return true;
+        }
+        const int n = (int) ids.size();
+        const int accepted = tokenBatchCallback(state_pr, n, ids.data(), (char *) pieces.data(), piece_lens.data(),
+            logprobs.data(), positions.data(), specials.data());
+        if (accepted >= 0 && accepted < n) {
+            const mark & m = marks[accepted];
+            res.resize(std::min(res.size(), m.res_len));
+            if (m.n_ids < sampled.ids.size()) {
+                sampled.ids.resize(m.n_ids);
+                sampled.piece_lens.resize(m.n_ids);
+                sampled.logprobs.resize(m.n_ids);
+                sampled.pieces.resize(m.pieces_len);
+            }
+            if (m.n_top < sampled.top_ids.size()) {
+                sampled.top_ids.resize(m.n_top);
+                sampled.top_piece_lens.resize(m.n_top);
+                sampled.top_logprobs.resize(m.n_top);
+                sampled.top_pieces.resize(m.top_pieces_len);
+            }
+        }
+        ids.clear();
+        pieces.clear();
+        piece_lens.clear();
+        logprobs.clear();
+        positions.clear();
+        specials.clear();
+        marks.clear();
+        return accepted >= n;
+    }
+};
+
+template <typename T>
+static T * copy_to_c(const std::vector<T> & v) {
+    T * res = (T *) malloc(sizeof(T) * std::max<size_t>(v.size(), 1));
+    std::copy(v.begin(), v.end(), res);
+    return res;
 }
 
+static char * copy_to_c(const std::string & s) {
+    char * res = (char *) malloc(s.size() + 1);
+    memcpy(res, s.c_str(), s.size() + 1);
+    return res;
+}
+
+// fill_result copies the information collected about the sampled tokens into the result
+// returned to Go.
+static void fill_result(llama_predict_result * out, const sampled_tokens & sampled, const std::string & text) {
+    if (out == nullptr) {
+        return;
+    }
+
+    out->text = copy_to_c(text);
+    out->text_len = (int) text.size();
+
+    out->n_prompt_tokens = sampled.n_prompt_tokens;
+    out->prompt_text_len = sampled.prompt_text_len;
+    out->finish_reason = sampled.finish_reason;
+    out->seed = sampled.seed;
+    out->t_prompt_us = sampled.t_prompt_us;
+    out->t_predict_us = sampled.t_predict_us;
+    out->t_sample_us = sampled.t_sample_us;
+    out->n_prompt_eval = sampled.n_prompt_eval;
+    out->n_predicted = sampled.n_predicted;
+
+    out->n_tokens = (int) sampled.ids.size();
+    out->ids = copy_to_c(sampled.ids);
+    out->pieces = copy_to_c(sampled.pieces);
+    out->piece_lens = copy_to_c(sampled.piece_lens);
+    out->logprobs = copy_to_c(sampled.logprobs);
 
-int llama_predict(void* params_ptr, void* state_pr, char* result, bool debug) {
-    gpt_params* params_p = (gpt_params*) params_ptr;
+    out->n_probs = sampled.n_probs;
+    out->top_ids = copy_to_c(sampled.top_ids);
+    out->top_pieces = copy_to_c(sampled.top_pieces);
+    out->top_piece_lens = copy_to_c(sampled.top_piece_lens);
+    out->top_logprobs = copy_to_c(sampled.top_logprobs);
+
+    std::string beam_texts;
+    std::vector<int> beam_text_lens;
+    std::vector<int> beam_ids;
+    std::vector<int> beam_n_tokens;
+    for (size_t i = 0; i < sampled.beam_texts.size(); i++) {
+        beam_texts += sampled.beam_texts[i];
+        beam_text_lens.push_back((int) sampled.beam_texts[i].size());
+        beam_ids.insert(beam_ids.end(), sampled.beam_ids[i].begin(), sampled.beam_ids[i].end());
+        beam_n_tokens.push_back((int) sampled.beam_ids[i].size());
+    }
+    out->n_beams = (int) sampled.beam_texts.size();
+    out->beam_texts = copy_to_c(beam_texts);
+    out->beam_text_lens = copy_to_c(beam_text_lens);
+    out->beam_ids = copy_to_c(beam_ids);
+    out->beam_n_tokens = copy_to_c(beam_n_tokens);
+    out->beam_scores = copy_to_c(sampled.beam_scores);
+}
+
+void llama_free_result(llama_predict_result * result) {
+    free(result->text);
+    free(result->ids);
+    free(result->pieces);
+    free(result->piece_lens);
+    free(result->logprobs);
+    free(result->top_ids);
+    free(result->top_pieces);
+    free(result->top_piece_lens);
+    free(result->top_logprobs);
+    free(result->beam_texts);
+    free(result->beam_text_lens);
+    free(result->beam_ids);
+    free(result->beam_n_tokens);
+    free(result->beam_scores);
+}
+
+// banned_strings masks the tokens which would complete one of the banned strings.
+struct banned_strings {
+    std::vector<std::string> strings;
+    // tokens whose text contains one of the strings
+    std::vector<llama_token> containing;
+    // continuing[i][k-1] are the tokens whose text starts with the rest of strings[i] after its
+    // first k bytes, they complete it after a text ending with these bytes
+    std::vector<std::vector<std::vector<llama_token>>> continuing;
+    // text of each token of the vocabulary
+    std::vector<std::string> pieces;
+    // end of the generated text, too short to contain a banned string on its own
+    std::string tail;
+    size_t max_len = 0;
+
+    banned_strings(llama_context * ctx, const std::vector<std::string> & banned) {
+        for (const auto & s : banned) {
+            if (!s.empty()) {
+                strings.push_back(s);
+                max_len = std::max(max_len, s.size());
+            }
+        }
+        if (strings.empty()) {
+            return;
+        }
+
+        const int n_vocab = llama_n_vocab(ctx);
+        pieces.resize(n_vocab);
+        continuing.resize(strings.size());
+        for (size_t i = 0; i < strings.size(); i++) {
+            continuing[i].resize(strings[i].size() - 1);
+        }
+        for (llama_token id = 0; id < n_vocab; id++) {
+            const char * str = llama_token_to_str(ctx, id);
+            pieces[id] = str != nullptr ? str : "";
+            const std::string & piece = pieces[id];
+            bool contains = false;
+            for (size_t i = 0; i < strings.size(); i++) {
+                const std::string & s = strings[i];
+                contains = contains || piece.find(s) != std::string::npos;
+                for (size_t k = 1; k < s.size(); k++) {
+                    if (piece.compare(0, s.size() - k, s, k, std::string::npos) == 0) {
+                        continuing[i][k - 1].push_back(id);
+                    }
+                }
+            }
+            if (contains) {
+                containing.push_back(id);
+            }
+        }
+    }
+
+    // mask only goes through the tokens completing a string after the tail, the tail itself
+    // holds none of the strings
+    void mask(float * logits) const {
+        for (auto id : containing) {
+            logits[id] = -INFINITY;
+        }
+        for (size_t i = 0; i < strings.size(); i++) {
+            const std::string & s = strings[i];
+            for (size_t k = 1; k < s.size() && k <= tail.size(); k++) {
+                if (tail.compare(tail.size() - k, k, s, 0, k) != 0) {
+                    continue;
+                }
+                for (auto id : continuing[i][k - 1]) {
+                    logits[id] = -INFINITY;
+                }
+            }
+        }
+    }
+
+    void accept(llama_token id) {
+        if (strings.empty()) {
+            return;
+        }
+        tail += pieces[id];
+        if (tail.size() >= max_len) {
+            tail.erase(0, tail.size() - (max_len - 1));
+        }
+    }
+};
+
+// find_token returns the token whose text is text, with or without a leading space, or -1.
+static llama_token find_token(llama_context * ctx, const std::string & text) {
+    const int n_vocab = llama_n_vocab(ctx);
+    for (int i = 0; i < n_vocab; i++) {
+        const char * str = llama_token_to_str(ctx, i);
+        if (str != nullptr && (text == str || " " + text == str)) {
+            return i;
+        }
+    }
+    return -1;
+}
+
+// tokenize_text tokenizes text like llama_tokenize. With parse_special the texts of the special
+// tokens of the vocabulary, like <|im_start|>, are replaced with the tokens instead of being
+// tokenized as text.
+static std::vector<llama_token> tokenize_text(llama_context * ctx, const std::string & text, bool add_bos, bool parse_special) {
+    if (!parse_special) {
+        return ::llama_tokenize(ctx, text, add_bos);
+    }
+
+    // the special tokens are the ones written inside angle brackets, the longest first
+    std::vector<std::pair<std::string, llama_token>> specials;
+    const int n_vocab = llama_n_vocab(ctx);
+    for (llama_token id = 0; id < n_vocab; id++) {
+        const char * str = llama_token_to_str(ctx, id);
+        const std::string piece = str != nullptr ? str : "";
+        if (piece.size() > 2 && piece.front() == '<' && piece.back() == '>' && piece.compare(0, 3, "<0x") != 0) {
+            specials.emplace_back(piece, id);
+        }
+    }
+    std::sort(specials.begin(), specials.end(), [](const std::pair<std::string, llama_token> & a, const std::pair<std::string, llama_token> & b) {
+        return a.first.size() > b.first.size();
+    });
+
+    std::vector<llama_token> res;
+    if (add_bos) {
+        res.push_back(llama_token_bos());
+    }
+    auto add_text = [&](size_t start, size_t end) {
+        if (end > start) {
+            auto tokens = ::llama_tokenize(ctx, text.substr(start, end - start), false);
+            res.insert(res.end(), tokens.begin(), tokens.end());
+        }
+    };
+    size_t start = 0;
+    size_t pos = 0;
+    while (pos < text.size()) {
+        bool matched = false;
+        if (text[pos] == '<') {
+            for (const auto & special : specials) {
+                if (text.compare(pos, special.first.size(), special.first) == 0) {
+                    add_text(start, pos);
+                    res.push_back(special.second);
+                    pos += special.first.size();
+                    start = pos;
+                    matched = true;
+                    break;
+                }
+            }
+        }
+        if (!matched) {
+            pos++;
+        }
+    }
+    add_text(start, text.size());
+    return res;
+}
+
+// copy_state saves the state of the context into state.
+static void copy_state(llama_context * ctx, std::vector<uint8_t> & state) {
+    state.resize(llama_get_state_size(ctx));
+    state.resize(llama_copy_state_data(ctx, state.data()));
+}
+
+// log_softmax replaces the logits with their log probabilities.
+static void log_softmax(float * logits, int n) {
+    const float max_logit = *std::max_element(logits, logits + n);
+    double sum_exp = 0.0;
+    for (int i = 0; i < n; i++) {
+        sum_exp += std::exp(logits[i] - max_logit);
+    }
+    const float log_sum = max_logit + (float) std::log(sum_exp);
+    for (int i = 0; i < n; i++) {
+        logits[i] -= log_sum;
+    }
+}
+
+// apply_guidance mixes the logits with the ones of the guidance sequence like upstream
+// llama_sample_classifier_free_guidance, which is missing from the pinned llama.cpp.
+static void apply_guidance(float * logits, std::vector<float> & guidance_logits, int n_vocab, float scale) {
+    log_softmax(logits, n_vocab);
+    log_softmax(guidance_logits.data(), n_vocab);
+    for (int i = 0; i < n_vocab; i++) {
+        logits[i] = guidance_logits[i] + scale * (logits[i] - guidance_logits[i]);
+    }
+}
+
+// beam is a hypothesis of beam_search.
+struct beam {
+    std::vector<llama_token> tokens;
+    std::vector<float> logprobs;
+    float logprob = 0.0f;
+    bool done = false;
+    // state of the context once the tokens but the last one are evaluated
+    std::shared_ptr<std::vector<uint8_t>> state;
+    int n_past = 0;
+
+    float score(float length_penalty) const {
+        return logprob / std::pow((float) std::max<size_t>(tokens.size(), 1), length_penalty);
+    }
+};
+
+// beam_search generates the text with the most likely tokens sequence found with a beam search
+// instead of sampling. The context state is saved for each beam, which takes a lot of memory
+// with large contexts.
+static int beam_search(llama_context * ctx, const binding_params & params, const std::vector<llama_token> & embd_inp,
+                       const std::function<bool(llama_token)> & is_eog, const std::function<bool()> & timed_out,
+                       void * state_pr, sampled_tokens & sampled, std::string & res, int64_t & t_prompt_end_us) {
+    const int n_ctx = llama_n_ctx(ctx);
+    const int n_vocab = llama_n_vocab(ctx);
+    const int n_beams = params.n_beams;
+
+    auto save_state = [&]() {
+        auto state = std::make_shared<std::vector<uint8_t>>();
+        copy_state(ctx, *state);
+        return state;
+    };
+
+    // evaluate the prompt once for all the beams
+    int n_past = 0;
+    for (int i = 0; i < (int) embd_inp.size(); i += params.n_batch) {
+        const int n_eval = std::min((int) embd_inp.size() - i, params.n_batch);
+        if (llama_eval(ctx, &embd_inp[i], n_eval, n_past, batch_threads(params))) {
+            binding_log(LOG_LEVEL_ERROR, "%s : failed to eval\n", __func__);
+            return 1;
+        }
+        n_past += n_eval;
+        sampled.n_prompt_eval += n_eval;
+        prompt_progress(params, state_pr, n_past, (int) embd_inp.size());
+    }
+    t_prompt_end_us = ggml_time_us();
+    trace(params, state_pr, TRACE_PROMPT_EVAL, sampled.n_prompt_eval, true);
+
+    std::vector<beam> beams(1);
+    beams[0].state = save_state();
+    beams[0].n_past = n_past;
+
+    struct candidate {
+        size_t parent;
+        llama_token id;
+        float logprob;
+    };
+    std::vector<candidate> candidates;
+    std::vector<std::pair<float, llama_token>> token_logprobs(n_vocab);
+
+    sampled.finish_reason = FINISH_LENGTH;
+    for (int n_step = 0; params.n_predict < 0 || n_step < params.n_predict; n_step++) {
+        if (params.canceled->load()) {
+            sampled.finish_reason = FINISH_CANCELED;
+            break;
+        }
+        if (timed_out()) {
+            sampled.finish_reason = FINISH_TIMEOUT;
+            break;
+        }
+
+        // extend each beam with its most likely tokens
+        candidates.clear();
+        for (size_t b = 0; b < beams.size(); b++) {
+            beam & bm = beams[b];
+            if (bm.done) {
+                continue;
+            }
+
+            llama_set_state_data(ctx, bm.state->data());
+            if (!bm.tokens.empty()) {
+                if (bm.n_past + 1 > n_ctx) {
+                    bm.done = true;
+                    continue;
+                }
+                if (llama_eval(ctx, &bm.tokens.back(), 1, bm.n_past, params.n_threads)) {
+                    binding_log(LOG_LEVEL_ERROR, "%s : failed to eval\n", __func__);
+                    return 1;
+                }
+                bm.n_past++;
+                bm.state = save_state();
+            }
+
+            float * logits = llama_get_logits(ctx);
+            for (auto it = params.logit_bias.begin(); it != params.logit_bias.end(); it++) {
+                if (it->first >= 0 && it->first < n_vocab) {
+                    logits[it->first] += it->second;
+                }
+            }
+
+            const float max_logit = *std::max_element(logits, logits + n_vocab);
+            double sum_exp = 0.0;
+            for (int i = 0; i < n_vocab; i++) {
+                sum_exp += std::exp(logits[i] - max_logit);
+            }
+            const float log_sum = max_logit + (float) std::log(sum_exp);
+
+            for (int i = 0; i < n_vocab; i++) {
+                token_logprobs[i] = std::make_pair(logits[i] - log_sum, (llama_token) i);
+            }
+            const int n_top = std::min(n_beams, n_vocab);
+            std::partial_sort(token_logprobs.begin(), token_logprobs.begin() + n_top, token_logprobs.end(),
+                [](const std::pair<float, llama_token> & a, const std::pair<float, llama_token> & b) { return a.first > b.first; });
+            for (int i = 0; i < n_top; i++) {
+                if (std::isinf(token_logprobs[i].first)) {
+                    break;
+                }
+                candidates.push_back({b, token_logprobs[i].second, token_logprobs[i].first});
+            }
+        }
+
+        if (candidates.empty()) {
+            break;
+        }
+
+        // keep the best beams among the finished ones and the extended ones
+        std::vector<beam> next;
+        for (const auto & bm : beams) {
+            if (bm.done) {
+                next.push_back(bm);
+            }
+        }
+        for (const auto & c : candidates) {
+            beam child = beams[c.parent];
+            child.tokens.push_back(c.id);
+            child.logprobs.push_back(c.logprob);
+            child.logprob += c.logprob;
+            child.done = is_eog(c.id);
+            next.push_back(child);
+        }
+        std::sort(next.begin(), next.end(), [&](const beam & a, const beam & b) {
+            return a.score(params.length_penalty) > b.score(params.length_penalty);
+        });
+        if ((int) next.size() > n_beams) {
+            next.resize(n_beams);
+        }
+        beams.swap(next);
+
+        bool all_done = true;
+        for (const auto & bm : beams) {
+            all_done = all_done && bm.done;
+        }
+        if (all_done || (params.beam_early_stopping && beams[0].done)) {
+            break;
+        }
+    }
+
+    // the best beam is the answer, the others are reported as alternatives
+    std::sort(beams.begin(), beams.end(), [&](const beam & a, const beam & b) {
+        return a.score(params.length_penalty) > b.score(params.length_penalty);
+    });
+    for (const auto & bm : beams) {
+        std::string text;
+        std::vector<int> ids;
+        for (auto id : bm.tokens) {
+            if (is_eog(id)) {
+                break;
+            }
+            const char * token_str = llama_token_to_str(ctx, id);
+            text += token_str != nullptr ? token_str : "";
+            ids.push_back(id);
+        }
+        sampled.beam_texts.push_back(text);
+        sampled.beam_ids.push_back(ids);
+        sampled.beam_scores.push_back(bm.score(params.length_penalty));
+    }
+
+    const beam & best = beams[0];
+    sampled.n_predicted = (int) best.tokens.size();
+    if (best.done && !best.tokens.empty() && is_eog(best.tokens.back())) {
+        sampled.finish_reason = FINISH_EOS;
+    }
+    for (size_t i = 0; i < best.tokens.size(); i++) {
+        const llama_token id = best.tokens[i];
+        if (is_eog(id)) {
+            break;
+        }
+        const char * token_str = llama_token_to_str(ctx, id);
+        if (!tokenCallback(state_pr, (char *) token_str, id, best.logprobs[i], (int) i, id == llama_token_bos())) {
+            sampled.finish_reason = FINISH_CANCELED;
+            break;
+        }
+        const std::string piece = token_str != nullptr ? token_str : "";
+        res += piece;
+        sampled.ids.push_back(id);
+        sampled.pieces += piece;
+        sampled.piece_lens.push_back((int) piece.size());
+        sampled.logprobs.push_back(best.logprobs[i]);
+    }
+
+    return 0;
+}
+
+int llama_predict(void* params_ptr, void* state_pr, char* result, bool debug, llama_predict_result* out) {
+    binding_params* params_p = (binding_params*) params_ptr;
     llama_context* ctx = (llama_context*) state_pr;
   
-    gpt_params params = *params_p;
+    binding_params params = *params_p;
+    thread_settings settings(params);
 
+    // pick a random seed, it is reported in the result so the prediction can be reproduced
     if (params.seed <= 0) {
-        params.seed = time(NULL);
+        params.seed = random_seed();
     }
-
-    std::mt19937 rng(params.seed);
+    llama_set_rng_seed(ctx, params.seed);
   
     // Add a space in front of the first character to match OG llama tokenizer behavior
     params.prompt.insert(0, 1, ' ');
 
-    // tokenize the prompt
-    auto embd_inp = ::llama_tokenize(ctx, params.prompt, true);
+    // tokenize the prompt, unless it is already tokenized
+    trace(params, state_pr, TRACE_TOKENIZE, 0, false);
+    auto embd_inp = params.prompt_tokens.empty() ? tokenize_text(ctx, params.prompt, params.add_bos, params.parse_special) : params.prompt_tokens;
+
+    // the system prompt replaces the beginning of stream token of text prompts
+    const auto system_prompt = get_system_prompt(ctx);
+    const int n_system = params.prompt_tokens.empty() && !params.infill ? (int) system_prompt.size() : 0;
+    if (n_system > 0) {
+        embd_inp = system_prompt;
+        auto prompt = tokenize_text(ctx, params.prompt, false, params.parse_special);
+        embd_inp.insert(embd_inp.end(), prompt.begin(), prompt.end());
+    }
+
+    // a fill-in-the-middle prompt is made of the prefix and the suffix
+    if (params.infill) {
+        const llama_token pre = params.fim_pre >= 0 ? params.fim_pre : find_token(ctx, "<PRE>");
+        const llama_token suf = params.fim_suf >= 0 ? params.fim_suf : find_token(ctx, "<SUF>");
+        const llama_token mid = params.fim_mid >= 0 ? params.fim_mid : find_token(ctx, "<MID>");
+        const llama_token eot = params.fim_eot >= 0 ? params.fim_eot : find_token(ctx, "<EOT>");
+        if (pre < 0 || suf < 0 || mid < 0) {
+            binding_log(LOG_LEVEL_ERROR, "%s : the model has no fill-in-the-middle tokens\n", __func__);
+            return 3;
+        }
+
+        auto prefix = ::llama_tokenize(ctx, " " + params.infill_prefix, false);
+        auto suffix = ::llama_tokenize(ctx, " " + params.infill_suffix, false);
+        embd_inp = { llama_token_bos(), pre };
+        embd_inp.insert(embd_inp.end(), prefix.begin(), prefix.end());
+        embd_inp.push_back(suf);
+        embd_inp.insert(embd_inp.end(), suffix.begin(), suffix.end());
+        embd_inp.push_back(mid);
+        if (eot >= 0) {
+            params.stop_token_ids.push_back(eot);
+        }
+    }
+    trace(params, state_pr, TRACE_TOKENIZE, (int) embd_inp.size(), true);
 
     const int n_ctx = llama_n_ctx(ctx);
 
@@ -115,10 +1100,51 @@ int llama_predict(void* params_ptr, void* state_pr, char* result, bool debug) {
     if (params.n_keep < 0 || params.n_keep > (int)embd_inp.size() || params.instruct) {
         params.n_keep = (int)embd_inp.size();
     }
+    // the attention sinks are the first tokens of the context, whether they belong to the prompt
+    // or were generated
+    if (params.n_sinks > 0) {
+        params.n_keep = std::min(params.n_sinks, n_ctx / 2);
+    }
+    // context shifts never discard the system prompt
+    params.n_keep = std::max(params.n_keep, n_system);
 
     // determine newline token
     auto llama_token_newline = ::llama_tokenize(ctx, "\n", false);
 
+    // determine the tokens ending the generation
+    const llama_token eos = params.eos_token >= 0 ? params.eos_token : llama_token_eos();
+    auto is_eog = [&](llama_token id) {
+        return id == eos || std::find(params.stop_token_ids.begin(), params.stop_token_ids.end(), id) != params.stop_token_ids.end();
+    };
+    if (params.ignore_eos) {
+        params.logit_bias[eos] = -INFINITY;
+        for (auto id : params.stop_token_ids) {
+            params.logit_bias[id] = -INFINITY;
+        }
+    }
+
+    // resolve the text biases with the vocabulary of the model
+    for (const auto & bias : params.token_bias) {
+        for (auto token : ::llama_tokenize(ctx, bias.first, false)) {
+            params.logit_bias[token] += bias.second;
+        }
+    }
+
+    std::unique_ptr<llama_grammar, decltype(&llama_grammar_free)> grammar(nullptr, llama_grammar_free);
+    // a lazy grammar is only applied once one of its triggers was generated
+    bool grammar_active = params.grammar_triggers.empty() && params.grammar_trigger_tokens.empty();
+    std::string grammar_text;
+    if (!params.grammar.empty()) {
+        try {
+            grammar_parser::parse_state parsed_grammar = grammar_parser::parse(params.grammar.c_str());
+            std::vector<const llama_grammar_element *> grammar_rules(parsed_grammar.c_rules());
+            grammar.reset(llama_grammar_init(grammar_rules.data(), grammar_rules.size(), parsed_grammar.symbol_ids.at("root")));
+        } catch (const std::exception & e) {
+            binding_log(LOG_LEVEL_ERROR, "%s : failed to parse grammar: %s\n", __func__, e.what());
+            return 2;
+        }
+    }
+
     // TODO: replace with ring-buffer
     std::vector<llama_token> last_n_tokens(n_ctx);
     std::fill(last_n_tokens.begin(), last_n_tokens.end(), 0);
@@ -130,7 +1156,122 @@ int llama_predict(void* params_ptr, void* state_pr, char* result, bool debug) {
     std::vector<llama_token> embd;
     std::string res = "";
 
+    // the sampled tokens reported in the result
+    sampled_tokens sampled;
+    token_batch pending_tokens;
+    // time the last token was generated, to pace them at max_tokens_per_second
+    int64_t t_last_token_us = 0;
+    sampled.n_prompt_tokens = (int) embd_inp.size();
+    sampled.seed = params.seed;
+    const int64_t t_start_us = ggml_time_us();
+    int64_t t_prompt_end_us = 0;
+    trace(params, state_pr, TRACE_PROMPT_EVAL, (int) embd_inp.size(), false);
+    auto timed_out = [&]() {
+        return params.max_duration_us > 0 && ggml_time_us() - t_start_us >= params.max_duration_us;
+    };
+
+    // the prompt must leave room for generating at least a few tokens
+    if ((int) embd_inp.size() > n_ctx - 4) {
+        binding_log(LOG_LEVEL_ERROR, "%s : prompt is too long (%d tokens, max %d)\n", __func__, (int) embd_inp.size(), n_ctx - 4);
+        sampled.finish_reason = FINISH_CONTEXT_FULL;
+        n_remain = 0;
+    }
+    sampled.n_probs = std::min(std::max(params.n_probs, 0), llama_n_vocab(ctx));
+    std::vector<llama_token_data> top_candidates;
+
+    // number of tokens sampled so far
+    int n_sampled = 0;
+    // mirostat state, it belongs to the prediction so predictions can run concurrently on
+    // several contexts
+    float mirostat_mu = 2.0f * params.mirostat_tau;
+    // entropy of the sampled positions and log probability of the sampled tokens, summed
+    double sum_entropy = 0.0;
+    float sum_logprob = 0.0f;
+
+    banned_strings banned(ctx, params.banned_strings);
+
+    // the guidance sequence is the negative prompt followed by the sampled tokens, it is
+    // evaluated in the guidance context, from its start for each prediction
+    bool use_guidance = params.ctx_guidance != nullptr && !params.cfg_negative_prompt.empty() && params.cfg_scale != 1.0f;
+    std::vector<llama_token> guidance_pending;
+    int guidance_n_past = 0;
+    std::vector<float> guidance_logits;
+    if (use_guidance) {
+        guidance_pending = ::llama_tokenize(params.ctx_guidance, " " + params.cfg_negative_prompt, true);
+    }
+
+    // the tokens at the positions 0 to n_past of the context, they are not evaluated again
+    std::vector<llama_token> evaluated = take_context_tokens(ctx);
+    // update the prompt cache file, see path_session
+    bool save_session = false;
+
+    // start right after the prompt when it was already evaluated
+    if (params.cache != nullptr && params.cache->valid && params.cache->tokens == embd_inp && n_remain != 0) {
+        llama_set_state_data(ctx, params.cache->state.data());
+        llama_set_rng_seed(ctx, params.seed);
+        n_past = params.cache->n_past;
+        evaluated = params.cache->tokens;
+        n_consumed = (int) embd_inp.size();
+        last_n_tokens = params.cache->last_n_tokens;
+        res = params.cache->res;
+    }
+
+    if (params.n_beams > 0 && n_remain != 0) {
+        res = params.prompt;
+        sampled.prompt_text_len = (int) res.size();
+        int ret = beam_search(ctx, params, embd_inp, is_eog, timed_out, state_pr, sampled, res, t_prompt_end_us);
+        if (ret != 0) {
+            return ret;
+        }
+        evaluated.clear();
+        n_remain = 0;
+    }
+
+    // reuse the start of the prompt held by the context, or evaluated by a previous run like the
+    // --prompt-cache option of main
+    if (!embd_inp.empty() && n_past == 0 && n_remain != 0) {
+        auto matching = [&]() {
+            size_t n = 0;
+            while (n < evaluated.size() && n < embd_inp.size() && evaluated[n] == embd_inp[n]) {
+                n++;
+            }
+            return n;
+        };
+
+        // the cache file is only loaded when the context shares no more than the first token
+        // with the prompt, loading it replaces the context
+        if (!params.path_session.empty() && matching() <= 1) {
+            FILE * fp = fopen(params.path_session.c_str(), "rb");
+            if (fp != NULL) {
+                fclose(fp);
+
+                evaluated.resize(n_ctx);
+                size_t n_token_count_out = 0;
+                if (!llama_load_session_file(ctx, params.path_session.c_str(), evaluated.data(), evaluated.capacity(), &n_token_count_out)) {
+                    binding_log(LOG_LEVEL_ERROR, "%s : failed to load session file '%s'\n", __func__, params.path_session.c_str());
+                    return 1;
+                }
+                evaluated.resize(n_token_count_out);
+                llama_set_rng_seed(ctx, params.seed);
+            }
+        }
+
+        // the last token of the prompt is evaluated again to compute the logits
+        const size_t n_matching = std::min(matching(), embd_inp.size() - 1);
+        evaluated.resize(n_matching);
+        save_session = !params.path_session.empty() && !params.prompt_cache_ro && n_matching < embd_inp.size() - 1;
+    }
+
     while (n_remain != 0) {
+        if (params.canceled->load()) {
+            sampled.finish_reason = FINISH_CANCELED;
+            break;
+        }
+        if (timed_out()) {
+            sampled.finish_reason = FINISH_TIMEOUT;
+            break;
+        }
+
         // predict
         if (embd.size() > 0) {
             // infinite text generation via context swapping
@@ -140,52 +1281,135 @@ int llama_predict(void* params_ptr, void* state_pr, char* result, bool debug) {
             if (n_past + (int) embd.size() > n_ctx) {
                 const int n_left = n_past - params.n_keep;
 
+                // nothing can be discarded when the whole context has to be kept
+                if (n_left / 2 <= 0) {
+                    sampled.finish_reason = FINISH_CONTEXT_FULL;
+                    break;
+                }
+
                 n_past = std::max(1, params.n_keep);
 
                 // insert n_left/2 tokens at the start of embd from last_n_tokens
                 embd.insert(embd.begin(), last_n_tokens.begin() + n_ctx - n_left/2 - embd.size(), last_n_tokens.end() - embd.size());
+
+                // the kept tokens are still at the start of the context
+                evaluated.resize(n_past);
+                save_session = false;
             }
 
+            // skip the tokens the context already holds
+            size_t n_skip = 0;
+            while (n_skip < embd.size() && n_past < (int) evaluated.size() && embd[n_skip] == evaluated[n_past]) {
+                n_past++;
+                n_skip++;
+            }
+            evaluated.resize(n_past);
+            embd.erase(embd.begin(), embd.begin() + n_skip);
+
             for (int i = 0; i < (int) embd.size(); i += params.n_batch) {
                 int n_eval = (int) embd.size() - i;
                 if (n_eval > params.n_batch) {
                     n_eval = params.n_batch;
                 }
-                if (llama_eval(ctx, &embd[i], n_eval, n_past, params.n_threads)) {
-                    fprintf(stderr, "%s : failed to eval\n", __func__);
+                if (params.canceled->load()) {
+                    sampled.finish_reason = FINISH_CANCELED;
+                    goto end;
+                }
+                if (timed_out()) {
+                    sampled.finish_reason = FINISH_TIMEOUT;
+                    goto end;
+                }
+                trace(params, state_pr, TRACE_DECODE, n_eval, false);
+                const int n_threads = t_prompt_end_us == 0 ? batch_threads(params) : params.n_threads;
+                if (llama_eval(ctx, &embd[i], n_eval, n_past, n_threads)) {
+                    binding_log(LOG_LEVEL_ERROR, "%s : failed to eval\n", __func__);
                     return 1;
                 }
+                trace(params, state_pr, TRACE_DECODE, n_eval, true);
                 n_past += n_eval;
+                if (t_prompt_end_us == 0) {
+                    sampled.n_prompt_eval += n_eval;
+                    prompt_progress(params, state_pr, n_past, (int) embd_inp.size());
+                }
             }
+
+            evaluated.insert(evaluated.end(), embd.begin(), embd.end());
         }
 
         embd.clear();
+        // whether the sampled token is a special token left out of the text
+        bool hidden = false;
 
         if ((int) embd_inp.size() <= n_consumed) {
             // out of user input, sample next token
+            if (t_prompt_end_us == 0) {
+                t_prompt_end_us = ggml_time_us();
+                sampled.prompt_text_len = (int) res.size();
+                trace(params, state_pr, TRACE_PROMPT_EVAL, sampled.n_prompt_eval, true);
+            }
+            if (save_session) {
+                save_session = false;
+                llama_save_session_file(ctx, params.path_session.c_str(), evaluated.data(), evaluated.size());
+            }
+            if (params.cache != nullptr && !params.cache->valid) {
+                params.cache->valid = true;
+                params.cache->tokens = embd_inp;
+                copy_state(ctx, params.cache->state);
+                params.cache->n_past = n_past;
+                params.cache->last_n_tokens = last_n_tokens;
+                params.cache->res = res;
+            }
                 const float   temp            = params.temp;
             const int32_t top_k           = params.top_k <= 0 ? llama_n_vocab(ctx) : params.top_k;
             const float   top_p           = params.top_p;
             const float   tfs_z           = params.tfs_z;
             const float   typical_p       = params.typical_p;
-            const int32_t repeat_last_n   = params.repeat_last_n < 0 ? n_ctx : params.repeat_last_n;
-            const float   repeat_penalty  = params.repeat_penalty;
-            const float   alpha_presence  = params.presence_penalty;
-            const float   alpha_frequency = params.frequency_penalty;
+            const float   min_p           = params.min_p;
             const int     mirostat        = params.mirostat;
             const float   mirostat_tau    = params.mirostat_tau;
             const float   mirostat_eta    = params.mirostat_eta;
-            const bool    penalize_nl     = params.penalize_nl;
 
             llama_token id = 0;
+            float logprob = 0.0f;
 
+            if (use_guidance && guidance_n_past + (int) guidance_pending.size() > llama_n_ctx(params.ctx_guidance)) {
+                binding_log(LOG_LEVEL_WARN, "%s : guidance sequence does not fit in the context, disabling guidance\n", __func__);
+                use_guidance = false;
+            }
+            if (use_guidance) {
+                for (int i = 0; i < (int) guidance_pending.size(); i += params.n_batch) {
+                    const int n_eval = std::min((int) guidance_pending.size() - i, params.n_batch);
+                    if (llama_eval(params.ctx_guidance, &guidance_pending[i], n_eval, guidance_n_past, n_eval > 1 ? batch_threads(params) : params.n_threads)) {
+                        binding_log(LOG_LEVEL_ERROR, "%s : failed to eval\n", __func__);
+                        return 1;
+                    }
+                    guidance_n_past += n_eval;
+                }
+                guidance_pending.clear();
+
+                const float * logits = llama_get_logits(params.ctx_guidance);
+                guidance_logits.assign(logits, logits + llama_n_vocab(params.ctx_guidance));
+            }
+
+            const int64_t t_sample_start_us = ggml_time_us();
+            trace(params, state_pr, TRACE_SAMPLE, 1, false);
             {
                 auto logits = llama_get_logits(ctx);
                 auto n_vocab = llama_n_vocab(ctx);
 
+                if (use_guidance) {
+                    apply_guidance(logits, guidance_logits, n_vocab, params.cfg_scale);
+                }
+
                 // Apply params.logit_bias map
                 for (auto it = params.logit_bias.begin(); it != params.logit_bias.end(); it++) {
-                    logits[it->first] += it->second;
+                    if (it->first >= 0 && it->first < n_vocab) {
+                        logits[it->first] += it->second;
+                    }
+                }
+                banned.mask(logits);
+                if (params.logits_processor) {
+                    logitsCallback(state_pr, n_sampled, logits, n_vocab);
                 }
 
                 std::vector<llama_token_data> candidates;
@@ -196,76 +1420,212 @@ int llama_predict(void* params_ptr, void* state_pr, char* result, bool debug) {
 
                 llama_token_data_array candidates_p = { candidates.data(), candidates.size(), false };
 
-                // Apply penalties
-                float nl_logit = logits[llama_token_nl()];
-                auto last_n_repeat = std::min(std::min((int)last_n_tokens.size(), repeat_last_n), n_ctx);
-                llama_sample_repetition_penalty(ctx, &candidates_p,
-                    last_n_tokens.data() + last_n_tokens.size() - last_n_repeat,
-                    last_n_repeat, repeat_penalty);
-                llama_sample_frequency_and_presence_penalties(ctx, &candidates_p,
-                    last_n_tokens.data() + last_n_tokens.size() - last_n_repeat,
-                    last_n_repeat, alpha_frequency, alpha_presence);
-                if (!penalize_nl) {
-                    logits[llama_token_nl()] = nl_logit;
+                if (grammar != nullptr && grammar_active) {
+                    llama_sample_grammar(ctx, &candidates_p, grammar.get());
+                }
+
+                // normalizer of the distribution before the samplers are applied, used to report
+                // the log probability of the sampled token
+                float max_logit = -INFINITY;
+                llama_token max_id = 0;
+                for (size_t i = 0; i < candidates_p.size; i++) {
+                    if (candidates_p.data[i].logit > max_logit) {
+                        max_logit = candidates_p.data[i].logit;
+                        max_id = candidates_p.data[i].id;
+                    }
+                }
+                double sum_exp = 0.0;
+                double sum_exp_logit = 0.0;
+                for (size_t i = 0; i < candidates_p.size; i++) {
+                    const float logit = candidates_p.data[i].logit;
+                    const float e = expf(logit - max_logit);
+                    sum_exp += e;
+                    if (e > 0.0f) {
+                        sum_exp_logit += e * logit;
+                    }
+                }
+                const float log_sum = max_logit + (float) log(sum_exp);
+                sum_entropy += log_sum - sum_exp_logit / sum_exp;
+
+                if (sampled.n_probs > 0) {
+                    top_candidates.assign(candidates_p.data, candidates_p.data + candidates_p.size);
+                    std::partial_sort(top_candidates.begin(), top_candidates.begin() + sampled.n_probs, top_candidates.end(),
+                        [](const llama_token_data & a, const llama_token_data & b) { return a.logit > b.logit; });
+                    top_candidates.resize(sampled.n_probs);
+                    for (auto & candidate : top_candidates) {
+                        candidate.p = candidate.logit - log_sum;
+                    }
+                }
+
+                // Greedy and mirostat sampling always apply the penalties first, the temperature
+                // sampling chain applies them in the configured order.
+                if (!params.greedy && (temp <= 0 || mirostat != 0)) {
+                    sample_penalties(ctx, &candidates_p, params, last_n_tokens);
                 }
 
-                if (temp <= 0) {
+                if (params.greedy) {
+                    // the most likely token, without any sampler
+                    id = max_id;
+                } else if (temp <= 0) {
                     // Greedy sampling
                     id = llama_sample_token_greedy(ctx, &candidates_p);
                 } else {
                     if (mirostat == 1) {
-                        static float mirostat_mu = 2.0f * mirostat_tau;
                         const int mirostat_m = 100;
                         llama_sample_temperature(ctx, &candidates_p, temp);
                         id = llama_sample_token_mirostat(ctx, &candidates_p, mirostat_tau, mirostat_eta, mirostat_m, &mirostat_mu);
                     } else if (mirostat == 2) {
-                        static float mirostat_mu = 2.0f * mirostat_tau;
                         llama_sample_temperature(ctx, &candidates_p, temp);
                         id = llama_sample_token_mirostat_v2(ctx, &candidates_p, mirostat_tau, mirostat_eta, &mirostat_mu);
                     } else {
                         // Temperature sampling
-                        llama_sample_top_k(ctx, &candidates_p, top_k, 1);
-                        llama_sample_tail_free(ctx, &candidates_p, tfs_z, 1);
-                        llama_sample_typical(ctx, &candidates_p, typical_p, 1);
-                        llama_sample_top_p(ctx, &candidates_p, top_p, 1);
-                        llama_sample_temperature(ctx, &candidates_p, temp);
-                        id = llama_sample_token(ctx, &candidates_p);
+                        for (int sampler : params.sampler_order) {
+                            switch (sampler) {
+                                case SAMPLER_PENALTIES:   sample_penalties(ctx, &candidates_p, params, last_n_tokens); break;
+                                case SAMPLER_TOP_K:       llama_sample_top_k(ctx, &candidates_p, top_k, 1); break;
+                                case SAMPLER_TAIL_FREE:   llama_sample_tail_free(ctx, &candidates_p, tfs_z, 1); break;
+                                case SAMPLER_TYPICAL:     llama_sample_typical(ctx, &candidates_p, typical_p, 1); break;
+                                case SAMPLER_TOP_P:       llama_sample_top_p(ctx, &candidates_p, top_p, 1); break;
+                                case SAMPLER_MIN_P:       sample_min_p(ctx, &candidates_p, min_p, 1); break;
+                                case SAMPLER_TEMPERATURE: llama_sample_temperature(ctx, &candidates_p, temp); break;
+                            }
+                        }
+                        if (params.go_rand) {
+                            id = sample_token_uniform(ctx, &candidates_p, randCallback(state_pr));
+                        } else {
+                            id = llama_sample_token(ctx, &candidates_p);
+                        }
                     }
                 }
                 // printf("`%d`", candidates_p.size);
 
+                logprob = logits[id] - log_sum;
+                sum_logprob += logprob;
+
                 last_n_tokens.erase(last_n_tokens.begin());
                 last_n_tokens.push_back(id);
+                guidance_pending.push_back(id);
+                banned.accept(id);
+            }
+            sampled.t_sample_us += ggml_time_us() - t_sample_start_us;
+            trace(params, state_pr, TRACE_SAMPLE, 1, true);
+
+            // stop before the token when the model is no longer confident
+            if ((params.max_entropy > 0.0f && sum_entropy / (n_sampled + 1) > params.max_entropy) ||
+                (params.min_logprob < 0.0f && sum_logprob < params.min_logprob)) {
+                sampled.finish_reason = FINISH_LOW_CONFIDENCE;
+                break;
+            }
+
+            // stop when the grammar cannot be continued
+            if (grammar != nullptr && grammar_active && !llama_grammar_accept_token(ctx, grammar.get(), id)) {
+                sampled.finish_reason = FINISH_EOS;
+                break;
+            }
+
+            // a lazy grammar constrains the text following its trigger
+            if (grammar != nullptr && !grammar_active) {
+                if (std::find(params.grammar_trigger_tokens.begin(), params.grammar_trigger_tokens.end(), id) != params.grammar_trigger_tokens.end()) {
+                    grammar_active = true;
+                } else {
+                    const char * piece = llama_token_to_str(ctx, id);
+                    const size_t start = grammar_text.size();
+                    grammar_text += piece != nullptr ? piece : "";
+                    for (const auto & trigger : params.grammar_triggers) {
+                        // only look at the matches ending in this token
+                        const size_t from = start >= trigger.size() ? start - trigger.size() + 1 : 0;
+                        const size_t pos = grammar_text.find(trigger, from);
+                        if (pos == std::string::npos) {
+                            continue;
+                        }
+                        grammar_active = true;
+                        if (!llama_grammar_accept_str(grammar.get(), grammar_text.substr(pos + trigger.size()))) {
+                            sampled.finish_reason = FINISH_EOS;
+                            goto end;
+                        }
+                        break;
+                    }
+                }
             }
 
             // add it to the context
             embd.push_back(id);
+            sampled.n_predicted++;
 
             // decrement remaining sampling budget
             --n_remain;
 
+            // wait until the token is due, in short steps so the prediction can still be canceled
+            if (params.max_tokens_per_second > 0.0f) {
+                if (t_last_token_us > 0) {
+                    const int64_t t_due_us = t_last_token_us + (int64_t) (1e6 / params.max_tokens_per_second);
+                    for (int64_t now = ggml_time_us(); now < t_due_us && !params.canceled->load() && !timed_out(); now = ggml_time_us()) {
+                        std::this_thread::sleep_for(std::chrono::microseconds(std::min<int64_t>(t_due_us - now, 10000)));
+                    }
+                }
+                t_last_token_us = ggml_time_us();
+            }
 
             // call the token callback, no need to check if one is actually registered, that will
             // be handled on the Go side.
             auto token_str = llama_token_to_str(ctx, id);
-            if (!tokenCallback(state_pr, (char*)token_str)) {
+            const bool special = is_eog(id) || id == llama_token_eos() || id == llama_token_bos();
+            const bool shown = !special || params.special_tokens;
+            hidden = !shown;
+            if (shown && params.token_batch > 1) {
+                // the batch is passed once full, a cancellation drops the tokens from the one it
+                // stopped at
+                pending_tokens.add(id, token_str, logprob, n_sampled++, special, res, sampled);
+                if ((int) pending_tokens.ids.size() >= params.token_batch && !pending_tokens.flush(state_pr, res, sampled)) {
+                    sampled.finish_reason = FINISH_CANCELED;
+                    break;
+                }
+            } else if (shown && !tokenCallback(state_pr, (char*)token_str, id, logprob, n_sampled++, special)) {
+                sampled.finish_reason = FINISH_CANCELED;
+                break;
+            }
+
+            if (shown) {
+                const std::string piece = token_str != nullptr ? token_str : "";
+                sampled.ids.push_back(id);
+                sampled.pieces += piece;
+                sampled.piece_lens.push_back((int) piece.size());
+                sampled.logprobs.push_back(logprob);
+
+                for (const auto & candidate : top_candidates) {
+                    const char * top_str = llama_token_to_str(ctx, candidate.id);
+                    const std::string top_piece = top_str != nullptr ? top_str : "";
+                    sampled.top_ids.push_back(candidate.id);
+                    sampled.top_pieces += top_piece;
+                    sampled.top_piece_lens.push_back((int) top_piece.size());
+                    sampled.top_logprobs.push_back(candidate.p);
+                }
+            }
+
+            // the text of the tokens ending the generation is only part of the output when the
+            // special tokens are shown
+            if (is_eog(id)) {
+                if (shown && token_str != nullptr) {
+                    res += token_str;
+                }
+                sampled.finish_reason = FINISH_EOS;
                 break;
             }
         } else {
-            // some user input remains from prompt or interaction, forward it to processing
+            // the rest of the prompt is forwarded at once, it is evaluated in batches of n_batch
+            // tokens without going through the loop for each batch
             while ((int) embd_inp.size() > n_consumed) {
                 embd.push_back(embd_inp[n_consumed]);
                 last_n_tokens.erase(last_n_tokens.begin());
                 last_n_tokens.push_back(embd_inp[n_consumed]);
                 ++n_consumed;
-                if ((int) embd.size() >= params.n_batch) {
-                    break;
-                }
             }
         }
 
-        for (auto id : embd) {
-            res += llama_token_to_str(ctx, id);
+        if (!hidden) {
+            for (auto id : embd) {
+                res += llama_token_to_str(ctx, id);
+            }
         }
 
         // check for stop prompt
@@ -277,14 +1637,16 @@ int llama_predict(void* params_ptr, void* state_pr, char* result, bool debug) {
             // Check if each of the reverse prompts appears at the end of the output.
             for (std::string & antiprompt : params.antiprompt) {
                 if (last_output.find(antiprompt.c_str(), last_output.length() - antiprompt.length(), antiprompt.length()) != std::string::npos) {
+                    sampled.finish_reason = FINISH_STOP_WORD;
                     goto end;
                 }
             }
         }
       
         // end of text token
-        if (embd.back() == llama_token_eos()) {
-                break;
+        if (!embd.empty() && is_eog(embd.back())) {
+            sampled.finish_reason = FINISH_EOS;
+            break;
         }
     }
 
@@ -292,23 +1654,431 @@ end:
 #if defined (_WIN32)
     signal(SIGINT, SIG_DFL);
 #endif
+    // the prediction is over, stopping it at one of the last tokens still drops the following ones
+    if (!pending_tokens.flush(state_pr, res, sampled)) {
+        sampled.finish_reason = FINISH_CANCELED;
+    }
+
+    store_context_tokens(ctx, std::move(evaluated));
+
+    const int64_t t_end_us = ggml_time_us();
+    if (t_prompt_end_us == 0) {
+        // stopped before the end of the prompt
+        t_prompt_end_us = t_end_us;
+        sampled.prompt_text_len = (int) res.size();
+    }
+    sampled.t_prompt_us = t_prompt_end_us - t_start_us;
+    sampled.t_predict_us = t_end_us - t_prompt_end_us;
 
     if (debug) {
         llama_print_timings(ctx);
         llama_reset_timings(ctx);
     }
 
-    strcpy(result, res.c_str()); 
+    // the output buffer is optional, the text is also part of the result
+    if (result != nullptr) {
+        strcpy(result, res.c_str());
+    }
+    fill_result(out, sampled, res);
     return 0;
 }
 
 void llama_free_model(void *state_ptr) {
     llama_context* ctx = (llama_context*) state_ptr;
+    take_context_tokens(ctx);
+    {
+        std::lock_guard<std::mutex> lock(context_tokens_mutex);
+        system_prompts.erase(ctx);
+    }
     llama_free(ctx);
 }
 
+int llama_set_system_prompt(void* params_ptr, void* state_pr) {
+    binding_params* params = (binding_params*) params_ptr;
+    llama_context* ctx = (llama_context*) state_pr;
+    take_context_tokens(ctx);
+    {
+        std::lock_guard<std::mutex> lock(context_tokens_mutex);
+        system_prompts.erase(ctx);
+    }
+
+    std::vector<llama_token> tokens;
+    if (!params->prompt.empty()) {
+        tokens = tokenize_text(ctx, " " + params->prompt, params->add_bos, params->parse_special);
+        // leave room for the conversation
+        if ((int) tokens.size() > llama_n_ctx(ctx) / 2) {
+            binding_log(LOG_LEVEL_ERROR, "%s : system prompt is too long (%d tokens, max %d)\n", __func__, (int) tokens.size(), llama_n_ctx(ctx) / 2);
+            return 2;
+        }
+        for (int i = 0; i < (int) tokens.size(); i += params->n_batch) {
+            const int n_eval = std::min((int) tokens.size() - i, params->n_batch);
+            if (llama_eval(ctx, &tokens[i], n_eval, i, batch_threads(*params))) {
+                binding_log(LOG_LEVEL_ERROR, "%s : failed to eval\n", __func__);
+                return 1;
+            }
+        }
+        store_context_tokens(ctx, tokens);
+
+        std::lock_guard<std::mutex> lock(context_tokens_mutex);
+        system_prompts[ctx] = tokens;
+    }
+    return 0;
+}
+
+int llama_tokenize_string(void* state_ptr, const char* text, int text_len, bool add_bos, bool parse_special, int* tokens, int n_max_tokens) {
+    llama_context* ctx = (llama_context*) state_ptr;
+    const auto res = tokenize_text(ctx, std::string(text, text_len), add_bos, parse_special);
+    if ((int) res.size() > n_max_tokens) {
+        return -1;
+    }
+    std::copy(res.begin(), res.end(), tokens);
+    return (int) res.size();
+}
+
+int llama_special_token(void* state_ptr, int kind) {
+    llama_context* ctx = (llama_context*) state_ptr;
+    // the tokens this llama.cpp does not know are looked up by the names the model families use
+    std::vector<std::string> names;
+    switch (kind) {
+        case SPECIAL_TOKEN_BOS: return llama_token_bos();
+        case SPECIAL_TOKEN_EOS: return llama_token_eos();
+        case SPECIAL_TOKEN_NL:  return llama_token_nl();
+        case SPECIAL_TOKEN_EOT: names = { "<EOT>", "<|eot_id|>", "<|im_end|>", "<end_of_turn>", "<|end|>" }; break;
+        case SPECIAL_TOKEN_PAD: names = { "<pad>", "[PAD]", "<|pad|>" }; break;
+    }
+    for (const auto & name : names) {
+        const llama_token id = find_token(ctx, name);
+        if (id >= 0) {
+            return id;
+        }
+    }
+    return -1;
+}
+
+int llama_vocab_size(void* state_ptr) {
+    return llama_n_vocab((llama_context*) state_ptr);
+}
+
+int llama_embedding_size(void* state_ptr) {
+    return llama_n_embd((llama_context*) state_ptr);
+}
+
+const char* llama_token_piece(void* state_ptr, int token) {
+    llama_context* ctx = (llama_context*) state_ptr;
+    if (token < 0 || token >= llama_n_vocab(ctx)) {
+        return nullptr;
+    }
+    return llama_token_to_str(ctx, token);
+}
+
+int llama_token_count(void* state_ptr, const char* text, int text_len) {
+    return (int) ::llama_tokenize((llama_context*) state_ptr, std::string(text, text_len), false).size();
+}
+
+int llama_perplexity(void* state_ptr, const int* tokens, int n_tokens, int stride, int n_threads, int n_batch, double* nll, int* n_scored) {
+    llama_context* ctx = (llama_context*) state_ptr;
+    const int n_ctx = llama_n_ctx(ctx);
+    const int n_vocab = llama_n_vocab(ctx);
+    n_batch = std::min(std::max(n_batch, 1), max_batch);
+    take_context_tokens(ctx);
+
+    *nll = 0.0;
+    *n_scored = 0;
+    int prev_end = 0;
+    for (int begin = 0; prev_end < n_tokens; begin += stride) {
+        const int end = std::min(begin + n_ctx, n_tokens);
+        // the tokens scored by the previous windows are only the context of this one
+        const int first = std::max(prev_end, begin + 1);
+        int n_past = 0;
+        for (int i = begin; i < first - 1; i += n_batch) {
+            const int n_eval = std::min(first - 1 - i, n_batch);
+            if (llama_eval(ctx, (const llama_token *) tokens + i, n_eval, n_past, n_threads)) {
+                binding_log(LOG_LEVEL_ERROR, "%s : failed to eval\n", __func__);
+                return 1;
+            }
+            n_past += n_eval;
+        }
+
+        // the context only returns the logits of the last token evaluated
+        for (int i = first; i < end; i++) {
+            if (llama_eval(ctx, (const llama_token *) tokens + i - 1, 1, n_past, n_threads)) {
+                binding_log(LOG_LEVEL_ERROR, "%s : failed to eval\n", __func__);
+                return 1;
+            }
+            n_past++;
+
+            const float * logits = llama_get_logits(ctx);
+            float max_logit = -INFINITY;
+            for (int j = 0; j < n_vocab; j++) {
+                max_logit = std::max(max_logit, logits[j]);
+            }
+            double sum_exp = 0.0;
+            for (int j = 0; j < n_vocab; j++) {
+                sum_exp += exp(logits[j] - max_logit);
+            }
+            *nll += max_logit + log(sum_exp) - logits[tokens[i]];
+            (*n_scored)++;
+        }
+        prev_end = end;
+    }
+    return 0;
+}
+
+int llama_bench(void* state_ptr, int n_prompt, int n_gen, int n_batch, int n_threads, int64_t* t_prompt_us, int64_t* t_gen_us) {
+    llama_context* ctx = (llama_context*) state_ptr;
+    take_context_tokens(ctx);
+
+    // like llama-bench, the time does not depend on the tokens
+    std::vector<llama_token> tokens(std::max(n_prompt, 1), llama_token_bos());
+    int n_past = 0;
+    const int64_t t_start_us = ggml_time_us();
+    for (int i = 0; i < n_prompt; i += n_batch) {
+        const int n_eval = std::min(n_prompt - i, n_batch);
+        if (llama_eval(ctx, tokens.data(), n_eval, n_past, n_threads)) {
+            binding_log(LOG_LEVEL_ERROR, "%s : failed to eval\n", __func__);
+            return 1;
+        }
+        n_past += n_eval;
+    }
+    const int64_t t_prompt_end_us = ggml_time_us();
+    for (int i = 0; i < n_gen; i++) {
+        if (llama_eval(ctx, tokens.data(), 1, n_past, n_threads)) {
+            binding_log(LOG_LEVEL_ERROR, "%s : failed to eval\n", __func__);
+            return 1;
+        }
+        n_past++;
+    }
+    *t_prompt_us = t_prompt_end_us - t_start_us;
+    *t_gen_us = ggml_time_us() - t_prompt_end_us;
+    return 0;
+}
+
+int llama_redirect_stderr(int fd) {
+#if defined (__unix__) || (defined (__APPLE__) && defined (__MACH__))
+    fflush(stderr);
+    const int saved = dup(2);
+    if (saved < 0) {
+        return -1;
+    }
+    if (dup2(fd, 2) < 0) {
+        close(saved);
+        return -1;
+    }
+    return saved;
+#else
+    return -1;
+#endif
+}
+
+void llama_restore_stderr(int saved) {
+#if defined (__unix__) || (defined (__APPLE__) && defined (__MACH__))
+    fflush(stderr);
+    dup2(saved, 2);
+#endif
+}
+
+int llama_detokenize(void* state_ptr, const int* tokens, int n_tokens, char* text, int text_size) {
+    llama_context* ctx = (llama_context*) state_ptr;
+    const int n_vocab = llama_n_vocab(ctx);
+    std::string res;
+    for (int i = 0; i < n_tokens; i++) {
+        if (tokens[i] < 0 || tokens[i] >= n_vocab) {
+            return -1;
+        }
+        const char * piece = llama_token_to_str(ctx, tokens[i]);
+        if (piece != nullptr) {
+            res += piece;
+        }
+    }
+    memcpy(text, res.data(), std::min((int) res.size(), text_size));
+    return (int) res.size();
+}
+
+int llama_clone_context(void* src_ptr, void* dst_ptr) {
+    llama_context* src = (llama_context*) src_ptr;
+    llama_context* dst = (llama_context*) dst_ptr;
+
+    std::vector<uint8_t> state;
+    copy_state(src, state);
+    if (llama_get_state_size(dst) < state.size() || llama_set_state_data(dst, state.data()) != state.size()) {
+        binding_log(LOG_LEVEL_ERROR, "%s : the contexts do not match\n", __func__);
+        return 1;
+    }
+
+    std::lock_guard<std::mutex> lock(context_tokens_mutex);
+    auto tokens = context_tokens.find(src);
+    if (tokens != context_tokens.end()) {
+        context_tokens[dst] = tokens->second;
+    }
+    auto system = system_prompts.find(src);
+    if (system != system_prompts.end()) {
+        system_prompts[dst] = system->second;
+    }
+    return 0;
+}
+
+void llama_reset_context(void* state_ptr) {
+    llama_context* ctx = (llama_context*) state_ptr;
+    take_context_tokens(ctx);
+    {
+        std::lock_guard<std::mutex> lock(context_tokens_mutex);
+        system_prompts.erase(ctx);
+    }
+    llama_set_rng_seed(ctx, random_seed());
+}
+
+void llama_context_usage(void* state_ptr, context_usage* out) {
+    llama_context* ctx = (llama_context*) state_ptr;
+    out->n_ctx = llama_n_ctx(ctx);
+
+    std::lock_guard<std::mutex> lock(context_tokens_mutex);
+    auto tokens = context_tokens.find(ctx);
+    // this llama.cpp cannot clear the KV cache, once the tokens are forgotten what it holds is
+    // overwritten by the next prediction
+    out->n_kv_tokens = tokens != context_tokens.end() ? llama_get_kv_cache_token_count(ctx) : 0;
+    out->n_reusable = tokens != context_tokens.end() ? (int) tokens->second.size() : 0;
+    auto system = system_prompts.find(ctx);
+    out->n_system = system != system_prompts.end() ? (int) system->second.size() : 0;
+}
+
+size_t llama_state_size(void* state_ptr) {
+    return llama_get_state_size((llama_context*) state_ptr);
+}
+
+size_t llama_save_state(void* state_ptr, uint8_t* dst) {
+    llama_context* ctx = (llama_context*) state_ptr;
+    // the state is padded to its full size, the size llama_load_state expects
+    const size_t size = llama_get_state_size(ctx);
+    const size_t n = llama_copy_state_data(ctx, dst);
+    memset(dst + n, 0, size - n);
+    return size;
+}
+
+int llama_load_state(void* state_ptr, const uint8_t* src, size_t size) {
+    llama_context* ctx = (llama_context*) state_ptr;
+    // llama_set_state_data reads a whole state without knowing the size of src
+    if (size != llama_get_state_size(ctx)) {
+        binding_log(LOG_LEVEL_ERROR, "%s : invalid state size %zu\n", __func__, size);
+        return 1;
+    }
+    take_context_tokens(ctx);
+    llama_set_state_data(ctx, src);
+    return 0;
+}
+
+// a sequence is exported as a header, the tokens it holds, its system prompt and the state of the
+// context
+static const uint32_t SEQUENCE_MAGIC = 0x71657367; // 'gseq'
+
+size_t llama_sequence_size(void* state_ptr) {
+    llama_context* ctx = (llama_context*) state_ptr;
+    size_t n_tokens = 0;
+    {
+        std::lock_guard<std::mutex> lock(context_tokens_mutex);
+        auto tokens = context_tokens.find(ctx);
+        n_tokens += tokens != context_tokens.end() ? tokens->second.size() : 0;
+        auto system = system_prompts.find(ctx);
+        n_tokens += system != system_prompts.end() ? system->second.size() : 0;
+    }
+    return 3 * sizeof(uint32_t) + n_tokens * sizeof(llama_token) + llama_get_state_size(ctx);
+}
+
+size_t llama_save_sequence(void* state_ptr, uint8_t* dst) {
+    llama_context* ctx = (llama_context*) state_ptr;
+    std::vector<llama_token> tokens;
+    std::vector<llama_token> system;
+    {
+        std::lock_guard<std::mutex> lock(context_tokens_mutex);
+        auto it = context_tokens.find(ctx);
+        if (it != context_tokens.end()) {
+            tokens = it->second;
+        }
+        auto sit = system_prompts.find(ctx);
+        if (sit != system_prompts.end()) {
+            system = sit->second;
+        }
+    }
+
+    uint8_t * p = dst;
+    auto write = [&p](const void * data, size_t n) {
+        memcpy(p, data, n);
+        p += n;
+    };
+    const uint32_t magic = SEQUENCE_MAGIC;
+    const uint32_t n_tokens = (uint32_t) tokens.size();
+    const uint32_t n_system = (uint32_t) system.size();
+    write(&magic, sizeof(magic));
+    write(&n_tokens, sizeof(n_tokens));
+    write(tokens.data(), n_tokens * sizeof(llama_token));
+    write(&n_system, sizeof(n_system));
+    write(system.data(), n_system * sizeof(llama_token));
+    p += llama_save_state(ctx, p);
+    return p - dst;
+}
+
+int llama_load_sequence(void* state_ptr, const uint8_t* src, size_t size, bool* has_system) {
+    llama_context* ctx = (llama_context*) state_ptr;
+    const uint8_t * p = src;
+    const uint8_t * end = src + size;
+    auto read = [&p, end](void * data, size_t n) {
+        if ((size_t) (end - p) < n) {
+            return false;
+        }
+        memcpy(data, p, n);
+        p += n;
+        return true;
+    };
+
+    uint32_t magic = 0;
+    uint32_t n_tokens = 0;
+    uint32_t n_system = 0;
+    std::vector<llama_token> tokens;
+    std::vector<llama_token> system;
+    if (!read(&magic, sizeof(magic)) || magic != SEQUENCE_MAGIC || !read(&n_tokens, sizeof(n_tokens)) || n_tokens > (uint32_t) llama_n_ctx(ctx)) {
+        binding_log(LOG_LEVEL_ERROR, "%s : invalid sequence\n", __func__);
+        return 1;
+    }
+    tokens.resize(n_tokens);
+    if (!read(tokens.data(), n_tokens * sizeof(llama_token)) || !read(&n_system, sizeof(n_system)) || n_system > n_tokens) {
+        binding_log(LOG_LEVEL_ERROR, "%s : invalid sequence\n", __func__);
+        return 1;
+    }
+    system.resize(n_system);
+    // the context is left alone unless the tokens and the state fill the sequence exactly
+    if (!read(system.data(), n_system * sizeof(llama_token)) || (size_t) (end - p) != llama_get_state_size(ctx)) {
+        binding_log(LOG_LEVEL_ERROR, "%s : invalid sequence\n", __func__);
+        return 1;
+    }
+    if (llama_load_state(ctx, p, end - p) != 0) {
+        return 1;
+    }
+
+    store_context_tokens(ctx, tokens);
+    std::lock_guard<std::mutex> lock(context_tokens_mutex);
+    if (system.empty()) {
+        system_prompts.erase(ctx);
+    } else {
+        system_prompts[ctx] = system;
+    }
+    *has_system = !system.empty();
+    return 0;
+}
+
+void* llama_new_prompt_cache() {
+    return new prompt_cache;
+}
+
+void llama_free_prompt_cache(void* cache_ptr) {
+    delete (prompt_cache*) cache_ptr;
+}
+
+void llama_cancel_predict(void* params_ptr) {
+    binding_params* params = (binding_params*) params_ptr;
+    params->canceled->store(true);
+}
+
 void llama_free_params(void* params_ptr) {
-    gpt_params* params = (gpt_params*) params_ptr;
+    binding_params* params = (binding_params*) params_ptr;
     delete params;
 }
 
@@ -327,8 +2097,25 @@ void delete_vector(std::vector<std::string>* vec) {
 
 void* llama_allocate_params(const char *prompt, int seed, int threads, int tokens, int top_k,
                             float top_p, float temp, float repeat_penalty, int repeat_last_n, bool ignore_eos, bool memory_f16, int n_batch, int n_keep, const char** antiprompt, int antiprompt_count,
-                             float tfs_z, float typical_p, float frequency_penalty, float presence_penalty, int mirostat, float mirostat_eta, float mirostat_tau, bool penalize_nl, const char *logit_bias ) {
-    gpt_params* params = new gpt_params;
+                             float tfs_z, float typical_p, float frequency_penalty, float presence_penalty, int mirostat, float mirostat_eta, float mirostat_tau, bool penalize_nl, const char *logit_bias,
+                            float min_p, const int *sampler_order, int sampler_order_count, const char *grammar,
+                            const int *logit_bias_tokens, const float *logit_bias_values, int logit_bias_count,
+                            const char **token_bias_texts, const float *token_bias_values, int token_bias_count,
+                            int n_probs, int64_t max_duration_us,
+                            int eos_token, const int *stop_token_ids, int stop_token_count,
+                            int n_beams, float length_penalty, bool beam_early_stopping,
+                            const char *negative_prompt, float cfg_scale, void *ctx_guidance, bool greedy, void *prompt_cache_ptr,
+                            const char **banned_strings, int banned_strings_count, bool logits_processor, bool go_rand,
+                            const int *prompt_tokens, int prompt_token_count,
+                            bool infill, const char *infill_prefix, const char *infill_suffix, const int *fim_tokens,
+                            bool special_tokens, float max_entropy, float min_logprob,
+                            const char **grammar_triggers, int grammar_trigger_count,
+                            const int *grammar_trigger_tokens, int grammar_trigger_token_count,
+                            const char *path_prompt_cache, bool prompt_cache_ro, int n_sinks,
+                            bool add_bos, bool parse_special, bool trace, int n_threads_batch,
+                            const int *cpu_mask, int cpu_mask_count, int priority, int token_batch,
+                            bool prompt_progress, float max_tokens_per_second) {
+    binding_params* params = new binding_params;
     params->seed = seed;
     params->n_threads = threads;
     params->n_predict = tokens;
@@ -339,12 +2126,51 @@ void* llama_allocate_params(const char *prompt, int seed, int threads, int token
     params->memory_f16 = memory_f16;
     params->temp = temp;
     params->repeat_penalty = repeat_penalty;
-    params->n_batch = n_batch;
+    // the compute buffers of llama.cpp are sized for batches of up to max_batch tokens
+    params->n_batch = std::min(std::max(n_batch, 1), max_batch);
     params->n_keep = n_keep;
 
-    if (ignore_eos) {
-        params->logit_bias[llama_token_eos()] = -INFINITY;
+    params->ignore_eos = ignore_eos;
+    params->n_beams = n_beams;
+    params->length_penalty = length_penalty;
+    params->beam_early_stopping = beam_early_stopping;
+    params->cfg_negative_prompt = negative_prompt;
+    params->cfg_scale = cfg_scale;
+    params->ctx_guidance = (llama_context *) ctx_guidance;
+    params->greedy = greedy;
+    params->cache = (prompt_cache *) prompt_cache_ptr;
+    for (int i = 0; i < banned_strings_count; i++) {
+        params->banned_strings.push_back(banned_strings[i]);
+    }
+    params->logits_processor = logits_processor;
+    params->go_rand = go_rand;
+    params->prompt_tokens.assign(prompt_tokens, prompt_tokens + prompt_token_count);
+    params->infill = infill;
+    params->infill_prefix = infill_prefix;
+    params->infill_suffix = infill_suffix;
+    params->fim_pre = fim_tokens[0];
+    params->fim_suf = fim_tokens[1];
+    params->fim_mid = fim_tokens[2];
+    params->fim_eot = fim_tokens[3];
+    params->special_tokens = special_tokens;
+    params->max_entropy = max_entropy;
+    params->min_logprob = min_logprob;
+    for (int i = 0; i < grammar_trigger_count; i++) {
+        params->grammar_triggers.push_back(grammar_triggers[i]);
     }
+    params->grammar_trigger_tokens.assign(grammar_trigger_tokens, grammar_trigger_tokens + grammar_trigger_token_count);
+    params->path_session = path_prompt_cache;
+    params->prompt_cache_ro = prompt_cache_ro;
+    params->n_sinks = n_sinks;
+    params->add_bos = add_bos;
+    params->parse_special = parse_special;
+    params->trace = trace;
+    params->n_threads_batch = n_threads_batch;
+    params->cpu_mask.assign(cpu_mask, cpu_mask + cpu_mask_count);
+    params->priority = priority;
+    params->token_batch = token_batch;
+    params->prompt_progress = prompt_progress;
+    params->max_tokens_per_second = max_tokens_per_second;
     if(antiprompt_count > 0) {
       params->antiprompt = create_vector(antiprompt, antiprompt_count);
     }
@@ -362,8 +2188,25 @@ void* llama_allocate_params(const char *prompt, int seed, int threads, int token
     if (ss >> key && ss >> sign && std::getline(ss, value_str) && (sign == '+' || sign == '-')) {
         params->logit_bias[key] = std::stof(value_str) * ((sign == '-') ? -1.0f : 1.0f);
     } 
+    for (int i = 0; i < logit_bias_count; i++) {
+        params->logit_bias[logit_bias_tokens[i]] += logit_bias_values[i];
+    }
+    for (int i = 0; i < token_bias_count; i++) {
+        params->token_bias.push_back(std::make_pair(std::string(token_bias_texts[i]), token_bias_values[i]));
+    }
+    params->n_probs = n_probs;
+    params->max_duration_us = max_duration_us;
+    params->eos_token = eos_token;
+    params->stop_token_ids.assign(stop_token_ids, stop_token_ids + stop_token_count);
     params->frequency_penalty = frequency_penalty;
     params->prompt = prompt;
+    params->min_p = min_p;
+    params->grammar = grammar;
+    if (sampler_order_count > 0) {
+        params->sampler_order.assign(sampler_order, sampler_order + sampler_order_count);
+    } else {
+        params->sampler_order.assign(std::begin(default_sampler_order), std::end(default_sampler_order));
+    }
     
     return params;
 }
@@ -383,7 +2226,7 @@ void* load_model(const char *fname, int n_ctx, int n_parts, int n_seed, bool mem
     try {
         res = llama_init_from_file(fname, lparams);
     } catch(std::runtime_error& e) {   
-        fprintf(stderr, "failed %s",e.what());
+        binding_log(LOG_LEVEL_ERROR, "%s : failed loading model: %s\n", __func__, e.what());
         return res;
     }
 
@@ -5,27 +5,283 @@ extern "C" {
 #endif
 
 #include <stdbool.h>
+#include <stddef.h>
+#include <stdint.h>
 
-extern unsigned char tokenCallback(void *, char *);
+extern unsigned char tokenCallback(void *, char *, int, float, int, bool);
+extern int tokenBatchCallback(void *, int, int *, char *, int *, float *, int *, unsigned char *);
+extern void logitsCallback(void *, int, float *, int);
+extern double randCallback(void *);
+extern void logCallback(int, char *);
+extern void traceCallback(void *, int, int, bool);
+extern void promptProgressCallback(void *, int, int);
+
+// priorities of the threads of a prediction, must be kept in sync with the ThreadPriority
+// constants in options.go
+enum thread_priority {
+    PRIORITY_NORMAL   = 0,
+    PRIORITY_MEDIUM   = 1,
+    PRIORITY_HIGH     = 2,
+    PRIORITY_REALTIME = 3,
+};
+
+// phases of a prediction reported to the tracer, must be kept in sync with the span names in
+// trace.go
+enum trace_phase {
+    TRACE_TOKENIZE    = 0,
+    TRACE_PROMPT_EVAL = 1,
+    TRACE_DECODE      = 2,
+    TRACE_SAMPLE      = 3,
+};
+
+// severities of the messages of the bindings, must be kept in sync with the LogLevel constants
+// in log.go
+enum log_level {
+    LOG_LEVEL_DEBUG = 0,
+    LOG_LEVEL_INFO  = 1,
+    LOG_LEVEL_WARN  = 2,
+    LOG_LEVEL_ERROR = 3,
+};
+
+// sampler stages, must be kept in sync with the Sampler constants in options.go
+enum sampler_type {
+    SAMPLER_PENALTIES   = 0,
+    SAMPLER_TOP_K       = 1,
+    SAMPLER_TAIL_FREE   = 2,
+    SAMPLER_TYPICAL     = 3,
+    SAMPLER_TOP_P       = 4,
+    SAMPLER_MIN_P       = 5,
+    SAMPLER_TEMPERATURE = 6,
+};
 
 void* load_model(const char *fname, int n_ctx, int n_parts, int n_seed, bool memory_f16, bool mlock, bool embeddings);
 
-int get_embeddings(void* params_ptr, void* state_pr, float * res_embeddings);
+// get_embeddings writes the embedding of the prompt, llama_embedding_size floats, pooled with
+// one of the pooling_type. It returns 2 when the prompt does not fit in the context.
+enum pooling_type {
+    POOLING_LAST = 0,
+    POOLING_MEAN = 1,
+    POOLING_CLS = 2,
+};
+
+int get_embeddings(void* params_ptr, void* state_pr, float * res_embeddings, int pooling);
 
-int get_token_embeddings(void* params_ptr, void* state_pr,  int *tokens, int tokenSize, float * res_embeddings);
+int get_token_embeddings(void* params_ptr, void* state_pr,  int *tokens, int tokenSize, float * res_embeddings, int pooling);
+
+// get_embeddings_per_token writes the embeddings of each token of the prompt, n_tokens vectors of
+// llama_embedding_size floats. When the prompt has more than max_tokens tokens, nothing is
+// evaluated, n_tokens is set and 4 is returned.
+int get_embeddings_per_token(void* params_ptr, void* state_pr, float * res_embeddings, int max_tokens, int* n_tokens);
+
+// get_embeddings_batch writes the embeddings of count texts one after the other, like
+// get_embeddings. On failure, the index of the text which failed is written to failed.
+int get_embeddings_batch(void* params_ptr, void* state_pr, const char** texts, int count, float * res_embeddings, int pooling, int* failed);
 
 void* llama_allocate_params(const char *prompt, int seed, int threads, int tokens,
                             int top_k, float top_p, float temp, float repeat_penalty, 
                             int repeat_last_n, bool ignore_eos, bool memory_f16, 
                             int n_batch, int n_keep, const char** antiprompt, int antiprompt_count,
-                            float tfs_z, float typical_p, float frequency_penalty, float presence_penalty, int mirostat, float mirostat_eta, float mirostat_tau, bool penalize_nl, const char *logit_bias);
+                            float tfs_z, float typical_p, float frequency_penalty, float presence_penalty, int mirostat, float mirostat_eta, float mirostat_tau, bool penalize_nl, const char *logit_bias,
+                            float min_p, const int *sampler_order, int sampler_order_count, const char *grammar,
+                            const int *logit_bias_tokens, const float *logit_bias_values, int logit_bias_count,
+                            const char **token_bias_texts, const float *token_bias_values, int token_bias_count,
+                            int n_probs, int64_t max_duration_us,
+                            int eos_token, const int *stop_token_ids, int stop_token_count,
+                            int n_beams, float length_penalty, bool beam_early_stopping,
+                            const char *negative_prompt, float cfg_scale, void *ctx_guidance, bool greedy, void *prompt_cache,
+                            const char **banned_strings, int banned_strings_count, bool logits_processor, bool go_rand,
+                            const int *prompt_tokens, int prompt_token_count,
+                            bool infill, const char *infill_prefix, const char *infill_suffix, const int *fim_tokens,
+                            bool special_tokens, float max_entropy, float min_logprob,
+                            const char **grammar_triggers, int grammar_trigger_count,
+                            const int *grammar_trigger_tokens, int grammar_trigger_token_count,
+                            const char *path_prompt_cache, bool prompt_cache_ro, int n_sinks,
+                            bool add_bos, bool parse_special, bool trace, int n_threads_batch,
+                            const int *cpu_mask, int cpu_mask_count, int priority, int token_batch,
+                            bool prompt_progress, float max_tokens_per_second);
+
+
+// finish_reason tells why llama_predict stopped, keep in sync with FinishReason in result.go.
+enum finish_reason {
+    FINISH_STOP_WORD = 0,
+    FINISH_EOS = 1,
+    FINISH_LENGTH = 2,
+    FINISH_CANCELED = 3,
+    FINISH_CONTEXT_FULL = 4,
+    FINISH_TIMEOUT = 5,
+    FINISH_LOW_CONFIDENCE = 6,
+};
+
+// llama_predict_result holds the information about the tokens sampled by llama_predict. The
+// arrays are allocated by llama_predict and released with llama_free_result.
+typedef struct llama_predict_result {
+    // output text, starting with the prompt
+    char *text;
+    int text_len;
+    // number of tokens in the prompt
+    int n_prompt_tokens;
+    // length of the text of the prompt at the start of the output
+    int prompt_text_len;
+    // one of finish_reason
+    int finish_reason;
+    // seed used for sampling
+    int seed;
+    // time spent evaluating the prompt and generating the tokens, in microseconds
+    int64_t t_prompt_us;
+    int64_t t_predict_us;
+    // time spent sampling the tokens, part of t_predict_us, in microseconds
+    int64_t t_sample_us;
+    // number of tokens of the prompt evaluated, those reused from the context are skipped
+    int n_prompt_eval;
+    // number of tokens generated, including the special ones
+    int n_predicted;
 
+    // number of sampled tokens
+    int n_tokens;
+    // id of each sampled token
+    int *ids;
+    // text of the sampled tokens, concatenated
+    char *pieces;
+    // length in bytes of the text of each token
+    int *piece_lens;
+    // log probability of each token
+    float *logprobs;
+    // number of alternatives reported for each token
+    int n_probs;
+    // id, text, length and log probability of the n_probs most likely alternatives of each token
+    int *top_ids;
+    char *top_pieces;
+    int *top_piece_lens;
+    float *top_logprobs;
+    // number of hypotheses of a beam search, best first
+    int n_beams;
+    // text of the hypotheses, concatenated, and the length of each
+    char *beam_texts;
+    int *beam_text_lens;
+    // token ids of the hypotheses, concatenated, and the number of tokens of each
+    int *beam_ids;
+    int *beam_n_tokens;
+    // score of the hypotheses
+    float *beam_scores;
+} llama_predict_result;
 
 void llama_free_params(void* params_ptr);
 
+// llama_sequence_size returns the maximum size of the sequence held by the context: its tokens,
+// its system prompt and the state of the context.
+size_t llama_sequence_size(void* state);
+
+// llama_save_sequence copies the sequence held by the context to dst and returns its size.
+size_t llama_save_sequence(void* state, uint8_t* dst);
+
+// llama_load_sequence restores a sequence saved by llama_save_sequence, has_system tells whether
+// it has a system prompt. The context is left unchanged when the sequence is truncated or does not
+// match the context.
+int llama_load_sequence(void* state, const uint8_t* src, size_t size, bool* has_system);
+
+// llama_new_prompt_cache allocates a cache shared by the predictions of a prompt, so it is only
+// evaluated once. It is released with llama_free_prompt_cache.
+void* llama_new_prompt_cache();
+
+void llama_free_prompt_cache(void* cache);
+
+// llama_cancel_predict stops a running llama_predict, it can be called from any thread.
+void llama_cancel_predict(void* params_ptr);
+
 void llama_free_model(void* state);
 
-int llama_predict(void* params_ptr, void* state_pr, char* result, bool debug);
+// llama_set_system_prompt evaluates the prompt of the parameters and keeps it at the start of the
+// context, it is prepended to the prompts of the next predictions. An empty prompt removes it.
+int llama_set_system_prompt(void* params_ptr, void* state);
+
+// llama_tokenize_string tokenizes text and returns the number of tokens, or -1 when there are
+// more than n_max_tokens.
+int llama_tokenize_string(void* state, const char* text, int text_len, bool add_bos, bool parse_special, int* tokens, int n_max_tokens);
+
+// special_token_kind selects the token returned by llama_special_token.
+enum special_token_kind {
+    SPECIAL_TOKEN_BOS = 0,
+    SPECIAL_TOKEN_EOS = 1,
+    SPECIAL_TOKEN_EOT = 2,
+    SPECIAL_TOKEN_NL  = 3,
+    SPECIAL_TOKEN_PAD = 4,
+};
+
+// llama_special_token returns the id of a special token of the model, or -1 when it has none.
+int llama_special_token(void* state, int kind);
+
+int llama_vocab_size(void* state);
+
+// llama_embedding_size returns the number of dimensions of the embeddings of the model.
+int llama_embedding_size(void* state);
+
+// llama_token_piece returns the text of a token, or NULL when it is not in the vocabulary. The
+// text belongs to the model.
+const char* llama_token_piece(void* state, int token);
+
+// llama_token_count returns the number of tokens of text.
+int llama_token_count(void* state, const char* text, int text_len);
+
+// llama_detokenize writes the text of the tokens to text and returns its length, the text is
+// truncated when it is longer than text_size. It returns -1 when a token is not in the
+// vocabulary.
+int llama_detokenize(void* state, const int* tokens, int n_tokens, char* text, int text_size);
+
+// llama_perplexity adds to nll the negative log likelihood of the tokens, which are scored with
+// the windows of the context starting every stride tokens, and sets n_scored to the number of
+// tokens scored. The tokens the context held are forgotten.
+int llama_perplexity(void* state, const int* tokens, int n_tokens, int stride, int n_threads, int n_batch, double* nll, int* n_scored);
+
+// llama_bench evaluates n_prompt tokens in batches of n_batch then generates n_gen tokens one by
+// one, without sampling, and sets the time spent in each phase in microseconds. The tokens the
+// context held are forgotten.
+int llama_bench(void* state, int n_prompt, int n_gen, int n_batch, int n_threads, int64_t* t_prompt_us, int64_t* t_gen_us);
+
+// llama_redirect_stderr points the standard error to fd and returns a descriptor of the previous
+// one, or -1 when it fails or the platform is not supported.
+int llama_redirect_stderr(int fd);
+
+// llama_restore_stderr points the standard error back to saved, returned by
+// llama_redirect_stderr.
+void llama_restore_stderr(int saved);
+
+// llama_clone_context copies the state, the tokens and the system prompt of the context src to
+// dst, a context of the same model with the same size.
+int llama_clone_context(void* src, void* dst);
+
+// llama_reset_context forgets the tokens held by the context and its system prompt, the next
+// prediction evaluates its whole prompt, and seeds the random number generator again.
+void llama_reset_context(void* state);
+
+// context_usage describes how much of a context is used.
+typedef struct context_usage {
+    // size of the context in tokens
+    int n_ctx;
+    // number of tokens in the KV cache
+    int n_kv_tokens;
+    // number of tokens at the start of the context the next prediction can reuse
+    int n_reusable;
+    // number of tokens of the system prompt
+    int n_system;
+} context_usage;
+
+void llama_context_usage(void* state, context_usage* out);
+
+// llama_state_size returns the maximum size of a snapshot of the context: the KV cache, the
+// random number generator and the logits.
+size_t llama_state_size(void* state);
+
+// llama_save_state copies a snapshot of the context to dst, padded to llama_state_size, and
+// returns its size.
+size_t llama_save_state(void* state, uint8_t* dst);
+
+// llama_load_state restores a snapshot taken by llama_save_state, it fails when size is not
+// the size of the state of the context.
+int llama_load_state(void* state, const uint8_t* src, size_t size);
+
+int llama_predict(void* params_ptr, void* state_pr, char* result, bool debug, llama_predict_result* out);
+
+void llama_free_result(llama_predict_result* result);
 
 #ifdef __cplusplus
 }
@@ -0,0 +1,320 @@
+package llama
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+// Message is a message of a chat.
+type Message struct {
+	// Role is the author of the message: system, user or assistant.
+	Role string
+	// Content is the text of the message.
+	Content string
+	// ToolCalls are the tools called by the assistant in the message, see SetTools.
+	ToolCalls []ToolCall
+	// Reasoning is the reasoning trace of the assistant before the message, see
+	// SetReasoningTags. It is not part of the prompts.
+	Reasoning string
+}
+
+// The chat templates known by FormatChat, the one of a model is selected with SetChatTemplate.
+const (
+	ChatTemplateChatML          = "chatml"
+	ChatTemplateLlama2          = "llama2"
+	ChatTemplateLlama3          = "llama3"
+	ChatTemplateZephyr          = "zephyr"
+	ChatTemplateVicuna          = "vicuna"
+	ChatTemplateAlpaca          = "alpaca"
+	ChatTemplateMistralInstruct = "mistral-instruct"
+	ChatTemplatePhi             = "phi"
+)
+
+// chatStopWords are the texts ending the turn of the assistant for each template, besides the end
+// of stream token.
+var chatStopWords = map[string][]string{
+	ChatTemplateChatML:          {"<|im_end|>", "<|im_start|>"},
+	ChatTemplateLlama2:          {"[INST]"},
+	ChatTemplateLlama3:          {"<|eot_id|>", "<|start_header_id|>"},
+	ChatTemplateZephyr:          {"<|user|>", "<|system|>"},
+	ChatTemplateVicuna:          {"USER:"},
+	ChatTemplateAlpaca:          {"### Instruction:"},
+	ChatTemplateMistralInstruct: {"[INST]"},
+	ChatTemplatePhi:             {"<|end|>", "<|user|>"},
+}
+
+// FormatChat formats messages into a prompt with the named template. With addAssistant the prompt
+// ends with the start of the answer of the assistant.
+func FormatChat(template string, messages []Message, addAssistant bool) (string, error) {
+	var sb strings.Builder
+	switch template {
+	case ChatTemplateChatML:
+		for _, m := range messages {
+			sb.WriteString("<|im_start|>" + m.Role + "\n" + m.Content + "<|im_end|>\n")
+		}
+		if addAssistant {
+			sb.WriteString("<|im_start|>assistant\n")
+		}
+	case ChatTemplateLlama2:
+		// [INST] <<SYS>>\nsystem\n<</SYS>>\n\nuser [/INST] assistant</s><s>[INST] user [/INST]
+		insideTurn := true
+		sb.WriteString("[INST] ")
+		for _, m := range messages {
+			if !insideTurn {
+				insideTurn = true
+				sb.WriteString("<s>[INST] ")
+			}
+			switch m.Role {
+			case "system":
+				sb.WriteString("<<SYS>>\n" + m.Content + "\n<</SYS>>\n\n")
+			case "user":
+				sb.WriteString(m.Content + " [/INST]")
+			default:
+				sb.WriteString(" " + m.Content + "</s>")
+				insideTurn = false
+			}
+		}
+	case ChatTemplateLlama3:
+		// the beginning of text token is added by the prediction
+		for _, m := range messages {
+			sb.WriteString("<|start_header_id|>" + m.Role + "<|end_header_id|>\n\n" + m.Content + "<|eot_id|>")
+		}
+		if addAssistant {
+			sb.WriteString("<|start_header_id|>assistant<|end_header_id|>\n\n")
+		}
+	case ChatTemplateMistralInstruct:
+		// [INST] system\n\nuser [/INST] assistant</s>[INST] user [/INST]
+		var system string
+		for _, m := range messages {
+			switch m.Role {
+			case "system":
+				system += m.Content + "\n\n"
+			case "user":
+				sb.WriteString("[INST] " + system + m.Content + " [/INST]")
+				system = ""
+			default:
+				sb.WriteString(" " + m.Content + "</s>")
+			}
+		}
+	case ChatTemplateAlpaca:
+		for _, m := range messages {
+			switch m.Role {
+			case "system":
+				sb.WriteString(m.Content + "\n\n")
+			case "user":
+				sb.WriteString("### Instruction:\n" + m.Content + "\n\n")
+			default:
+				sb.WriteString("### Response:\n" + m.Content + "\n\n")
+			}
+		}
+		if addAssistant {
+			sb.WriteString("### Response:\n")
+		}
+	case ChatTemplatePhi:
+		for _, m := range messages {
+			sb.WriteString("<|" + m.Role + "|>\n" + m.Content + "<|end|>\n")
+		}
+		if addAssistant {
+			sb.WriteString("<|assistant|>\n")
+		}
+	case ChatTemplateZephyr:
+		for _, m := range messages {
+			sb.WriteString("<|" + m.Role + "|>\n" + m.Content + "</s>\n")
+		}
+		if addAssistant {
+			sb.WriteString("<|assistant|>\n")
+		}
+	case ChatTemplateVicuna:
+		for _, m := range messages {
+			switch m.Role {
+			case "system":
+				sb.WriteString(m.Content + "\n\n")
+			case "user":
+				sb.WriteString("USER: " + m.Content + "\n")
+			default:
+				sb.WriteString("ASSISTANT: " + m.Content + "</s>\n")
+			}
+		}
+		if addAssistant {
+			sb.WriteString("ASSISTANT:")
+		}
+	default:
+		return "", fmt.Errorf("unknown chat template %q", template)
+	}
+	return sb.String(), nil
+}
+
+// ApplyChatTemplate formats messages into a prompt with the chat template of the model, set with
+// SetChatTemplate, or with the one set with SetPromptTemplate or SetJinjaTemplate. With
+// addAssistantPrefix the prompt ends with the start of the answer of the assistant.
+func (l *LLama) ApplyChatTemplate(messages []Message, addAssistantPrefix bool) (string, error) {
+	if l.promptTemplate != nil {
+		return executePromptTemplate(l.promptTemplate, messages, addAssistantPrefix)
+	}
+	if l.jinjaTemplate != nil {
+		return l.executeJinjaTemplate(messages, addAssistantPrefix)
+	}
+	return FormatChat(l.chatTemplate, messages, addAssistantPrefix)
+}
+
+// PromptTemplateData is the data the templates set with SetPromptTemplate are executed with.
+type PromptTemplateData struct {
+	// Messages are the messages of the chat, the turns are told apart by the role of the
+	// messages.
+	Messages []Message
+	// AddAssistant is set when the prompt must end with the start of the answer of the
+	// assistant.
+	AddAssistant bool
+}
+
+// FormatPromptTemplate formats messages into a prompt with the text/template tmpl, executed with
+// a PromptTemplateData. For instance, ChatML is formatted with:
+//
+//	{{range .Messages}}<|im_start|>{{.Role}}
+//	{{.Content}}<|im_end|>
+//	{{end}}{{if .AddAssistant}}<|im_start|>assistant
+//	{{end}}
+func FormatPromptTemplate(tmpl string, messages []Message, addAssistant bool) (string, error) {
+	t, err := parsePromptTemplate(tmpl)
+	if err != nil {
+		return "", err
+	}
+	return executePromptTemplate(t, messages, addAssistant)
+}
+
+func parsePromptTemplate(tmpl string) (*template.Template, error) {
+	t, err := template.New("prompt").Parse(tmpl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid prompt template: %w", err)
+	}
+	return t, nil
+}
+
+func executePromptTemplate(t *template.Template, messages []Message, addAssistant bool) (string, error) {
+	var sb strings.Builder
+	if err := t.Execute(&sb, PromptTemplateData{Messages: messages, AddAssistant: addAssistant}); err != nil {
+		return "", fmt.Errorf("failed formatting prompt: %w", err)
+	}
+	return sb.String(), nil
+}
+
+func (l *LLama) executeJinjaTemplate(messages []Message, addAssistant bool) (string, error) {
+	list := make([]map[string]interface{}, len(messages))
+	for i, m := range messages {
+		msg := map[string]interface{}{"role": m.Role, "content": m.Content}
+		if len(m.ToolCalls) > 0 {
+			calls := make([]map[string]interface{}, len(m.ToolCalls))
+			for j, c := range m.ToolCalls {
+				calls[j] = map[string]interface{}{"type": "function",
+					"function": map[string]interface{}{"name": c.Name, "arguments": c.Arguments}}
+			}
+			msg["tool_calls"] = calls
+		}
+		list[i] = msg
+	}
+
+	// the beginning of stream token is added by the prediction, models whose vocabulary has no
+	// text for the control tokens get none written by the template
+	prompt, err := l.jinjaTemplate.Execute(map[string]interface{}{
+		"messages":              list,
+		"add_generation_prompt": addAssistant,
+		"bos_token":             l.TokenText(l.BOS()),
+		"eos_token":             l.TokenText(l.EOS()),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed formatting prompt: %w", err)
+	}
+	return prompt, nil
+}
+
+// CountChatTokens returns the number of tokens of the prompt of messages formatted with the chat
+// template of the model, including the start of the answer of the assistant.
+func (l *LLama) CountChatTokens(messages []Message) (int, error) {
+	prompt, err := l.ApplyChatTemplate(messages, true)
+	if err != nil {
+		return 0, err
+	}
+	// the prompt is tokenized like the prompts of a prediction
+	tokens, err := l.TokenizeSpecial(" "+prompt, true, true)
+	if err != nil {
+		return 0, err
+	}
+	return len(tokens), nil
+}
+
+// Chat generates the next message of the assistant in the conversation of messages, formatted
+// with the chat template of the model. The generation stops at the end of the turn of the
+// assistant, the stop words and tokens set in opts are kept.
+//
+// With SetTools the tools are described in the system prompt and the assistant may call one of
+// them instead of answering, the call is then parsed into the ToolCalls of the message.
+func (l *LLama) Chat(ctx context.Context, messages []Message, opts ...PredictOption) (Message, error) {
+	prompt, all, tools, err := l.chatPrompt(messages, opts)
+	if err != nil {
+		return Message{}, err
+	}
+
+	res, err := l.predict(ctx, prompt, all...)
+	if res == nil {
+		return Message{}, err
+	}
+	answer := Message{Role: "assistant", Content: res.Text, Reasoning: res.Reasoning}
+	if len(tools) > 0 && err == nil {
+		answer.Content, answer.ToolCalls, err = parseToolCalls(res.Text)
+	}
+	answer.Content = strings.TrimSpace(answer.Content)
+	return answer, err
+}
+
+// chatPrompt formats the prompt of the next message of the assistant and returns the options of
+// its prediction, along with the tools the assistant can call.
+func (l *LLama) chatPrompt(messages []Message, opts []PredictOption) (string, []PredictOption, []Tool, error) {
+	tools := NewPredictOptions(opts...).Tools
+	messages, err := withToolCalls(messages)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	var toolsGBNF string
+	if len(tools) > 0 {
+		system, err := toolsPrompt(tools)
+		if err != nil {
+			return "", nil, nil, err
+		}
+		if toolsGBNF, err = toolsGrammar(tools); err != nil {
+			return "", nil, nil, err
+		}
+		if len(messages) > 0 && messages[0].Role == "system" {
+			messages[0].Content += "\n\n" + system
+		} else {
+			messages = append([]Message{{Role: "system", Content: system}}, messages...)
+		}
+	}
+
+	prompt, err := l.ApplyChatTemplate(messages, true)
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	var stopWords []string
+	if l.promptTemplate == nil && l.jinjaTemplate == nil {
+		stopWords = chatStopWords[l.chatTemplate]
+	}
+	eot := l.EOT()
+	all := make([]PredictOption, 0, len(opts)+2)
+	all = append(all, SetParseSpecial(true))
+	all = append(all, opts...)
+	all = append(all, func(p *PredictOptions) {
+		p.StopPrompts = append(append([]string(nil), p.StopPrompts...), stopWords...)
+		if eot >= 0 {
+			p.StopTokenIDs = append(append([]int(nil), p.StopTokenIDs...), int(eot))
+		}
+		if toolsGBNF != "" {
+			p.Grammar = toolsGBNF
+			p.GrammarTriggers = []string{toolCallTag}
+			p.GrammarTriggerTokens = nil
+		}
+	})
+	return prompt, all, tools, nil
+}
@@ -0,0 +1,186 @@
+package llama_test
+
+import (
+	. "github.com/go-skynet/go-llama.cpp"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("FormatChat", func() {
+	messages := []Message{
+		{Role: "system", Content: "Be brief."},
+		{Role: "user", Content: "Hi"},
+		{Role: "assistant", Content: "Hello"},
+		{Role: "user", Content: "Bye"},
+	}
+
+	It("formats ChatML", func() {
+		prompt, err := FormatChat(ChatTemplateChatML, messages[:2], true)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(prompt).To(Equal("<|im_start|>system\nBe brief.<|im_end|>\n<|im_start|>user\nHi<|im_end|>\n<|im_start|>assistant\n"))
+	})
+
+	It("formats Llama 2 turns", func() {
+		prompt, err := FormatChat(ChatTemplateLlama2, messages, true)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(prompt).To(Equal("[INST] <<SYS>>\nBe brief.\n<</SYS>>\n\nHi [/INST] Hello</s><s>[INST] Bye [/INST]"))
+	})
+
+	It("formats Llama 3 turns", func() {
+		prompt, err := FormatChat(ChatTemplateLlama3, messages[:2], true)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(prompt).To(Equal("<|start_header_id|>system<|end_header_id|>\n\nBe brief.<|eot_id|><|start_header_id|>user<|end_header_id|>\n\nHi<|eot_id|><|start_header_id|>assistant<|end_header_id|>\n\n"))
+	})
+
+	It("formats Mistral Instruct turns with the system prompt in the first one", func() {
+		prompt, err := FormatChat(ChatTemplateMistralInstruct, messages, true)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(prompt).To(Equal("[INST] Be brief.\n\nHi [/INST] Hello</s>[INST] Bye [/INST]"))
+	})
+
+	It("fails with an unknown template", func() {
+		_, err := FormatChat("unknown", messages, true)
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+var _ = Describe("FormatPromptTemplate", func() {
+	messages := []Message{
+		{Role: "system", Content: "Be brief."},
+		{Role: "user", Content: "Hi"},
+	}
+
+	It("formats the turns", func() {
+		tmpl := "{{range .Messages}}{{if eq .Role \"user\"}}### User: {{else}}### System: {{end}}{{.Content}}\n{{end}}{{if .AddAssistant}}### Assistant:{{end}}"
+		prompt, err := FormatPromptTemplate(tmpl, messages, true)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(prompt).To(Equal("### System: Be brief.\n### User: Hi\n### Assistant:"))
+	})
+
+	It("fails with an invalid template", func() {
+		_, err := FormatPromptTemplate("{{range .Messages}", messages, true)
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+var _ = Describe("Tool calls", func() {
+	It("splits the call of a tool from the message", func() {
+		content, calls, err := ParseToolCalls(`Let me check.<tool_call>{"name": "weather", "arguments": {"city": "Paris"}}`)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(content).To(Equal("Let me check."))
+		Expect(calls).To(HaveLen(1))
+		Expect(calls[0].Name).To(Equal("weather"))
+		Expect(string(calls[0].Arguments)).To(MatchJSON(`{"city": "Paris"}`))
+	})
+
+	It("returns the text without a call as the message", func() {
+		content, calls, err := ParseToolCalls("Hello")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(content).To(Equal("Hello"))
+		Expect(calls).To(BeEmpty())
+	})
+
+	It("fails on a truncated call, keeping the message", func() {
+		content, _, err := ParseToolCalls(`Sure.<tool_call>{"name": "weather", "argu`)
+		Expect(err).To(HaveOccurred())
+		Expect(content).To(Equal("Sure."))
+	})
+
+	It("writes the calls back into the messages the way they are parsed", func() {
+		messages := []Message{
+			{Role: "user", Content: "Weather?"},
+			{Role: "assistant", Content: "Let me check.", ToolCalls: []ToolCall{{Name: "weather", Arguments: []byte(`{"city": "Paris"}`)}}},
+		}
+		out, err := WithToolCalls(messages)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(out[0]).To(Equal(messages[0]))
+		Expect(out[1].Content).To(Equal(`Let me check.<tool_call>{"name":"weather","arguments":{"city":"Paris"}}`))
+		Expect(messages[1].Content).To(Equal("Let me check."))
+
+		content, calls, err := ParseToolCalls(out[1].Content)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(content).To(Equal("Let me check."))
+		Expect(calls[0].Name).To(Equal("weather"))
+		Expect(string(calls[0].Arguments)).To(MatchJSON(`{"city": "Paris"}`))
+	})
+})
+
+var _ = Describe("Reasoning", func() {
+	It("splits the trace from the answer", func() {
+		reasoning, answer := SplitReasoning("<think> Plan it. </think>\n\nThe answer.", "<think>", "</think>", "Question?")
+		Expect(reasoning).To(Equal("Plan it."))
+		Expect(answer).To(Equal("The answer."))
+	})
+
+	It("splits a trace opened by the prompt", func() {
+		reasoning, answer := SplitReasoning("Plan it.</think>The answer.", "<think>", "</think>", "Question?<think>\n")
+		Expect(reasoning).To(Equal("Plan it."))
+		Expect(answer).To(Equal("The answer."))
+	})
+
+	It("keeps a trace which never ends as reasoning", func() {
+		reasoning, answer := SplitReasoning("<think>Still thinking", "<think>", "</think>", "")
+		Expect(reasoning).To(Equal("Still thinking"))
+		Expect(answer).To(BeEmpty())
+	})
+
+	It("holds back the tags split across chunks", func() {
+		reasoning, answer := StreamReasoning("<think>", "</think>", "", []string{"<th", "ink>pl", "an</th", "ink> The answer"})
+		Expect(reasoning).To(Equal([]string{"pl", "an"}))
+		Expect(answer).To(Equal([]string{"The answer"}))
+	})
+
+	It("passes on the start of a tag which is not one once the generation is over", func() {
+		reasoning, answer := StreamReasoning("<think>", "</think>", "", []string{"Hi <th"})
+		Expect(reasoning).To(BeEmpty())
+		Expect(answer).To(Equal([]string{"Hi ", "<th"}))
+	})
+})
+
+var _ = Describe("Chat streams", func() {
+	contents := func(deltas []ChatDelta) []string {
+		var out []string
+		for _, d := range deltas {
+			Expect(d.ToolCall).To(BeNil())
+			out = append(out, d.Content)
+		}
+		return out
+	}
+
+	It("holds back a stop word split across chunks", func() {
+		deltas := StreamChat([]string{"<|im_end|>"}, false, "", "", []string{"Hello", " wor", "ld<|im", "_end|>ignored"})
+		Expect(contents(deltas)).To(Equal([]string{"Hello", " wor", "ld"}))
+	})
+
+	It("holds back the bytes of a truncated rune", func() {
+		deltas := StreamChat(nil, false, "", "", []string{"caf\xc3", "\xa9!"})
+		Expect(contents(deltas)).To(Equal([]string{"caf", "é!"}))
+	})
+
+	It("drops the spaces starting the message", func() {
+		deltas := StreamChat(nil, false, "", "", []string{"  ", "\nHi"})
+		Expect(contents(deltas)).To(Equal([]string{"Hi"}))
+	})
+
+	It("streams the call of a tool once its tag is complete", func() {
+		deltas := StreamChat(nil, true, "", "", []string{"Let me check.", "<tool", `_call>{"name":`, `"get"}`})
+		Expect(deltas).To(Equal([]ChatDelta{
+			{Content: "Let me check."},
+			{ToolCall: &ToolCallDelta{Arguments: `{"name":`}},
+			{ToolCall: &ToolCallDelta{Arguments: `"get"}`}},
+		}))
+	})
+
+	It("streams the reasoning trace apart from the content", func() {
+		deltas := StreamChat(nil, false, "<think>", "</think>", []string{"<think>hmm</think>", " Hi"})
+		Expect(deltas).To(Equal([]ChatDelta{{Reasoning: "hmm"}, {Content: "Hi"}}))
+	})
+
+	It("finds the truncated rune ending a text", func() {
+		Expect(IncompleteUTF8("abc")).To(Equal(0))
+		Expect(IncompleteUTF8("ab\xc3")).To(Equal(1))
+		Expect(IncompleteUTF8("a\xe2\x82")).To(Equal(2))
+		Expect(IncompleteUTF8("a€")).To(Equal(0))
+		Expect(IncompleteUTF8("")).To(Equal(0))
+	})
+})
@@ -0,0 +1,238 @@
+package llama
+
+import (
+	"context"
+	"strings"
+	"unicode/utf8"
+)
+
+// ChatDelta is a piece of a message of the assistant streamed by ChatStream.
+type ChatDelta struct {
+	// Role is set on the first delta.
+	Role string
+	// Content is the next chunk of the text of the message.
+	Content string
+	// Reasoning is the next chunk of the reasoning trace, see SetReasoningTags.
+	Reasoning string
+	// ToolCall is the next chunk of the call of a tool, see SetTools.
+	ToolCall *ToolCallDelta
+	// Done is set on the last delta, which also carries the reason the generation stopped, the
+	// parsed tool calls and the error of the generation.
+	Done         bool
+	FinishReason FinishReason
+	ToolCalls    []ToolCall
+	Err          error
+}
+
+// ToolCallDelta is a chunk of the call of a tool.
+type ToolCallDelta struct {
+	// Index is the index of the call in the message.
+	Index int
+	// Arguments is the next chunk of the JSON object of the call, holding the name of the tool
+	// and its arguments.
+	Arguments string
+}
+
+// ChatStream generates the next message of the assistant like Chat and sends it over the
+// returned channel as deltas, like the chunks of OpenAI's streamed chat completions. The text
+// which may be the start of a stop word is held back until it is known not to be one, and the
+// chunks are valid UTF-8.
+//
+// The channel must be drained, the generation is blocked until each delta is received. Canceling
+// ctx stops the generation.
+func (l *LLama) ChatStream(ctx context.Context, messages []Message, opts ...PredictOption) (<-chan ChatDelta, error) {
+	prompt, all, tools, err := l.chatPrompt(messages, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	po := NewPredictOptions(all...)
+	split := &chatSplitter{stopWords: po.StopPrompts, tools: len(tools) > 0}
+	if po.ReasoningStart != "" {
+		split.reasoning = newReasoningSplitter(po.ReasoningStart, po.ReasoningEnd, prompt)
+	}
+	out := make(chan ChatDelta)
+	send := func(d ChatDelta) bool {
+		select {
+		case out <- d:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	userCallback := po.TokenCallbackEx
+	all = append(all, SetTokenCallbackEx(func(event TokenEvent) bool {
+		for _, d := range split.add(event.Text) {
+			if !send(d) {
+				return false
+			}
+		}
+		if userCallback != nil {
+			return userCallback(event)
+		}
+		return true
+	}))
+
+	go func() {
+		defer close(out)
+		if !send(ChatDelta{Role: "assistant"}) {
+			return
+		}
+
+		res, err := l.predict(ctx, prompt, all...)
+		for _, d := range split.flush() {
+			if !send(d) {
+				return
+			}
+		}
+		last := ChatDelta{Done: true, Err: err}
+		if res != nil {
+			last.FinishReason = res.FinishReason
+			if len(tools) > 0 && err == nil {
+				_, last.ToolCalls, last.Err = parseToolCalls(res.Text)
+			}
+		}
+		send(last)
+	}()
+
+	return out, nil
+}
+
+// chatSplitter splits the streamed text of a message into the deltas of its content and of its
+// tool calls.
+type chatSplitter struct {
+	stopWords []string
+	tools     bool
+	reasoning *reasoningSplitter
+
+	pending string
+	started bool
+	inCall  bool
+	stopped bool
+}
+
+func (s *chatSplitter) add(text string) []ChatDelta {
+	if s.stopped {
+		return nil
+	}
+	if s.reasoning != nil {
+		reasoning, answer := s.reasoning.add(text)
+		deltas := s.emitReasoning(reasoning)
+		return append(deltas, s.addAnswer(answer)...)
+	}
+	return s.addAnswer(text)
+}
+
+// addAnswer adds text following the reasoning trace.
+func (s *chatSplitter) addAnswer(text string) []ChatDelta {
+	s.pending += text
+	if s.inCall {
+		return s.emitCall(false)
+	}
+
+	var deltas []ChatDelta
+	if s.tools {
+		if i := strings.Index(s.pending, toolCallTag); i >= 0 {
+			deltas = s.emitContent(s.pending[:i])
+			s.pending = s.pending[i+len(toolCallTag):]
+			s.inCall = true
+			return append(deltas, s.emitCall(false)...)
+		}
+	}
+	for _, stop := range s.stopWords {
+		if i := strings.Index(s.pending, stop); i >= 0 && stop != "" {
+			s.stopped = true
+			return s.emitContent(s.pending[:i])
+		}
+	}
+
+	// the end of the text may be the start of a stop word or of a tool call
+	keep := 0
+	markers := s.stopWords
+	if s.tools {
+		markers = append(markers[:len(markers):len(markers)], toolCallTag)
+	}
+	for _, m := range markers {
+		for n := len(m) - 1; n > keep; n-- {
+			if strings.HasSuffix(s.pending, m[:n]) {
+				keep = n
+				break
+			}
+		}
+	}
+	keep += incompleteUTF8(s.pending[:len(s.pending)-keep])
+	ready := s.pending[:len(s.pending)-keep]
+	s.pending = s.pending[len(s.pending)-keep:]
+	return s.emitContent(ready)
+}
+
+// flush returns the deltas of the text held back once the generation is over.
+func (s *chatSplitter) flush() []ChatDelta {
+	if s.stopped {
+		return nil
+	}
+	var deltas []ChatDelta
+	if s.reasoning != nil {
+		reasoning, answer := s.reasoning.flush()
+		deltas = append(s.emitReasoning(reasoning), s.addAnswer(answer)...)
+		if s.stopped {
+			return deltas
+		}
+	}
+	if s.inCall {
+		return append(deltas, s.emitCall(true)...)
+	}
+	text := s.pending
+	s.pending = ""
+	return append(deltas, s.emitContent(text)...)
+}
+
+func (s *chatSplitter) emitReasoning(text string) []ChatDelta {
+	if text == "" {
+		return nil
+	}
+	return []ChatDelta{{Reasoning: text}}
+}
+
+func (s *chatSplitter) emitContent(text string) []ChatDelta {
+	if !s.started {
+		// like Chat, the message does not start with spaces
+		text = strings.TrimLeft(text, " \t\r\n")
+	}
+	if text == "" {
+		return nil
+	}
+	s.started = true
+	return []ChatDelta{{Content: text}}
+}
+
+func (s *chatSplitter) emitCall(final bool) []ChatDelta {
+	n := len(s.pending)
+	if !final {
+		n -= incompleteUTF8(s.pending)
+	}
+	text := s.pending[:n]
+	s.pending = s.pending[n:]
+	if text == "" {
+		return nil
+	}
+	return []ChatDelta{{ToolCall: &ToolCallDelta{Arguments: text}}}
+}
+
+// incompleteUTF8 returns the length of the truncated rune ending s.
+func incompleteUTF8(s string) int {
+	for n := 1; n <= utf8.UTFMax && n <= len(s); n++ {
+		c := s[len(s)-n]
+		if c < utf8.RuneSelf {
+			return 0
+		}
+		if utf8.RuneStart(c) {
+			if r, _ := utf8.DecodeRuneInString(s[len(s)-n:]); r == utf8.RuneError && !utf8.FullRuneInString(s[len(s)-n:]) {
+				return n
+			}
+			return 0
+		}
+	}
+	return 0
+}
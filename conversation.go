@@ -0,0 +1,133 @@
+package llama
+
+import (
+	"context"
+	"fmt"
+)
+
+// Summarizer condenses the oldest turns of a conversation dropped to fit in the context, see
+// SetSummarizer.
+type Summarizer func(ctx context.Context, dropped []Message) (string, error)
+
+// Conversation is a chat with a model keeping its history. The oldest turns are dropped when the
+// history no longer fits in the context, the system messages at the start are always kept.
+//
+// Each prompt starts with the messages of the previous one, so the tokens cached by the previous
+// turn are reused and only the new messages are evaluated, until turns are dropped. A
+// conversation is not safe for concurrent use.
+type Conversation struct {
+	l          *LLama
+	opts       []PredictOption
+	messages   []Message
+	summarize  Summarizer
+	maxAnswer  int
+	summarized bool
+}
+
+// NewConversation starts a conversation with the model, opts are the options of each turn, see
+// Chat. The history starts with the system message when it is not empty, the answers are kept
+// within the number of tokens set with SetTokens.
+func (l *LLama) NewConversation(system string, opts ...PredictOption) *Conversation {
+	tokens := NewPredictOptions(opts...).Tokens
+	if tokens <= 0 {
+		// unbounded answers still need some room
+		tokens = l.ContextUsage().Size / 4
+	}
+	c := &Conversation{l: l, opts: opts, maxAnswer: tokens}
+	if system != "" {
+		c.messages = []Message{{Role: "system", Content: system}}
+	}
+	return c
+}
+
+// SetSummarizer makes the conversation replace the dropped turns with a system message holding
+// their summary, written by fn. The model itself can write it, e.g. with Chat.
+func (c *Conversation) SetSummarizer(fn Summarizer) {
+	c.summarize = fn
+}
+
+// Messages returns the history of the conversation.
+func (c *Conversation) Messages() []Message {
+	return append([]Message(nil), c.messages...)
+}
+
+// Add appends messages to the history without generating an answer, e.g. the results of the
+// tools called by the assistant.
+func (c *Conversation) Add(messages ...Message) {
+	c.messages = append(c.messages, messages...)
+}
+
+// Send appends the message of the user to the history and returns the answer of the assistant,
+// which is appended too.
+func (c *Conversation) Send(ctx context.Context, content string) (Message, error) {
+	c.messages = append(c.messages, Message{Role: "user", Content: content})
+	return c.Reply(ctx)
+}
+
+// Reply generates the next message of the assistant and appends it to the history.
+func (c *Conversation) Reply(ctx context.Context) (Message, error) {
+	if err := c.fit(ctx); err != nil {
+		return Message{}, err
+	}
+	answer, err := c.l.Chat(ctx, c.messages, c.opts...)
+	if err != nil {
+		return answer, err
+	}
+	c.messages = append(c.messages, answer)
+	return answer, nil
+}
+
+// fit drops the oldest turns until the history and the answer fit in the context.
+func (c *Conversation) fit(ctx context.Context) error {
+	budget := c.l.ContextUsage().Size - c.maxAnswer
+	n, err := c.l.CountChatTokens(c.messages)
+	if err != nil || n <= budget {
+		return err
+	}
+
+	start := 0
+	for start < len(c.messages) && c.messages[start].Role == "system" {
+		start++
+	}
+	// the previous summary is summarized again along with the newly dropped turns
+	if c.summarized && start > 0 {
+		start--
+	}
+	system := c.messages[:start]
+
+	end := start
+	for n > budget {
+		// the last message is the one being answered
+		if end >= len(c.messages)-1 {
+			return fmt.Errorf("the conversation does not fit in the context")
+		}
+		end++
+		kept := append(append([]Message(nil), system...), c.messages[end:]...)
+		if n, err = c.l.CountChatTokens(kept); err != nil {
+			return err
+		}
+	}
+
+	dropped := c.messages[start:end]
+	rest := c.messages[end:]
+	if c.summarize == nil {
+		c.messages = append(c.messages[:start:start], rest...)
+		return nil
+	}
+
+	// the history is left untouched when the summary fails
+	summary, err := c.summarize(ctx, dropped)
+	if err != nil {
+		return err
+	}
+	c.messages = append(append(c.messages[:start:start], Message{Role: "system", Content: summary}), rest...)
+	c.summarized = true
+
+	if n, err = c.l.CountChatTokens(c.messages); err != nil {
+		return err
+	}
+	if n > budget {
+		return fmt.Errorf("the summary of the conversation does not fit in the context")
+	}
+	return nil
+}
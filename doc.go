@@ -0,0 +1,19 @@
+// Package llama binds llama.cpp to generate text with LLaMA models, embed texts and serve many
+// users from the contexts of a model.
+//
+// # Limitations
+//
+// The bindings are built against a llama.cpp revision which sets these limits:
+//
+//   - A context evaluates the tokens of a single sequence per call, several sequences cannot be
+//     batched. EmbedBatch evaluates its texts one after the other and the Scheduler runs each
+//     generation alone on its context.
+//   - A context cannot be created from loaded weights, each context of a Model loads the file
+//     again.
+//   - The model files store no chat template, it is selected with SetChatTemplate.
+//   - The vocabulary stores the decoded text of the tokens.
+//   - Only generative models are loaded, there are no embedding-only models and no cross-encoder
+//     rerankers.
+//   - The models are evaluated on the CPU and ggml starts the threads of each evaluation, there
+//     is no thread pool.
+package llama
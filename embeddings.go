@@ -0,0 +1,116 @@
+package llama
+
+import (
+	"fmt"
+	"math"
+)
+
+// NormalizeEmbedding scales v to unit length in place and returns its length before, the vector
+// is left unchanged when it is zero.
+func NormalizeEmbedding(v []float32) float32 {
+	var sum float64
+	for _, x := range v {
+		sum += float64(x) * float64(x)
+	}
+	norm := math.Sqrt(sum)
+	if norm > 0 {
+		for i := range v {
+			v[i] = float32(float64(v[i]) / norm)
+		}
+	}
+	return float32(norm)
+}
+
+// postprocessEmbedding applies the options of po to an embedding returned by the model.
+func postprocessEmbedding(v []float32, po PredictOptions) ([]float32, error) {
+	if n := po.EmbeddingDimensions; n > 0 {
+		if n > len(v) {
+			return nil, fmt.Errorf("the embeddings of the model have %d dimensions, not %d", len(v), n)
+		}
+		// the truncated vector of a Matryoshka model is scaled back to unit length
+		v = v[:n:n]
+		NormalizeEmbedding(v)
+	}
+	if po.NormalizeEmbeddings {
+		NormalizeEmbedding(v)
+	}
+	return v, nil
+}
+
+// EmbedDocument embeds a text which may be longer than the context, which would fail like
+// Embeddings, by splitting it into chunks of chunkSize tokens, each one starting with the last
+// overlap tokens of the previous one. The chunks are embedded with EmbedBatch and their
+// embeddings are returned in order, or their mean with SetAverageChunks.
+//
+// The chunks are detokenized to be embedded, the tokens of a chunk may differ slightly once it
+// is tokenized again, chunkSize should leave a margin below the size of the context.
+func (l *LLama) EmbedDocument(text string, chunkSize, overlap int, opts ...PredictOption) ([][]float32, error) {
+	if chunkSize <= 0 {
+		return nil, fmt.Errorf("the chunk size must be positive")
+	}
+	if overlap < 0 || overlap >= chunkSize {
+		return nil, fmt.Errorf("the overlap must be between 0 and the chunk size")
+	}
+
+	tokens, err := l.Tokenize(text, false)
+	if err != nil {
+		return nil, err
+	}
+	var chunks []string
+	var weights []int
+	for start := 0; ; start += chunkSize - overlap {
+		end := start + chunkSize
+		if end > len(tokens) {
+			end = len(tokens)
+		}
+		chunk, err := l.Detokenize(tokens[start:end])
+		if err != nil {
+			return nil, err
+		}
+		chunks = append(chunks, chunk)
+		weights = append(weights, end-start)
+		if end == len(tokens) {
+			break
+		}
+	}
+
+	embeddings, err := l.EmbedBatch(chunks, opts...)
+	if err != nil {
+		return nil, err
+	}
+	po := NewPredictOptions(opts...)
+	if !po.AverageChunks {
+		return embeddings, nil
+	}
+	return [][]float32{averageEmbeddings(embeddings, weights, po.NormalizeEmbeddings)}, nil
+}
+
+// averageEmbeddings returns the mean of the embeddings weighted by weights, scaled to unit length
+// when normalize is set.
+func averageEmbeddings(embeddings [][]float32, weights []int, normalize bool) []float32 {
+	mean := make([]float32, len(embeddings[0]))
+	total := 0
+	for _, w := range weights {
+		total += w
+	}
+	for i, v := range embeddings {
+		w := float32(weights[i])
+		if total == 0 {
+			// the text has no token, each chunk weighs the same
+			w = 1
+		}
+		for j, x := range v {
+			mean[j] += w * x
+		}
+	}
+	if total == 0 {
+		total = len(embeddings)
+	}
+	for j := range mean {
+		mean[j] /= float32(total)
+	}
+	if normalize {
+		NormalizeEmbedding(mean)
+	}
+	return mean
+}
@@ -0,0 +1,66 @@
+// Package embeddings compares the embeddings returned by llama.Embeddings, for simple semantic
+// searches.
+package embeddings
+
+import (
+	"math"
+	"sort"
+)
+
+// DotProduct returns the dot product of a and b, which must have the same length. It is the
+// cosine similarity of normalized vectors.
+func DotProduct(a, b []float32) float32 {
+	if len(a) != len(b) {
+		panic("embeddings: vectors of different lengths")
+	}
+	var dot float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+	}
+	return float32(dot)
+}
+
+// CosineSimilarity returns the cosine of the angle between a and b, which must have the same
+// length. It is 0 when one of them is zero.
+func CosineSimilarity(a, b []float32) float32 {
+	if len(a) != len(b) {
+		panic("embeddings: vectors of different lengths")
+	}
+	var dot, normA, normB float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+		normA += float64(a[i]) * float64(a[i])
+		normB += float64(b[i]) * float64(b[i])
+	}
+	if normA == 0 || normB == 0 {
+		return 0
+	}
+	return float32(dot / math.Sqrt(normA*normB))
+}
+
+// Match is a vector of a corpus matching a query.
+type Match struct {
+	// Index is the index of the vector in the corpus.
+	Index int
+	// Score is the cosine similarity of the vector and the query.
+	Score float32
+}
+
+// TopK returns the k vectors of corpus the most similar to query, by decreasing cosine
+// similarity. Ties are ordered by index.
+func TopK(query []float32, corpus [][]float32, k int) []Match {
+	matches := make([]Match, len(corpus))
+	for i, v := range corpus {
+		matches[i] = Match{Index: i, Score: CosineSimilarity(query, v)}
+	}
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].Score > matches[j].Score
+	})
+	if k < 0 {
+		k = 0
+	}
+	if k < len(matches) {
+		matches = matches[:k]
+	}
+	return matches
+}
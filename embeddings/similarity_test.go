@@ -0,0 +1,25 @@
+package embeddings_test
+
+import (
+	. "github.com/go-skynet/go-llama.cpp/embeddings"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Similarity", func() {
+	It("computes the dot product and the cosine similarity", func() {
+		Expect(DotProduct([]float32{1, 2}, []float32{3, 4})).To(BeNumerically("~", 11, 1e-6))
+		Expect(CosineSimilarity([]float32{1, 0}, []float32{2, 0})).To(BeNumerically("~", 1, 1e-6))
+		Expect(CosineSimilarity([]float32{1, 0}, []float32{0, 3})).To(BeNumerically("~", 0, 1e-6))
+		Expect(CosineSimilarity([]float32{0, 0}, []float32{1, 1})).To(BeZero())
+	})
+
+	It("returns the most similar vectors first", func() {
+		corpus := [][]float32{{0, 1}, {1, 0}, {1, 1}, {-1, 0}}
+		matches := TopK([]float32{1, 0.1}, corpus, 2)
+		Expect(matches).To(HaveLen(2))
+		Expect(matches[0].Index).To(Equal(1))
+		Expect(matches[1].Index).To(Equal(2))
+		Expect(TopK([]float32{1, 0}, corpus, 10)).To(HaveLen(4))
+	})
+})
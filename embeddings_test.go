@@ -0,0 +1,22 @@
+package llama_test
+
+import (
+	. "github.com/go-skynet/go-llama.cpp"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("NormalizeEmbedding", func() {
+	It("scales the vector to unit length and returns its norm", func() {
+		v := []float32{3, 4}
+		Expect(NormalizeEmbedding(v)).To(BeNumerically("~", 5, 1e-6))
+		Expect(v[0]).To(BeNumerically("~", 0.6, 1e-6))
+		Expect(v[1]).To(BeNumerically("~", 0.8, 1e-6))
+	})
+
+	It("leaves zero vectors unchanged", func() {
+		v := []float32{0, 0}
+		Expect(NormalizeEmbedding(v)).To(BeZero())
+		Expect(v).To(Equal([]float32{0, 0}))
+	})
+})
@@ -0,0 +1,83 @@
+package llama
+
+import "context"
+
+// MatchStop feeds tokens to a stopMatcher like a prediction does, then flushes it. It returns the
+// texts passed to the callback, and the text before the match, if any.
+func MatchStop(words, patterns, tokens []string) ([]string, *string, error) {
+	var forwarded []string
+	s, err := newStopMatcher(words, patterns, func(event TokenEvent) bool {
+		forwarded = append(forwarded, event.Text)
+		return true
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, t := range tokens {
+		if !s.tokenCallback(TokenEvent{Text: t}) {
+			break
+		}
+	}
+	s.flush()
+	return forwarded, s.matched, nil
+}
+
+// NewFakePool returns a pool of n contexts which hold no model, they can only be acquired and
+// released.
+func NewFakePool(n int) *ContextPool {
+	p := &ContextPool{free: make(chan *LLama, n)}
+	for i := 0; i < n; i++ {
+		l := &LLama{}
+		p.contexts = append(p.contexts, l)
+		p.free <- l
+	}
+	return p
+}
+
+// Enqueue queues a request for a slot of the scheduler, the returned function waits for it.
+func (s *Scheduler) Enqueue(ctx context.Context) func() (*LLama, error) {
+	r := s.enqueue(ctx)
+	return func() (*LLama, error) {
+		return s.wait(r)
+	}
+}
+
+var (
+	ParseToolCalls = parseToolCalls
+	WithToolCalls  = withToolCalls
+	SplitReasoning = splitReasoning
+	IncompleteUTF8 = incompleteUTF8
+)
+
+// StreamReasoning feeds the chunks of the text generated after prompt to a reasoningSplitter,
+// then flushes it, and returns the chunks of the trace and of the answer it returned.
+func StreamReasoning(start, end, prompt string, chunks []string) (reasoning, answer []string) {
+	s := newReasoningSplitter(start, end, prompt)
+	collect := func(r, a string) {
+		if r != "" {
+			reasoning = append(reasoning, r)
+		}
+		if a != "" {
+			answer = append(answer, a)
+		}
+	}
+	for _, c := range chunks {
+		collect(s.add(c))
+	}
+	collect(s.flush())
+	return reasoning, answer
+}
+
+// StreamChat feeds the chunks of a message to a chatSplitter like ChatStream, then flushes it,
+// and returns the deltas. The reasoning trace is split when start is set.
+func StreamChat(stopWords []string, tools bool, start, end string, chunks []string) []ChatDelta {
+	s := &chatSplitter{stopWords: stopWords, tools: tools}
+	if start != "" {
+		s.reasoning = newReasoningSplitter(start, end, "")
+	}
+	var deltas []ChatDelta
+	for _, c := range chunks {
+		deltas = append(deltas, s.add(c)...)
+	}
+	return append(deltas, s.flush()...)
+}
@@ -0,0 +1,89 @@
+#pragma once
+
+// GBNF grammar support, ported from upstream llama.cpp. The llama.cpp revision the bindings are
+// built against does not ship grammar sampling yet, the names are kept identical to upstream so
+// this file can be dropped once the submodule is updated.
+
+#include "llama.h"
+
+#include <cstdint>
+#include <map>
+#include <string>
+#include <vector>
+
+// grammar element type
+enum llama_gretype {
+    // end of rule definition
+    LLAMA_GRETYPE_END            = 0,
+
+    // start of alternate definition for rule
+    LLAMA_GRETYPE_ALT            = 1,
+
+    // non-terminal element: reference to rule
+    LLAMA_GRETYPE_RULE_REF       = 2,
+
+    // terminal element: character (code point)
+    LLAMA_GRETYPE_CHAR           = 3,
+
+    // inverse char(s) ([^a], [^a-b] [^abc])
+    LLAMA_GRETYPE_CHAR_NOT       = 4,
+
+    // modifies a preceding LLAMA_GRETYPE_CHAR or LLAMA_GRETYPE_CHAR_ALT to
+    // be an inclusive range ([a-z])
+    LLAMA_GRETYPE_CHAR_RNG_UPPER = 5,
+
+    // modifies a preceding LLAMA_GRETYPE_CHAR or
+    // LLAMA_GRETYPE_CHAR_RNG_UPPER to add an alternate char to match ([ab], [a-zA])
+    LLAMA_GRETYPE_CHAR_ALT       = 6,
+
+    // any character (.)
+    LLAMA_GRETYPE_CHAR_ANY       = 7,
+};
+
+struct llama_grammar_element {
+    enum llama_gretype type;
+    uint32_t           value; // Unicode code point or rule ID
+};
+
+struct llama_partial_utf8 {
+    uint32_t value;    // bit value so far (unshifted)
+    int      n_remain; // num bytes remaining; -1 indicates invalid sequence
+};
+
+struct llama_grammar {
+    std::vector<std::vector<llama_grammar_element>>         rules;
+    std::vector<std::vector<const llama_grammar_element *>> stacks;
+
+    // buffer for partially generated UTF-8 sequence from accepted tokens
+    llama_partial_utf8                                      partial_utf8;
+};
+
+namespace grammar_parser {
+    struct parse_state {
+        std::map<std::string, uint32_t>                 symbol_ids;
+        std::vector<std::vector<llama_grammar_element>> rules;
+
+        std::vector<const llama_grammar_element *> c_rules() const;
+    };
+
+    // parse parses a GBNF grammar. It throws std::runtime_error when the grammar is invalid.
+    parse_state parse(const char * src);
+}
+
+struct llama_grammar * llama_grammar_init(
+        const llama_grammar_element ** rules,
+                             size_t    n_rules,
+                             size_t    start_rule_index);
+
+void llama_grammar_free(struct llama_grammar * grammar);
+
+// llama_sample_grammar masks out the candidates that do not match the grammar.
+void llama_sample_grammar(struct llama_context * ctx, llama_token_data_array * candidates, const struct llama_grammar * grammar);
+
+// llama_grammar_accept_token advances the grammar with the sampled token. It returns false when
+// the token is rejected by the grammar.
+bool llama_grammar_accept_token(struct llama_context * ctx, struct llama_grammar * grammar, llama_token token);
+
+// llama_grammar_accept_str advances the grammar with text. It returns false when the text is
+// rejected by the grammar.
+bool llama_grammar_accept_str(struct llama_grammar * grammar, const std::string & text);
@@ -0,0 +1,12 @@
+package grammar
+
+import "strings"
+
+// ChoiceGrammar returns a GBNF grammar whose root rule only accepts one of the choices, exactly.
+func ChoiceGrammar(choices ...string) string {
+	literals := make([]string, len(choices))
+	for i, c := range choices {
+		literals[i] = formatLiteral(c)
+	}
+	return "root ::= " + strings.Join(literals, " | ") + "\n"
+}
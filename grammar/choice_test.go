@@ -0,0 +1,13 @@
+package grammar_test
+
+import (
+	. "github.com/go-skynet/go-llama.cpp/grammar"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ChoiceGrammar", func() {
+	It("accepts one of the literals", func() {
+		Expect(ChoiceGrammar("yes", "no", `say "hi"`)).To(Equal(`root ::= "yes" | "no" | "say \"hi\""` + "\n"))
+	})
+})
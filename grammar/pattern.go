@@ -0,0 +1,156 @@
+package grammar
+
+import (
+	"fmt"
+	"regexp/syntax"
+	"strings"
+	"unicode"
+)
+
+// visitPattern adds a rule for a JSON string matching the regular expression pattern, which
+// must be anchored at both ends.
+func (c *converter) visitPattern(pattern, ruleName string) (string, error) {
+	if !strings.HasPrefix(pattern, "^") || !strings.HasSuffix(pattern, "$") {
+		return "", fmt.Errorf("pattern %q must start with ^ and end with $", pattern)
+	}
+
+	re, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return "", fmt.Errorf("parsing pattern %q: %w", pattern, err)
+	}
+
+	body, err := c.regexpRule(re)
+	if err != nil {
+		return "", fmt.Errorf("pattern %q: %w", pattern, err)
+	}
+	return c.addRule(ruleName, `"\"" `+body+` "\"" space`), nil
+}
+
+func (c *converter) regexpRule(re *syntax.Regexp) (string, error) {
+	switch re.Op {
+	case syntax.OpNoMatch:
+		return "", fmt.Errorf("expression never matches")
+	case syntax.OpEmptyMatch, syntax.OpBeginLine, syntax.OpEndLine, syntax.OpBeginText, syntax.OpEndText:
+		return `""`, nil
+	case syntax.OpLiteral:
+		var sb strings.Builder
+		for _, r := range re.Rune {
+			if re.Flags&syntax.FoldCase != 0 && unicode.ToUpper(r) != unicode.ToLower(r) {
+				sb.WriteString(" [" + rangeChar(unicode.ToLower(r)) + rangeChar(unicode.ToUpper(r)) + "]")
+				continue
+			}
+			sb.WriteString(" " + formatLiteral(jsonEscape(r)))
+		}
+		return "(" + sb.String() + " )", nil
+	case syntax.OpCharClass:
+		return charClass(re.Rune)
+	case syntax.OpAnyChar, syntax.OpAnyCharNotNL:
+		return c.addPrimitive("char", primitiveRules["char"]), nil
+	case syntax.OpCapture:
+		sub, err := c.regexpRule(re.Sub[0])
+		if err != nil {
+			return "", err
+		}
+		return "(" + sub + ")", nil
+	case syntax.OpStar, syntax.OpPlus, syntax.OpQuest:
+		sub, err := c.regexpRule(re.Sub[0])
+		if err != nil {
+			return "", err
+		}
+		op := map[syntax.Op]string{syntax.OpStar: "*", syntax.OpPlus: "+", syntax.OpQuest: "?"}[re.Op]
+		return "(" + sub + ")" + op, nil
+	case syntax.OpRepeat:
+		sub, err := c.regexpRule(re.Sub[0])
+		if err != nil {
+			return "", err
+		}
+		if re.Max < 0 {
+			return fmt.Sprintf("(%s){%d,}", sub, re.Min), nil
+		}
+		return fmt.Sprintf("(%s){%d,%d}", sub, re.Min, re.Max), nil
+	case syntax.OpConcat, syntax.OpAlternate:
+		parts := make([]string, len(re.Sub))
+		for i, s := range re.Sub {
+			sub, err := c.regexpRule(s)
+			if err != nil {
+				return "", err
+			}
+			parts[i] = sub
+		}
+		sep := " "
+		if re.Op == syntax.OpAlternate {
+			sep = " | "
+		}
+		return "(" + strings.Join(parts, sep) + ")", nil
+	default:
+		return "", fmt.Errorf("unsupported regular expression operator %v", re.Op)
+	}
+}
+
+// charClass converts the ranges of a character class into a GBNF character range. Characters
+// that would need escaping in a JSON string are left out.
+func charClass(ranges []rune) (string, error) {
+	excluded := [][2]rune{{0x00, 0x1f}, {'"', '"'}, {'\\', '\\'}, {0x7f, 0x7f}}
+
+	var sb strings.Builder
+	for i := 0; i+1 < len(ranges); i += 2 {
+		lo, hi := ranges[i], ranges[i+1]
+		for _, ex := range excluded {
+			if hi < ex[0] || lo > ex[1] {
+				continue
+			}
+			if lo < ex[0] {
+				writeRange(&sb, lo, ex[0]-1)
+			}
+			lo = ex[1] + 1
+		}
+		if lo <= hi {
+			writeRange(&sb, lo, hi)
+		}
+	}
+	if sb.Len() == 0 {
+		return "", fmt.Errorf("character class only contains characters that must be escaped")
+	}
+	return "[" + sb.String() + "]", nil
+}
+
+func writeRange(sb *strings.Builder, lo, hi rune) {
+	sb.WriteString(rangeChar(lo))
+	if hi != lo {
+		sb.WriteString("-" + rangeChar(hi))
+	}
+}
+
+// rangeChar formats r for use inside a GBNF character range.
+func rangeChar(r rune) string {
+	switch {
+	case r < 0x80 && (unicode.IsLetter(r) || unicode.IsDigit(r)):
+		return string(r)
+	case r <= 0xff:
+		return fmt.Sprintf(`\x%02X`, r)
+	case r <= 0xffff:
+		return fmt.Sprintf(`\u%04X`, r)
+	default:
+		return fmt.Sprintf(`\U%08X`, r)
+	}
+}
+
+// jsonEscape returns how r is written inside a JSON string.
+func jsonEscape(r rune) string {
+	switch r {
+	case '"':
+		return `\"`
+	case '\\':
+		return `\\`
+	case '\n':
+		return `\n`
+	case '\r':
+		return `\r`
+	case '\t':
+		return `\t`
+	}
+	if r < 0x20 {
+		return fmt.Sprintf(`\u%04x`, r)
+	}
+	return string(r)
+}
@@ -0,0 +1,576 @@
+// Package grammar builds GBNF grammars that can be passed to llama.SetGrammar.
+package grammar
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const spaceRule = `| " " | "\n" [ \t]{0,20}`
+
+type primitive struct {
+	rule string
+	deps []string
+}
+
+var primitiveRules = map[string]primitive{
+	"boolean":       {`("true" | "false") space`, nil},
+	"decimal-part":  {`[0-9]{1,16}`, nil},
+	"integral-part": {`[0] | [1-9] [0-9]{0,15}`, nil},
+	"number":        {`("-"? integral-part) ("." decimal-part)? ([eE] [-+]? integral-part)? space`, []string{"integral-part", "decimal-part"}},
+	"integer":       {`("-"? integral-part) space`, []string{"integral-part"}},
+	"value":         {`object | array | string | number | boolean | null`, []string{"object", "array", "string", "number", "boolean", "null"}},
+	"object":        {`"{" space ( string ":" space value ("," space string ":" space value)* )? "}" space`, []string{"string", "value"}},
+	"array":         {`"[" space ( value ("," space value)* )? "]" space`, []string{"value"}},
+	"uuid":          {`"\"" [0-9a-fA-F]{8} "-" [0-9a-fA-F]{4} "-" [0-9a-fA-F]{4} "-" [0-9a-fA-F]{4} "-" [0-9a-fA-F]{12} "\"" space`, nil},
+	"char":          {`[^"\\\x7F\x00-\x1F] | [\\] (["\\bfnrt] | "u" [0-9a-fA-F]{4})`, nil},
+	"string":        {`"\"" char* "\"" space`, []string{"char"}},
+	"null":          {`"null" space`, nil},
+}
+
+var stringFormatRules = map[string]primitive{
+	"date":             {`[0-9]{4} "-" ( "0" [1-9] | "1" [0-2] ) "-" ( "0" [1-9] | [1-2] [0-9] | "3" [0-1] )`, nil},
+	"time":             {`([01] [0-9] | "2" [0-3]) ":" [0-5] [0-9] ":" [0-5] [0-9] ( "." [0-9]{3} )? ( "Z" | ( "+" | "-" ) ( [01] [0-9] | "2" [0-3] ) ":" [0-5] [0-9] )`, nil},
+	"date-time":        {`date "T" time`, []string{"date", "time"}},
+	"date-string":      {`"\"" date "\"" space`, []string{"date"}},
+	"time-string":      {`"\"" time "\"" space`, []string{"time"}},
+	"date-time-string": {`"\"" date-time "\"" space`, []string{"date-time"}},
+}
+
+var invalidRuleChars = regexp.MustCompile(`[^a-zA-Z0-9-]+`)
+
+// SchemaToGrammar converts a JSON schema into a GBNF grammar whose root rule only accepts JSON
+// documents matching the schema.
+//
+// Objects, arrays, tuples, strings (including length limits, patterns and the date, time,
+// date-time and uuid formats), numbers, integers, booleans, null, enum, const, oneOf, anyOf
+// and local $ref references are supported. Numeric bounds are not enforced.
+func SchemaToGrammar(jsonSchema []byte) (string, error) {
+	dec := json.NewDecoder(bytes.NewReader(jsonSchema))
+	dec.UseNumber()
+	schema, err := decodeOrdered(dec)
+	if err != nil {
+		return "", fmt.Errorf("parsing schema: %w", err)
+	}
+
+	c := &converter{
+		root:      schema,
+		rules:     map[string]string{"space": spaceRule},
+		resolving: map[string]bool{},
+	}
+	if _, err := c.visit(schema, ""); err != nil {
+		return "", err
+	}
+	return c.format(), nil
+}
+
+type converter struct {
+	root      interface{}
+	rules     map[string]string
+	resolving map[string]bool
+}
+
+func (c *converter) format() string {
+	names := make([]string, 0, len(c.rules))
+	for name := range c.rules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var sb strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&sb, "%s ::= %s\n", name, c.rules[name])
+	}
+	return sb.String()
+}
+
+func (c *converter) addRule(name, rule string) string {
+	escName := invalidRuleChars.ReplaceAllString(name, "-")
+	key := escName
+	if existing, ok := c.rules[escName]; ok && existing != rule {
+		i := 0
+		for {
+			key = escName + strconv.Itoa(i)
+			if existing, ok := c.rules[key]; !ok || existing == rule {
+				break
+			}
+			i++
+		}
+	}
+	c.rules[key] = rule
+	return key
+}
+
+func (c *converter) addPrimitive(name string, p primitive) string {
+	n := c.addRule(name, p.rule)
+	for _, dep := range p.deps {
+		if _, ok := c.rules[dep]; ok {
+			continue
+		}
+		depRule, ok := primitiveRules[dep]
+		if !ok {
+			depRule = stringFormatRules[dep]
+		}
+		c.addPrimitive(dep, depRule)
+	}
+	return n
+}
+
+func isReserved(name string) bool {
+	if name == "root" || name == "dot" {
+		return true
+	}
+	if _, ok := primitiveRules[name]; ok {
+		return true
+	}
+	_, ok := stringFormatRules[name]
+	return ok
+}
+
+func subName(name, suffix string) string {
+	if name == "" {
+		return suffix
+	}
+	return name + "-" + suffix
+}
+
+func (c *converter) visit(node interface{}, name string) (string, error) {
+	var schema *object
+	switch v := node.(type) {
+	case *object:
+		schema = v
+	case bool:
+		if !v {
+			return "", fmt.Errorf("schema %q never matches", name)
+		}
+		schema = &object{values: map[string]interface{}{}}
+	default:
+		return "", fmt.Errorf("schema %q is not an object", name)
+	}
+
+	ruleName := name
+	if ruleName == "" {
+		ruleName = "root"
+	} else if isReserved(ruleName) {
+		ruleName += "-"
+	}
+
+	schemaType, _ := schema.values["type"]
+	typeName, _ := schemaType.(string)
+	format, _ := schema.values["format"].(string)
+
+	if ref, ok := schema.values["$ref"].(string); ok {
+		target, err := c.resolveRef(ref)
+		if err != nil {
+			return "", err
+		}
+		if target == invalidRuleChars.ReplaceAllString(ruleName, "-") {
+			return target, nil
+		}
+		return c.addRule(ruleName, target), nil
+	}
+
+	if alts, ok := schema.values["oneOf"]; ok {
+		return c.visitUnion(alts, name, ruleName)
+	}
+	if alts, ok := schema.values["anyOf"]; ok {
+		return c.visitUnion(alts, name, ruleName)
+	}
+
+	if types, ok := schemaType.([]interface{}); ok {
+		var alts []interface{}
+		for _, t := range types {
+			alt := schema.clone()
+			alt.set("type", t)
+			alts = append(alts, alt)
+		}
+		return c.visitUnion(alts, name, ruleName)
+	}
+
+	if value, ok := schema.values["const"]; ok {
+		lit, err := constantRule(value)
+		if err != nil {
+			return "", err
+		}
+		return c.addRule(ruleName, lit+" space"), nil
+	}
+
+	if values, ok := schema.values["enum"]; ok {
+		list, ok := values.([]interface{})
+		if !ok {
+			return "", fmt.Errorf("enum of %q must be an array", ruleName)
+		}
+		alts := make([]string, len(list))
+		for i, v := range list {
+			lit, err := constantRule(v)
+			if err != nil {
+				return "", err
+			}
+			alts[i] = lit
+		}
+		return c.addRule(ruleName, "("+strings.Join(alts, " | ")+") space"), nil
+	}
+
+	_, hasProperties := schema.values["properties"]
+	additional, hasAdditional := schema.values["additionalProperties"]
+	if (typeName == "" || typeName == "object") && (hasProperties || (hasAdditional && additional != true)) {
+		rule, err := c.buildObjectRule(schema, name)
+		if err != nil {
+			return "", err
+		}
+		return c.addRule(ruleName, rule), nil
+	}
+
+	if _, ok := schema.values["allOf"]; ok {
+		return "", fmt.Errorf("allOf is not supported")
+	}
+
+	items, hasItems := schema.values["items"]
+	if prefix, ok := schema.values["prefixItems"]; ok {
+		items, hasItems = prefix, true
+	}
+	if (typeName == "" || typeName == "array") && hasItems {
+		if tuple, ok := items.([]interface{}); ok {
+			parts := make([]string, len(tuple))
+			for i, item := range tuple {
+				itemRule, err := c.visit(item, subName(name, "tuple-"+strconv.Itoa(i)))
+				if err != nil {
+					return "", err
+				}
+				parts[i] = itemRule
+			}
+			return c.addRule(ruleName, `"[" space `+strings.Join(parts, ` "," space `)+` "]" space`), nil
+		}
+
+		itemRule, err := c.visit(items, subName(name, "item"))
+		if err != nil {
+			return "", err
+		}
+		minItems, maxItems, err := bounds(schema, "minItems", "maxItems")
+		if err != nil {
+			return "", err
+		}
+		return c.addRule(ruleName, `"[" space `+buildRepetition(itemRule, minItems, maxItems, `"," space`)+` "]" space`), nil
+	}
+
+	if pattern, ok := schema.values["pattern"].(string); ok && (typeName == "" || typeName == "string") {
+		return c.visitPattern(pattern, ruleName)
+	}
+
+	if (typeName == "" || typeName == "string") && (format == "uuid" || (strings.HasPrefix(format, "uuid") && len(format) == 5 && format[4] >= '1' && format[4] <= '5')) {
+		primName := format
+		if ruleName == "root" {
+			primName = "root"
+		}
+		return c.addPrimitive(primName, primitiveRules["uuid"]), nil
+	}
+
+	if p, ok := stringFormatRules[format+"-string"]; ok && (typeName == "" || typeName == "string") {
+		primName := format + "-string"
+		if ruleName == "root" {
+			primName = "root"
+		}
+		return c.addPrimitive(primName, p), nil
+	}
+
+	_, hasMin := schema.values["minLength"]
+	_, hasMax := schema.values["maxLength"]
+	if typeName == "string" && (hasMin || hasMax) {
+		charRule := c.addPrimitive("char", primitiveRules["char"])
+		minLength, maxLength, err := bounds(schema, "minLength", "maxLength")
+		if err != nil {
+			return "", err
+		}
+		return c.addRule(ruleName, `"\"" `+buildRepetition(charRule, minLength, maxLength, "")+` "\"" space`), nil
+	}
+
+	if typeName == "object" || len(schema.keys) == 0 {
+		return c.addRule(ruleName, c.addPrimitive("object", primitiveRules["object"])), nil
+	}
+
+	if typeName == "" {
+		return c.addRule(ruleName, c.addPrimitive("value", primitiveRules["value"])), nil
+	}
+
+	p, ok := primitiveRules[typeName]
+	if !ok {
+		return "", fmt.Errorf("unrecognized schema type %q", typeName)
+	}
+	primName := typeName
+	if ruleName == "root" {
+		primName = "root"
+	}
+	return c.addPrimitive(primName, p), nil
+}
+
+func (c *converter) visitUnion(alts interface{}, name, ruleName string) (string, error) {
+	list, ok := alts.([]interface{})
+	if !ok {
+		return "", fmt.Errorf("alternatives of %q must be an array", ruleName)
+	}
+
+	prefix := name + "-"
+	if name == "" {
+		prefix = "alternative-"
+	}
+	parts := make([]string, len(list))
+	for i, alt := range list {
+		altRule, err := c.visit(alt, prefix+strconv.Itoa(i))
+		if err != nil {
+			return "", err
+		}
+		parts[i] = altRule
+	}
+	return c.addRule(ruleName, strings.Join(parts, " | ")), nil
+}
+
+func (c *converter) buildObjectRule(schema *object, name string) (string, error) {
+	var propNames []string
+	kvRules := map[string]string{}
+
+	if props, ok := schema.values["properties"]; ok {
+		properties, ok := props.(*object)
+		if !ok {
+			return "", fmt.Errorf("properties of %q must be an object", name)
+		}
+		for _, prop := range properties.keys {
+			propRule, err := c.visit(properties.values[prop], subName(name, prop))
+			if err != nil {
+				return "", err
+			}
+			lit, err := constantRule(prop)
+			if err != nil {
+				return "", err
+			}
+			kvRules[prop] = c.addRule(subName(name, prop)+"-kv", lit+` space ":" space `+propRule)
+			propNames = append(propNames, prop)
+		}
+	}
+
+	required := map[string]bool{}
+	if req, ok := schema.values["required"].([]interface{}); ok {
+		for _, r := range req {
+			if s, ok := r.(string); ok {
+				required[s] = true
+			}
+		}
+	}
+
+	var requiredProps, optionalProps []string
+	for _, prop := range propNames {
+		if required[prop] {
+			requiredProps = append(requiredProps, prop)
+		} else {
+			optionalProps = append(optionalProps, prop)
+		}
+	}
+
+	// additional properties are represented by the "*" key, which can repeat
+	if additional, ok := schema.values["additionalProperties"]; ok && additional != false {
+		valueSchema := additional
+		if additional == true {
+			valueSchema = &object{values: map[string]interface{}{}}
+		}
+		subRule, err := c.visit(valueSchema, subName(name, "additional-value"))
+		if err != nil {
+			return "", err
+		}
+		stringRule := c.addPrimitive("string", primitiveRules["string"])
+		kvRules["*"] = c.addRule(subName(name, "additional-kv"), stringRule+` ":" space `+subRule)
+		optionalProps = append(optionalProps, "*")
+	}
+
+	var sb strings.Builder
+	sb.WriteString(`"{" space `)
+	for i, prop := range requiredProps {
+		if i > 0 {
+			sb.WriteString(` "," space `)
+		}
+		sb.WriteString(kvRules[prop])
+	}
+
+	if len(optionalProps) > 0 {
+		sb.WriteString(" (")
+		if len(requiredProps) > 0 {
+			sb.WriteString(` "," space ( `)
+		}
+
+		var recursiveRefs func(ks []string, firstIsOptional bool) string
+		recursiveRefs = func(ks []string, firstIsOptional bool) string {
+			k := ks[0]
+			kvRule := kvRules[k]
+			commaRef := `( "," space ` + kvRule + ` )`
+			var res string
+			if firstIsOptional {
+				if k == "*" {
+					res = commaRef + "*"
+				} else {
+					res = commaRef + "?"
+				}
+			} else {
+				res = kvRule
+				if k == "*" {
+					res += " " + commaRef + "*"
+				}
+			}
+			if len(ks) > 1 {
+				res += " " + c.addRule(subName(name, k)+"-rest", recursiveRefs(ks[1:], true))
+			}
+			return res
+		}
+
+		alts := make([]string, len(optionalProps))
+		for i := range optionalProps {
+			alts[i] = recursiveRefs(optionalProps[i:], false)
+		}
+		sb.WriteString(strings.Join(alts, " | "))
+
+		if len(requiredProps) > 0 {
+			sb.WriteString(" )")
+		}
+		sb.WriteString(" )?")
+	}
+	sb.WriteString(` "}" space`)
+	return sb.String(), nil
+}
+
+func (c *converter) resolveRef(ref string) (string, error) {
+	if !strings.HasPrefix(ref, "#/") && ref != "#" {
+		return "", fmt.Errorf("unsupported $ref %q: only local references are supported", ref)
+	}
+
+	refName := ref[strings.LastIndex(ref, "/")+1:]
+	if ref == "#" {
+		refName = "root"
+	}
+	if _, ok := c.rules[refName]; ok || c.resolving[ref] {
+		return invalidRuleChars.ReplaceAllString(refName, "-"), nil
+	}
+
+	target := c.root
+	if ref != "#" {
+		for _, part := range strings.Split(ref[2:], "/") {
+			part = strings.ReplaceAll(strings.ReplaceAll(part, "~1", "/"), "~0", "~")
+			obj, ok := target.(*object)
+			if !ok {
+				return "", fmt.Errorf("unresolved $ref %q", ref)
+			}
+			if target, ok = obj.values[part]; !ok {
+				return "", fmt.Errorf("unresolved $ref %q", ref)
+			}
+		}
+	}
+
+	c.resolving[ref] = true
+	defer delete(c.resolving, ref)
+	return c.visit(target, refName)
+}
+
+// buildRepetition repeats itemRule between min and max times, max < 0 meaning unbounded.
+func buildRepetition(itemRule string, min, max int, separatorRule string) string {
+	if max == 0 {
+		return ""
+	}
+	if min == 0 && max == 1 {
+		return itemRule + "?"
+	}
+
+	if separatorRule == "" {
+		switch {
+		case min == 1 && max < 0:
+			return itemRule + "+"
+		case min == 0 && max < 0:
+			return itemRule + "*"
+		case max < 0:
+			return fmt.Sprintf("%s{%d,}", itemRule, min)
+		default:
+			return fmt.Sprintf("%s{%d,%d}", itemRule, min, max)
+		}
+	}
+
+	innerMin, innerMax := min-1, max-1
+	if innerMin < 0 {
+		innerMin = 0
+	}
+	if max < 0 {
+		innerMax = -1
+	}
+	result := itemRule + " " + buildRepetition("("+separatorRule+" "+itemRule+")", innerMin, innerMax, "")
+	if min == 0 {
+		return "(" + result + ")?"
+	}
+	return result
+}
+
+func bounds(schema *object, minKey, maxKey string) (int, int, error) {
+	min, max := 0, -1
+	if v, ok := schema.values[minKey]; ok {
+		n, err := toInt(v)
+		if err != nil {
+			return 0, 0, fmt.Errorf("%s: %w", minKey, err)
+		}
+		min = n
+	}
+	if v, ok := schema.values[maxKey]; ok {
+		n, err := toInt(v)
+		if err != nil {
+			return 0, 0, fmt.Errorf("%s: %w", maxKey, err)
+		}
+		max = n
+	}
+	return min, max, nil
+}
+
+func toInt(v interface{}) (int, error) {
+	n, ok := v.(json.Number)
+	if !ok {
+		return 0, fmt.Errorf("expected a number, got %v", v)
+	}
+	i, err := strconv.Atoi(n.String())
+	if err != nil || i < 0 {
+		return 0, fmt.Errorf("expected a non-negative integer, got %v", n)
+	}
+	return i, nil
+}
+
+// constantRule returns a GBNF literal matching the JSON encoding of value.
+func constantRule(value interface{}) (string, error) {
+	b, err := marshal(plain(value))
+	if err != nil {
+		return "", err
+	}
+	return formatLiteral(string(b)), nil
+}
+
+// formatLiteral quotes s as a GBNF string literal.
+func formatLiteral(s string) string {
+	var sb strings.Builder
+	sb.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '"':
+			sb.WriteString(`\"`)
+		case '\\':
+			sb.WriteString(`\\`)
+		case '\n':
+			sb.WriteString(`\n`)
+		case '\r':
+			sb.WriteString(`\r`)
+		case '\t':
+			sb.WriteString(`\t`)
+		default:
+			if r < 0x20 || r == 0x7f {
+				fmt.Fprintf(&sb, `\x%02X`, r)
+			} else {
+				sb.WriteRune(r)
+			}
+		}
+	}
+	sb.WriteByte('"')
+	return sb.String()
+}
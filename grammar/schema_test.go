@@ -0,0 +1,71 @@
+package grammar_test
+
+import (
+	. "github.com/go-skynet/go-llama.cpp/grammar"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("SchemaToGrammar", func() {
+	It("converts primitive types", func() {
+		g, err := SchemaToGrammar([]byte(`{"type": "boolean"}`))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(g).To(Equal(`root ::= ("true" | "false") space
+space ::= | " " | "\n" [ \t]{0,20}
+`))
+	})
+
+	It("keeps the property order and makes non-required properties optional", func() {
+		g, err := SchemaToGrammar([]byte(`{
+			"type": "object",
+			"properties": {"b": {"type": "integer"}, "a": {"type": "string"}},
+			"required": ["b"]
+		}`))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(g).To(ContainSubstring(`root ::= "{" space b-kv ( "," space ( a-kv ) )? "}" space`))
+		Expect(g).To(ContainSubstring(`b-kv ::= "\"b\"" space ":" space integer`))
+		Expect(g).To(ContainSubstring(`a-kv ::= "\"a\"" space ":" space string`))
+	})
+
+	It("converts enums and constants to literals", func() {
+		g, err := SchemaToGrammar([]byte(`{"enum": ["red", 1, null]}`))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(g).To(ContainSubstring(`root ::= ("\"red\"" | "1" | "null") space`))
+	})
+
+	It("bounds arrays and strings", func() {
+		g, err := SchemaToGrammar([]byte(`{"type": "array", "items": {"type": "string", "maxLength": 3}, "minItems": 1, "maxItems": 2}`))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(g).To(ContainSubstring(`root ::= "[" space item ("," space item)? "]" space`))
+		Expect(g).To(ContainSubstring(`item ::= "\"" char{0,3} "\"" space`))
+	})
+
+	It("resolves local references", func() {
+		g, err := SchemaToGrammar([]byte(`{"$ref": "#/$defs/point", "$defs": {"point": {"properties": {"x": {"type": "number"}}, "required": ["x"]}}}`))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(g).To(ContainSubstring(`root ::= point`))
+		Expect(g).To(ContainSubstring(`point ::= "{" space point-x-kv "}" space`))
+	})
+
+	It("converts anchored patterns", func() {
+		g, err := SchemaToGrammar([]byte(`{"type": "string", "pattern": "^[a-c]+-[0-9]{2}$"}`))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(g).To(ContainSubstring(`root ::= "\"" `))
+		Expect(g).To(ContainSubstring(`([a-c])+`))
+		Expect(g).To(ContainSubstring(`([0-9]){2,2}`))
+	})
+
+	It("fails on unsupported schemas", func() {
+		_, err := SchemaToGrammar([]byte(`{"type": "string", "pattern": "[a-z]"}`))
+		Expect(err).To(HaveOccurred())
+
+		_, err = SchemaToGrammar([]byte(`{"allOf": [{"type": "string"}]}`))
+		Expect(err).To(HaveOccurred())
+
+		_, err = SchemaToGrammar([]byte(`{"$ref": "https://example.com/schema.json"}`))
+		Expect(err).To(HaveOccurred())
+
+		_, err = SchemaToGrammar([]byte(`{"type": "tuple"}`))
+		Expect(err).To(HaveOccurred())
+	})
+})
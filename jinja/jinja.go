@@ -0,0 +1,455 @@
+// Package jinja renders the subset of Jinja2 chat templates are written in, so the templates
+// shipped with models can format the prompts of llama.SetJinjaTemplate.
+//
+// The {{ }} outputs, {# #} comments and the if, for and set statements are supported, with the
+// whitespace control of the - and + modifiers. Templates are rendered with the trim_blocks and
+// lstrip_blocks settings chat templates expect. Expressions support literals, lists, dicts,
+// attributes, subscripts and slices, the arithmetic, comparison, logic and ~ operators,
+// conditional expressions, the common filters and tests, the methods of strings and dicts, and
+// the raise_exception, namespace and range global functions. Macros, blocks and inheritance are
+// not supported.
+package jinja
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Template is a parsed template.
+type Template struct {
+	nodes []node
+}
+
+// Parse parses the template src.
+func Parse(src string) (*Template, error) {
+	segs, err := scan(src)
+	if err != nil {
+		return nil, err
+	}
+	tp := &templateParser{segs: segs}
+	nodes, _, _, err := tp.parseBody()
+	if err != nil {
+		return nil, err
+	}
+	return &Template{nodes: nodes}, nil
+}
+
+// Execute renders the template with the variables vars. The Go values are converted to the
+// values of the template: maps become dicts with sorted keys, slices become lists and
+// json.RawMessage values are decoded.
+func (t *Template) Execute(vars map[string]interface{}) (string, error) {
+	globals := map[string]interface{}{
+		"raise_exception": function(func(args []interface{}, kwargs *dict) (interface{}, error) {
+			return nil, errors.New(str(arg(args, kwargs, 0, "message", "")))
+		}),
+		"namespace": function(func(args []interface{}, kwargs *dict) (interface{}, error) {
+			if kwargs == nil {
+				return newDict(), nil
+			}
+			return kwargs, nil
+		}),
+		"range": function(rangeFunc),
+	}
+	locals := map[string]interface{}{}
+	for k, v := range vars {
+		locals[k] = toValue(v)
+	}
+
+	s := &state{scopes: []map[string]interface{}{globals, locals}}
+	var sb strings.Builder
+	if err := render(s, &sb, t.nodes); err != nil {
+		return "", err
+	}
+	return sb.String(), nil
+}
+
+func rangeFunc(args []interface{}, kwargs *dict) (interface{}, error) {
+	bounds := make([]int, len(args))
+	for i, a := range args {
+		n, ok := a.(int)
+		if !ok {
+			return nil, fmt.Errorf("range expects integers")
+		}
+		bounds[i] = n
+	}
+	start, stop, step := 0, 0, 1
+	switch len(bounds) {
+	case 1:
+		stop = bounds[0]
+	case 2:
+		start, stop = bounds[0], bounds[1]
+	case 3:
+		start, stop, step = bounds[0], bounds[1], bounds[2]
+	default:
+		return nil, fmt.Errorf("range expects 1 to 3 arguments")
+	}
+	if step == 0 {
+		return nil, fmt.Errorf("range step must not be zero")
+	}
+	list := []interface{}{}
+	for i := start; (step > 0 && i < stop) || (step < 0 && i > stop); i += step {
+		list = append(list, i)
+	}
+	return list, nil
+}
+
+// state holds the variables of a rendering, the innermost scope last.
+type state struct {
+	scopes []map[string]interface{}
+}
+
+func (s *state) lookup(name string) interface{} {
+	for i := len(s.scopes) - 1; i >= 0; i-- {
+		if v, ok := s.scopes[i][name]; ok {
+			return v
+		}
+	}
+	return undefined{}
+}
+
+func (s *state) set(name string, v interface{}) {
+	s.scopes[len(s.scopes)-1][name] = v
+}
+
+type node interface {
+	render(s *state, sb *strings.Builder) error
+}
+
+func render(s *state, sb *strings.Builder, nodes []node) error {
+	for _, n := range nodes {
+		if err := n.render(s, sb); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type textNode string
+
+func (n textNode) render(s *state, sb *strings.Builder) error {
+	sb.WriteString(string(n))
+	return nil
+}
+
+type outputNode struct {
+	value expr
+}
+
+func (n outputNode) render(s *state, sb *strings.Builder) error {
+	v, err := n.value(s)
+	if err != nil {
+		return err
+	}
+	sb.WriteString(str(v))
+	return nil
+}
+
+type ifNode struct {
+	conds     []expr
+	bodies    [][]node
+	otherwise []node
+}
+
+func (n ifNode) render(s *state, sb *strings.Builder) error {
+	for i, cond := range n.conds {
+		v, err := cond(s)
+		if err != nil {
+			return err
+		}
+		if truthy(v) {
+			return render(s, sb, n.bodies[i])
+		}
+	}
+	return render(s, sb, n.otherwise)
+}
+
+type forNode struct {
+	targets   []string
+	iter      expr
+	filter    expr
+	body      []node
+	otherwise []node
+}
+
+func (n forNode) render(s *state, sb *strings.Builder) error {
+	v, err := n.iter(s)
+	if err != nil {
+		return err
+	}
+	items, err := iterate(v)
+	if err != nil {
+		return err
+	}
+
+	if n.filter != nil {
+		var kept []interface{}
+		for _, item := range items {
+			s.scopes = append(s.scopes, map[string]interface{}{})
+			err := n.assign(s, item)
+			var ok interface{}
+			if err == nil {
+				ok, err = n.filter(s)
+			}
+			s.scopes = s.scopes[:len(s.scopes)-1]
+			if err != nil {
+				return err
+			}
+			if truthy(ok) {
+				kept = append(kept, item)
+			}
+		}
+		items = kept
+	}
+	if len(items) == 0 {
+		return render(s, sb, n.otherwise)
+	}
+
+	for i, item := range items {
+		loop := newDict()
+		loop.set("index", i+1)
+		loop.set("index0", i)
+		loop.set("revindex", len(items)-i)
+		loop.set("revindex0", len(items)-i-1)
+		loop.set("first", i == 0)
+		loop.set("last", i == len(items)-1)
+		loop.set("length", len(items))
+		if i > 0 {
+			loop.set("previtem", items[i-1])
+		}
+		if i+1 < len(items) {
+			loop.set("nextitem", items[i+1])
+		}
+
+		// the variables set in the body are local to the iteration
+		s.scopes = append(s.scopes, map[string]interface{}{"loop": loop})
+		err := n.assign(s, item)
+		if err == nil {
+			err = render(s, sb, n.body)
+		}
+		s.scopes = s.scopes[:len(s.scopes)-1]
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (n forNode) assign(s *state, item interface{}) error {
+	if len(n.targets) == 1 {
+		s.set(n.targets[0], item)
+		return nil
+	}
+	values, ok := item.([]interface{})
+	if !ok || len(values) != len(n.targets) {
+		return fmt.Errorf("cannot unpack %s into %d variables", repr(item), len(n.targets))
+	}
+	for i, t := range n.targets {
+		s.set(t, values[i])
+	}
+	return nil
+}
+
+type setNode struct {
+	name, attr string
+	value      expr
+	body       []node
+}
+
+func (n setNode) render(s *state, sb *strings.Builder) error {
+	var v interface{}
+	if n.value != nil {
+		var err error
+		if v, err = n.value(s); err != nil {
+			return err
+		}
+	} else {
+		var body strings.Builder
+		if err := render(s, &body, n.body); err != nil {
+			return err
+		}
+		v = body.String()
+	}
+
+	if n.attr == "" {
+		s.set(n.name, v)
+		return nil
+	}
+	ns, ok := s.lookup(n.name).(*dict)
+	if !ok {
+		return fmt.Errorf("cannot set attribute %q of %s", n.attr, n.name)
+	}
+	ns.set(n.attr, v)
+	return nil
+}
+
+// templateParser parses the statements of a template.
+type templateParser struct {
+	segs []segment
+	pos  int
+}
+
+// parseBody parses the nodes up to one of the ends tags, it returns the name of the tag and the
+// parser of its content.
+func (tp *templateParser) parseBody(ends ...string) ([]node, string, *parser, error) {
+	var nodes []node
+	for ; tp.pos < len(tp.segs); tp.pos++ {
+		seg := tp.segs[tp.pos]
+		switch seg.kind {
+		case segText:
+			if seg.text != "" {
+				nodes = append(nodes, textNode(seg.text))
+			}
+			continue
+		case segComment:
+			continue
+		}
+
+		p, err := newParser(seg.text)
+		if err != nil {
+			return nil, "", nil, err
+		}
+		if seg.kind == segOutput {
+			value, err := p.parseExpr()
+			if err == nil {
+				err = p.end()
+			}
+			if err != nil {
+				return nil, "", nil, fmt.Errorf("in {{ %s }}: %w", seg.text, err)
+			}
+			nodes = append(nodes, outputNode{value})
+			continue
+		}
+
+		keyword, err := p.name()
+		if err != nil {
+			return nil, "", nil, err
+		}
+		for _, end := range ends {
+			if keyword == end {
+				tp.pos++
+				return nodes, keyword, p, nil
+			}
+		}
+		tp.pos++
+		var n node
+		switch keyword {
+		case "if":
+			n, err = tp.parseIf(p)
+		case "for":
+			n, err = tp.parseFor(p)
+		case "set":
+			n, err = tp.parseSet(p)
+		case "generation", "endgeneration":
+			// the markers of the assistant turns have no output
+			err = p.end()
+		default:
+			err = fmt.Errorf("unsupported tag %q", keyword)
+		}
+		tp.pos--
+		if err != nil {
+			return nil, "", nil, fmt.Errorf("in {%% %s %%}: %w", seg.text, err)
+		}
+		if n != nil {
+			nodes = append(nodes, n)
+		}
+	}
+	if len(ends) > 0 {
+		return nil, "", nil, fmt.Errorf("missing {%% %s %%}", ends[len(ends)-1])
+	}
+	return nodes, "", nil, nil
+}
+
+func (tp *templateParser) parseIf(p *parser) (node, error) {
+	var n ifNode
+	for {
+		cond, err := p.parseExpr()
+		if err == nil {
+			err = p.end()
+		}
+		if err != nil {
+			return nil, err
+		}
+		body, end, next, err := tp.parseBody("elif", "else", "endif")
+		if err != nil {
+			return nil, err
+		}
+		n.conds, n.bodies = append(n.conds, cond), append(n.bodies, body)
+		switch end {
+		case "elif":
+			p = next
+			continue
+		case "else":
+			if n.otherwise, _, _, err = tp.parseBody("endif"); err != nil {
+				return nil, err
+			}
+		}
+		return n, nil
+	}
+}
+
+func (tp *templateParser) parseFor(p *parser) (node, error) {
+	var n forNode
+	for {
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		n.targets = append(n.targets, name)
+		if !p.accept(",") {
+			break
+		}
+	}
+	if !p.acceptName("in") {
+		return nil, fmt.Errorf("expected \"in\"")
+	}
+	var err error
+	if n.iter, err = p.parseOr(); err != nil {
+		return nil, err
+	}
+	if p.acceptName("if") {
+		if n.filter, err = p.parseExpr(); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.end(); err != nil {
+		return nil, err
+	}
+
+	body, end, _, err := tp.parseBody("else", "endfor")
+	if err != nil {
+		return nil, err
+	}
+	n.body = body
+	if end == "else" {
+		if n.otherwise, _, _, err = tp.parseBody("endfor"); err != nil {
+			return nil, err
+		}
+	}
+	return n, nil
+}
+
+func (tp *templateParser) parseSet(p *parser) (node, error) {
+	var n setNode
+	var err error
+	if n.name, err = p.name(); err != nil {
+		return nil, err
+	}
+	if p.accept(".") {
+		if n.attr, err = p.name(); err != nil {
+			return nil, err
+		}
+	}
+	if !p.accept("=") {
+		// {% set name %}...{% endset %}
+		if err := p.end(); err != nil {
+			return nil, err
+		}
+		n.body, _, _, err = tp.parseBody("endset")
+		return n, err
+	}
+	if n.value, err = p.parseExpr(); err != nil {
+		return nil, err
+	}
+	return n, p.end()
+}
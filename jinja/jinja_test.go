@@ -0,0 +1,94 @@
+package jinja_test
+
+import (
+	. "github.com/go-skynet/go-llama.cpp/jinja"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func render(src string, vars map[string]interface{}) (string, error) {
+	t, err := Parse(src)
+	if err != nil {
+		return "", err
+	}
+	return t.Execute(vars)
+}
+
+var _ = Describe("Template", func() {
+	messages := []map[string]interface{}{
+		{"role": "system", "content": "Be brief."},
+		{"role": "user", "content": "Hi"},
+		{"role": "assistant", "content": "Hello"},
+		{"role": "user", "content": "Bye"},
+	}
+
+	It("renders ChatML", func() {
+		out, err := render(`{% for message in messages %}{{'<|im_start|>' + message['role'] + '\n' + message['content'] + '<|im_end|>' + '\n'}}{% endfor %}{% if add_generation_prompt %}{{ '<|im_start|>assistant\n' }}{% endif %}`,
+			map[string]interface{}{"messages": messages[:2], "add_generation_prompt": true})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(out).To(Equal("<|im_start|>system\nBe brief.<|im_end|>\n<|im_start|>user\nHi<|im_end|>\n<|im_start|>assistant\n"))
+	})
+
+	It("renders Llama 2 with the whitespace control and the loop variables", func() {
+		src := `{% if messages[0]['role'] == 'system' %}
+    {% set loop_messages = messages[1:] %}
+    {% set system_message = messages[0]['content'] %}
+{% else %}
+    {% set loop_messages = messages %}
+    {% set system_message = false %}
+{% endif %}
+{% for message in loop_messages %}
+    {% if (message['role'] == 'user') != (loop.index0 % 2 == 0) %}
+        {{ raise_exception('Conversation roles must alternate user/assistant/user/assistant/...') }}
+    {% endif %}
+    {% if loop.index0 == 0 and system_message != false %}
+        {% set content = '<<SYS>>\n' + system_message + '\n<</SYS>>\n\n' + message['content'] %}
+    {% else %}
+        {% set content = message['content'] %}
+    {% endif %}
+    {% if message['role'] == 'user' %}
+        {{- bos_token + '[INST] ' + content.strip() + ' [/INST]' -}}
+    {% elif message['role'] == 'assistant' %}
+        {{- ' '  + content.strip() + ' ' + eos_token -}}
+    {% endif %}
+{% endfor %}`
+		out, err := render(src, map[string]interface{}{"messages": messages, "bos_token": "<s>", "eos_token": "</s>"})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(out).To(Equal("<s>[INST] <<SYS>>\nBe brief.\n<</SYS>>\n\nHi [/INST] Hello </s><s>[INST] Bye [/INST]"))
+
+		_, err = render(src, map[string]interface{}{"messages": messages[1:2:2], "bos_token": "<s>", "eos_token": "</s>"})
+		Expect(err).ToNot(HaveOccurred())
+		_, err = render(src, map[string]interface{}{"messages": messages[2:], "bos_token": "<s>", "eos_token": "</s>"})
+		Expect(err).To(MatchError("Conversation roles must alternate user/assistant/user/assistant/..."))
+	})
+
+	It("keeps the attributes of namespaces set in loops", func() {
+		out, err := render(`{% set ns = namespace(found=false) %}{% for m in messages %}{% if m.role == 'system' %}{% set ns.found = true %}{% endif %}{% endfor %}{{ ns.found }}`,
+			map[string]interface{}{"messages": messages})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(out).To(Equal("True"))
+	})
+
+	It("applies filters and tests", func() {
+		out, err := render(`{{ messages|selectattr('role', 'equalto', 'user')|map(attribute='content')|join(', ') }}|{{ messages|length }}|{{ missing is defined }}|{{ (missing|default('x')) ~ 1 }}|{{ tools|tojson }}|{{ messages[-1].content|upper }}`,
+			map[string]interface{}{"messages": messages, "tools": []map[string]interface{}{{"name": "time", "parameters": map[string]interface{}{}}}})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(out).To(Equal(`Hi, Bye|4|False|x1|[{"name": "time", "parameters": {}}]|BYE`))
+	})
+
+	It("iterates dict items and filtered loops", func() {
+		out, err := render(`{% for k, v in d.items() %}{{ k }}={{ v }}{% if not loop.last %},{% endif %}{% endfor %};{% for n in range(5) if n is odd %}{{ n }}{% else %}none{% endfor %}`,
+			map[string]interface{}{"d": map[string]interface{}{"b": 2, "a": 1}})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(out).To(Equal("a=1,b=2;13"))
+	})
+
+	It("fails on unsupported or unclosed tags", func() {
+		_, err := Parse(`{% macro m() %}{% endmacro %}`)
+		Expect(err).To(HaveOccurred())
+		_, err = Parse(`{% if true %}`)
+		Expect(err).To(HaveOccurred())
+		_, err = Parse(`{{ 'a' `)
+		Expect(err).To(HaveOccurred())
+	})
+})
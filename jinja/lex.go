@@ -0,0 +1,231 @@
+package jinja
+
+import (
+	"fmt"
+	"strings"
+)
+
+type segmentKind int
+
+const (
+	segText segmentKind = iota
+	segOutput
+	segBlock
+	segComment
+)
+
+// segment is a piece of a template: text, or the content of a {{ }}, {% %} or {# #} tag.
+type segment struct {
+	kind segmentKind
+	text string
+	// the - and + modifiers of the tag
+	trimLeft, trimRight, keepLeft bool
+}
+
+// scan splits src into segments and applies the whitespace control of the tags, with the
+// trim_blocks and lstrip_blocks settings chat templates are written for.
+func scan(src string) ([]segment, error) {
+	var segs []segment
+	for i := 0; i < len(src); {
+		start := tagStart(src, i)
+		if start < 0 {
+			segs = append(segs, segment{kind: segText, text: src[i:]})
+			break
+		}
+		if start > i {
+			segs = append(segs, segment{kind: segText, text: src[i:start]})
+		}
+
+		var seg segment
+		var closing string
+		switch src[start+1] {
+		case '{':
+			seg.kind, closing = segOutput, "}}"
+		case '%':
+			seg.kind, closing = segBlock, "%}"
+		default:
+			seg.kind, closing = segComment, "#}"
+		}
+		j := start + 2
+		if j < len(src) && src[j] == '-' {
+			seg.trimLeft = true
+			j++
+		} else if j < len(src) && src[j] == '+' {
+			seg.keepLeft = true
+			j++
+		}
+		end := tagEnd(src, j, closing, seg.kind != segComment)
+		if end < 0 {
+			return nil, fmt.Errorf("unclosed tag at offset %d", start)
+		}
+		content := src[j:end]
+		if strings.HasSuffix(content, "-") {
+			seg.trimRight = true
+			content = content[:len(content)-1]
+		}
+		seg.text = strings.TrimSpace(content)
+		segs = append(segs, seg)
+		i = end + len(closing)
+	}
+
+	for i := range segs {
+		if segs[i].kind != segText {
+			continue
+		}
+		text := segs[i].text
+		if i > 0 {
+			prev := segs[i-1]
+			if prev.trimRight {
+				text = strings.TrimLeft(text, " \t\r\n")
+			} else if prev.kind == segBlock || prev.kind == segComment {
+				text = strings.TrimPrefix(strings.TrimPrefix(text, "\r"), "\n")
+			}
+		}
+		if i+1 < len(segs) {
+			next := segs[i+1]
+			if next.trimLeft {
+				text = strings.TrimRight(text, " \t\r\n")
+			} else if (next.kind == segBlock || next.kind == segComment) && !next.keepLeft {
+				// the indentation before a tag starting a line is stripped
+				orig := segs[i].text
+				nl := strings.LastIndexByte(orig, '\n')
+				indent := orig[nl+1:]
+				if (nl >= 0 || i == 0) && strings.Trim(indent, " \t") == "" && strings.HasSuffix(text, indent) {
+					text = text[:len(text)-len(indent)]
+				}
+			}
+		}
+		segs[i].text = text
+	}
+	return segs, nil
+}
+
+// tagStart returns the offset of the next tag of src from i, -1 when there is none.
+func tagStart(src string, i int) int {
+	for {
+		j := strings.IndexByte(src[i:], '{')
+		if j < 0 || i+j+1 >= len(src) {
+			return -1
+		}
+		switch src[i+j+1] {
+		case '{', '%', '#':
+			return i + j
+		}
+		i += j + 1
+	}
+}
+
+// tagEnd returns the offset of closing from i, skipping the string literals when quoted is set.
+func tagEnd(src string, i int, closing string, quoted bool) int {
+	for ; i+len(closing) <= len(src); i++ {
+		c := src[i]
+		if quoted && (c == '"' || c == '\'') {
+			for i++; i < len(src) && src[i] != c; i++ {
+				if src[i] == '\\' {
+					i++
+				}
+			}
+			continue
+		}
+		if strings.HasPrefix(src[i:], closing) {
+			return i
+		}
+	}
+	return -1
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokName
+	tokString
+	tokInt
+	tokFloat
+	tokOp
+)
+
+type token struct {
+	kind tokenKind
+	val  string
+}
+
+// lex splits the content of a tag into tokens.
+func lex(src string) ([]token, error) {
+	var toks []token
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case isNameStart(c):
+			j := i + 1
+			for j < len(src) && (isNameStart(src[j]) || isDigit(src[j])) {
+				j++
+			}
+			toks = append(toks, token{tokName, src[i:j]})
+			i = j
+		case isDigit(c):
+			j := i
+			for j < len(src) && isDigit(src[j]) {
+				j++
+			}
+			kind := tokInt
+			if j+1 < len(src) && src[j] == '.' && isDigit(src[j+1]) {
+				kind = tokFloat
+				for j++; j < len(src) && isDigit(src[j]); j++ {
+				}
+			}
+			toks = append(toks, token{kind, src[i:j]})
+			i = j
+		case c == '"' || c == '\'':
+			var sb strings.Builder
+			j := i + 1
+			for ; j < len(src) && src[j] != c; j++ {
+				if src[j] != '\\' || j+1 == len(src) {
+					sb.WriteByte(src[j])
+					continue
+				}
+				j++
+				switch src[j] {
+				case 'n':
+					sb.WriteByte('\n')
+				case 't':
+					sb.WriteByte('\t')
+				case 'r':
+					sb.WriteByte('\r')
+				default:
+					sb.WriteByte(src[j])
+				}
+			}
+			if j == len(src) {
+				return nil, fmt.Errorf("unterminated string")
+			}
+			toks = append(toks, token{tokString, sb.String()})
+			i = j + 1
+		default:
+			if i+1 < len(src) {
+				switch op := src[i : i+2]; op {
+				case "==", "!=", "<=", ">=", "//", "**":
+					toks = append(toks, token{tokOp, op})
+					i += 2
+					continue
+				}
+			}
+			if !strings.ContainsRune("()[]{}.,:|~+-*/%<>=", rune(c)) {
+				return nil, fmt.Errorf("unexpected character %q", c)
+			}
+			toks = append(toks, token{tokOp, string(c)})
+			i++
+		}
+	}
+	return toks, nil
+}
+
+func isNameStart(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
@@ -0,0 +1,686 @@
+package jinja
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// expr is a compiled expression.
+type expr func(s *state) (interface{}, error)
+
+// parser parses the tokens of a tag.
+type parser struct {
+	toks []token
+	pos  int
+}
+
+func newParser(src string) (*parser, error) {
+	toks, err := lex(src)
+	if err != nil {
+		return nil, err
+	}
+	return &parser{toks: toks}, nil
+}
+
+func (p *parser) peek() token {
+	if p.pos < len(p.toks) {
+		return p.toks[p.pos]
+	}
+	return token{kind: tokEOF}
+}
+
+func (p *parser) next() token {
+	t := p.peek()
+	if p.pos < len(p.toks) {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) isOp(op string) bool {
+	t := p.peek()
+	return t.kind == tokOp && t.val == op
+}
+
+func (p *parser) isName(name string) bool {
+	t := p.peek()
+	return t.kind == tokName && t.val == name
+}
+
+func (p *parser) accept(op string) bool {
+	if p.isOp(op) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) acceptName(name string) bool {
+	if p.isName(name) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(op string) error {
+	if !p.accept(op) {
+		return fmt.Errorf("expected %q, got %q", op, p.peek().val)
+	}
+	return nil
+}
+
+func (p *parser) name() (string, error) {
+	t := p.next()
+	if t.kind != tokName {
+		return "", fmt.Errorf("expected a name, got %q", t.val)
+	}
+	return t.val, nil
+}
+
+func (p *parser) end() error {
+	if t := p.peek(); t.kind != tokEOF {
+		return fmt.Errorf("unexpected %q", t.val)
+	}
+	return nil
+}
+
+// parseExpr parses an expression, including the conditional ones: a if cond else b.
+func (p *parser) parseExpr() (expr, error) {
+	value, err := p.parseOr()
+	if err != nil || !p.acceptName("if") {
+		return value, err
+	}
+	cond, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	otherwise := expr(func(*state) (interface{}, error) { return undefined{}, nil })
+	if p.acceptName("else") {
+		if otherwise, err = p.parseExpr(); err != nil {
+			return nil, err
+		}
+	}
+	return func(s *state) (interface{}, error) {
+		c, err := cond(s)
+		if err != nil {
+			return nil, err
+		}
+		if truthy(c) {
+			return value(s)
+		}
+		return otherwise(s)
+	}, nil
+}
+
+func (p *parser) parseOr() (expr, error) {
+	left, err := p.parseAnd()
+	for err == nil && p.acceptName("or") {
+		var right expr
+		if right, err = p.parseAnd(); err != nil {
+			break
+		}
+		l := left
+		left = func(s *state) (interface{}, error) {
+			v, err := l(s)
+			if err != nil || truthy(v) {
+				return v, err
+			}
+			return right(s)
+		}
+	}
+	return left, err
+}
+
+func (p *parser) parseAnd() (expr, error) {
+	left, err := p.parseNot()
+	for err == nil && p.acceptName("and") {
+		var right expr
+		if right, err = p.parseNot(); err != nil {
+			break
+		}
+		l := left
+		left = func(s *state) (interface{}, error) {
+			v, err := l(s)
+			if err != nil || !truthy(v) {
+				return v, err
+			}
+			return right(s)
+		}
+	}
+	return left, err
+}
+
+func (p *parser) parseNot() (expr, error) {
+	if !p.acceptName("not") {
+		return p.parseCompare()
+	}
+	operand, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	return func(s *state) (interface{}, error) {
+		v, err := operand(s)
+		return !truthy(v), err
+	}, nil
+}
+
+func (p *parser) parseCompare() (expr, error) {
+	left, err := p.parseMath()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		var op string
+		switch t := p.peek(); {
+		case t.kind == tokOp && (t.val == "==" || t.val == "!=" || t.val == "<" || t.val == ">" || t.val == "<=" || t.val == ">="):
+			op = t.val
+			p.pos++
+		case p.isName("in"):
+			op = "in"
+			p.pos++
+		case p.isName("not") && p.pos+1 < len(p.toks) && p.toks[p.pos+1].kind == tokName && p.toks[p.pos+1].val == "in":
+			op = "not in"
+			p.pos += 2
+		default:
+			return left, nil
+		}
+		right, err := p.parseMath()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(s *state) (interface{}, error) {
+			a, err := l(s)
+			if err != nil {
+				return nil, err
+			}
+			b, err := right(s)
+			if err != nil {
+				return nil, err
+			}
+			switch op {
+			case "==":
+				return equal(a, b), nil
+			case "!=":
+				return !equal(a, b), nil
+			case "in":
+				return contains(b, a)
+			case "not in":
+				found, err := contains(b, a)
+				return !found, err
+			}
+			c, err := compare(a, b)
+			if err != nil {
+				return nil, err
+			}
+			switch op {
+			case "<":
+				return c < 0, nil
+			case ">":
+				return c > 0, nil
+			case "<=":
+				return c <= 0, nil
+			}
+			return c >= 0, nil
+		}
+	}
+}
+
+// binary parses the left-associative operators ops, with operands parsed by operand.
+func (p *parser) binary(operand func() (expr, error), ops ...string) (expr, error) {
+	left, err := operand()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		var op string
+		for _, o := range ops {
+			if p.isOp(o) {
+				op = o
+			}
+		}
+		if op == "" {
+			return left, nil
+		}
+		p.pos++
+		right, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(s *state) (interface{}, error) {
+			a, err := l(s)
+			if err != nil {
+				return nil, err
+			}
+			b, err := right(s)
+			if err != nil {
+				return nil, err
+			}
+			if op == "~" {
+				return str(a) + str(b), nil
+			}
+			return arithmetic(op, a, b)
+		}
+	}
+}
+
+func (p *parser) parseMath() (expr, error) {
+	return p.binary(p.parseConcat, "+", "-")
+}
+
+func (p *parser) parseConcat() (expr, error) {
+	return p.binary(p.parseTerm, "~")
+}
+
+func (p *parser) parseTerm() (expr, error) {
+	return p.binary(p.parsePow, "*", "/", "//", "%")
+}
+
+func (p *parser) parsePow() (expr, error) {
+	return p.binary(p.parseUnary, "**")
+}
+
+func (p *parser) parseUnary() (expr, error) {
+	if p.accept("-") {
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return func(s *state) (interface{}, error) {
+			v, err := operand(s)
+			if err != nil {
+				return nil, err
+			}
+			return arithmetic("-", 0, v)
+		}, nil
+	}
+	p.accept("+")
+	return p.parsePostfix()
+}
+
+// parsePostfix parses a primary expression followed by attributes, subscripts, calls, filters
+// and tests.
+func (p *parser) parsePostfix() (expr, error) {
+	e, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch {
+		case p.accept("."):
+			name, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			e = attrExpr(e, name)
+		case p.accept("["):
+			if e, err = p.parseSubscript(e); err != nil {
+				return nil, err
+			}
+		case p.accept("("):
+			args, kwargs, err := p.parseArgs()
+			if err != nil {
+				return nil, err
+			}
+			e = callExpr(e, args, kwargs)
+		case p.accept("|"):
+			name, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			var args []expr
+			var kwargs map[string]expr
+			if p.accept("(") {
+				if args, kwargs, err = p.parseArgs(); err != nil {
+					return nil, err
+				}
+			}
+			e = filterExpr(e, name, args, kwargs)
+		case p.acceptName("is"):
+			negate := p.acceptName("not")
+			t := p.next()
+			if t.kind != tokName && t.kind != tokOp {
+				return nil, fmt.Errorf("expected a test, got %q", t.val)
+			}
+			var args []expr
+			if p.accept("(") {
+				if args, _, err = p.parseArgs(); err != nil {
+					return nil, err
+				}
+			} else if k := p.peek().kind; k == tokString || k == tokInt || k == tokFloat || (k == tokName && !isKeyword(p.peek().val)) {
+				arg, err := p.parsePrimary()
+				if err != nil {
+					return nil, err
+				}
+				args = []expr{arg}
+			}
+			e = testExpr(e, t.val, args, negate)
+		default:
+			return e, nil
+		}
+	}
+}
+
+func isKeyword(name string) bool {
+	switch name {
+	case "and", "or", "not", "in", "is", "if", "else":
+		return true
+	}
+	return false
+}
+
+func (p *parser) parseSubscript(e expr) (expr, error) {
+	var bounds [3]expr
+	isSlice := false
+	for i := 0; i < 3; i++ {
+		if !p.isOp(":") && !p.isOp("]") {
+			b, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			bounds[i] = b
+		}
+		if i == 2 || !p.accept(":") {
+			break
+		}
+		isSlice = true
+	}
+	if err := p.expect("]"); err != nil {
+		return nil, err
+	}
+	if !isSlice {
+		key := bounds[0]
+		if key == nil {
+			return nil, fmt.Errorf("empty subscript")
+		}
+		return func(s *state) (interface{}, error) {
+			v, err := e(s)
+			if err != nil {
+				return nil, err
+			}
+			k, err := key(s)
+			if err != nil {
+				return nil, err
+			}
+			if name, ok := k.(string); ok {
+				if _, isDict := v.(*dict); !isDict {
+					return getAttr(v, name), nil
+				}
+			}
+			return getItem(v, k), nil
+		}, nil
+	}
+	return func(s *state) (interface{}, error) {
+		v, err := e(s)
+		if err != nil {
+			return nil, err
+		}
+		var values [3]interface{}
+		for i, b := range bounds {
+			if b != nil {
+				if values[i], err = b(s); err != nil {
+					return nil, err
+				}
+			}
+		}
+		return slice(v, values)
+	}, nil
+}
+
+// parseArgs parses the arguments of a call, after the opening parenthesis.
+func (p *parser) parseArgs() ([]expr, map[string]expr, error) {
+	var args []expr
+	kwargs := map[string]expr{}
+	for !p.accept(")") {
+		if len(args)+len(kwargs) > 0 {
+			if err := p.expect(","); err != nil {
+				return nil, nil, err
+			}
+			if p.accept(")") {
+				break
+			}
+		}
+		if t := p.peek(); t.kind == tokName && p.pos+1 < len(p.toks) && p.toks[p.pos+1].kind == tokOp && p.toks[p.pos+1].val == "=" {
+			p.pos += 2
+			value, err := p.parseExpr()
+			if err != nil {
+				return nil, nil, err
+			}
+			kwargs[t.val] = value
+			continue
+		}
+		value, err := p.parseExpr()
+		if err != nil {
+			return nil, nil, err
+		}
+		args = append(args, value)
+	}
+	return args, kwargs, nil
+}
+
+func (p *parser) parsePrimary() (expr, error) {
+	t := p.next()
+	switch t.kind {
+	case tokString:
+		// adjacent strings are concatenated
+		s := t.val
+		for p.peek().kind == tokString {
+			s += p.next().val
+		}
+		return constant(s), nil
+	case tokInt:
+		n, err := strconv.Atoi(t.val)
+		if err != nil {
+			return nil, err
+		}
+		return constant(n), nil
+	case tokFloat:
+		f, err := strconv.ParseFloat(t.val, 64)
+		if err != nil {
+			return nil, err
+		}
+		return constant(f), nil
+	case tokName:
+		switch t.val {
+		case "true", "True":
+			return constant(true), nil
+		case "false", "False":
+			return constant(false), nil
+		case "none", "None":
+			return constant(nil), nil
+		}
+		name := t.val
+		return func(s *state) (interface{}, error) {
+			return s.lookup(name), nil
+		}, nil
+	case tokOp:
+		switch t.val {
+		case "(":
+			items, tuple, err := p.parseItems(")")
+			if err != nil {
+				return nil, err
+			}
+			if len(items) == 1 && !tuple {
+				return items[0], nil
+			}
+			return listExpr(items), nil
+		case "[":
+			items, _, err := p.parseItems("]")
+			if err != nil {
+				return nil, err
+			}
+			return listExpr(items), nil
+		case "{":
+			return p.parseDict()
+		}
+	}
+	if t.kind == tokEOF {
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+	return nil, fmt.Errorf("unexpected %q", t.val)
+}
+
+// parseItems parses comma separated expressions up to closing, tuple tells whether there was
+// a comma.
+func (p *parser) parseItems(closing string) ([]expr, bool, error) {
+	var items []expr
+	tuple := false
+	for !p.accept(closing) {
+		if len(items) > 0 {
+			if err := p.expect(","); err != nil {
+				return nil, false, err
+			}
+			tuple = true
+			if p.accept(closing) {
+				break
+			}
+		}
+		item, err := p.parseExpr()
+		if err != nil {
+			return nil, false, err
+		}
+		items = append(items, item)
+	}
+	return items, tuple, nil
+}
+
+func (p *parser) parseDict() (expr, error) {
+	var keys, values []expr
+	for !p.accept("}") {
+		if len(keys) > 0 {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+			if p.accept("}") {
+				break
+			}
+		}
+		key, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(":"); err != nil {
+			return nil, err
+		}
+		value, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		keys, values = append(keys, key), append(values, value)
+	}
+	return func(s *state) (interface{}, error) {
+		d := newDict()
+		for i := range keys {
+			k, err := keys[i](s)
+			if err != nil {
+				return nil, err
+			}
+			v, err := values[i](s)
+			if err != nil {
+				return nil, err
+			}
+			d.set(str(k), v)
+		}
+		return d, nil
+	}, nil
+}
+
+func constant(v interface{}) expr {
+	return func(*state) (interface{}, error) { return v, nil }
+}
+
+func listExpr(items []expr) expr {
+	return func(s *state) (interface{}, error) {
+		list := make([]interface{}, len(items))
+		for i, item := range items {
+			v, err := item(s)
+			if err != nil {
+				return nil, err
+			}
+			list[i] = v
+		}
+		return list, nil
+	}
+}
+
+func attrExpr(e expr, name string) expr {
+	return func(s *state) (interface{}, error) {
+		v, err := e(s)
+		if err != nil {
+			return nil, err
+		}
+		return getAttr(v, name), nil
+	}
+}
+
+func evalArgs(s *state, args []expr, kwargs map[string]expr) ([]interface{}, *dict, error) {
+	values := make([]interface{}, len(args))
+	for i, a := range args {
+		v, err := a(s)
+		if err != nil {
+			return nil, nil, err
+		}
+		values[i] = v
+	}
+	var kw *dict
+	if len(kwargs) > 0 {
+		kw = newDict()
+		for name, a := range kwargs {
+			v, err := a(s)
+			if err != nil {
+				return nil, nil, err
+			}
+			kw.set(name, v)
+		}
+	}
+	return values, kw, nil
+}
+
+func callExpr(e expr, args []expr, kwargs map[string]expr) expr {
+	return func(s *state) (interface{}, error) {
+		v, err := e(s)
+		if err != nil {
+			return nil, err
+		}
+		fn, ok := v.(function)
+		if !ok {
+			return nil, fmt.Errorf("%s is not callable", repr(v))
+		}
+		values, kw, err := evalArgs(s, args, kwargs)
+		if err != nil {
+			return nil, err
+		}
+		return fn(values, kw)
+	}
+}
+
+func filterExpr(e expr, name string, args []expr, kwargs map[string]expr) expr {
+	return func(s *state) (interface{}, error) {
+		v, err := e(s)
+		if err != nil {
+			return nil, err
+		}
+		values, kw, err := evalArgs(s, args, kwargs)
+		if err != nil {
+			return nil, err
+		}
+		return applyFilter(name, v, values, kw)
+	}
+}
+
+func testExpr(e expr, name string, args []expr, negate bool) expr {
+	return func(s *state) (interface{}, error) {
+		v, err := e(s)
+		if err != nil {
+			return nil, err
+		}
+		values, _, err := evalArgs(s, args, nil)
+		if err != nil {
+			return nil, err
+		}
+		ok, err := applyTest(name, v, values)
+		return ok != negate, err
+	}
+}
@@ -0,0 +1,932 @@
+package jinja
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// undefined is the value of the missing variables, attributes and items.
+type undefined struct{}
+
+// dict is a mapping keeping the order its keys were inserted in, like a Python dict.
+type dict struct {
+	keys   []string
+	values map[string]interface{}
+}
+
+func newDict() *dict {
+	return &dict{values: map[string]interface{}{}}
+}
+
+func (d *dict) get(key string) (interface{}, bool) {
+	v, ok := d.values[key]
+	return v, ok
+}
+
+func (d *dict) set(key string, value interface{}) {
+	if _, ok := d.values[key]; !ok {
+		d.keys = append(d.keys, key)
+	}
+	d.values[key] = value
+}
+
+// function is a callable value: a global function, a method or a macro.
+type function func(args []interface{}, kwargs *dict) (interface{}, error)
+
+// toValue converts a Go value to a template value: nil, bool, int, float64, string,
+// []interface{} or *dict. The keys of the maps are sorted.
+func toValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case nil, bool, int, float64, string, *dict, function, undefined:
+		return v
+	case json.RawMessage:
+		var decoded interface{}
+		if err := json.Unmarshal(v, &decoded); err != nil {
+			return string(v)
+		}
+		return toValue(decoded)
+	}
+
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return int(rv.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int(rv.Uint())
+	case reflect.Float32, reflect.Float64:
+		return rv.Float()
+	case reflect.String:
+		return rv.String()
+	case reflect.Bool:
+		return rv.Bool()
+	case reflect.Slice, reflect.Array:
+		list := make([]interface{}, rv.Len())
+		for i := range list {
+			list[i] = toValue(rv.Index(i).Interface())
+		}
+		return list
+	case reflect.Map:
+		keys := make([]string, 0, rv.Len())
+		values := map[string]reflect.Value{}
+		iter := rv.MapRange()
+		for iter.Next() {
+			k := fmt.Sprint(iter.Key().Interface())
+			keys = append(keys, k)
+			values[k] = iter.Value()
+		}
+		sort.Strings(keys)
+		d := newDict()
+		for _, k := range keys {
+			d.set(k, toValue(values[k].Interface()))
+		}
+		return d
+	case reflect.Ptr, reflect.Interface:
+		if rv.IsNil() {
+			return nil
+		}
+		return toValue(rv.Elem().Interface())
+	}
+	return fmt.Sprint(v)
+}
+
+func truthy(v interface{}) bool {
+	switch v := v.(type) {
+	case nil, undefined:
+		return false
+	case bool:
+		return v
+	case int:
+		return v != 0
+	case float64:
+		return v != 0
+	case string:
+		return v != ""
+	case []interface{}:
+		return len(v) > 0
+	case *dict:
+		return len(v.keys) > 0
+	}
+	return true
+}
+
+// str formats v the way it is output by a template.
+func str(v interface{}) string {
+	switch v := v.(type) {
+	case undefined:
+		return ""
+	case string:
+		return v
+	}
+	return repr(v)
+}
+
+// repr formats v like Python's repr.
+func repr(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "None"
+	case undefined:
+		return ""
+	case bool:
+		if v {
+			return "True"
+		}
+		return "False"
+	case int:
+		return strconv.Itoa(v)
+	case float64:
+		if v == math.Trunc(v) && math.Abs(v) < 1e16 {
+			return strconv.FormatFloat(v, 'f', 1, 64)
+		}
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case string:
+		return "'" + strings.NewReplacer(`\`, `\\`, "'", `\'`, "\n", `\n`).Replace(v) + "'"
+	case []interface{}:
+		items := make([]string, len(v))
+		for i, item := range v {
+			items[i] = repr(item)
+		}
+		return "[" + strings.Join(items, ", ") + "]"
+	case *dict:
+		items := make([]string, len(v.keys))
+		for i, k := range v.keys {
+			items[i] = repr(k) + ": " + repr(v.values[k])
+		}
+		return "{" + strings.Join(items, ", ") + "}"
+	case function:
+		return "<function>"
+	}
+	return fmt.Sprint(v)
+}
+
+func equal(a, b interface{}) bool {
+	if x, ok := toNumber(a); ok {
+		if y, ok := toNumber(b); ok {
+			return x == y
+		}
+		return false
+	}
+	switch a := a.(type) {
+	case []interface{}:
+		b, ok := b.([]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if !equal(a[i], b[i]) {
+				return false
+			}
+		}
+		return true
+	case *dict:
+		b, ok := b.(*dict)
+		if !ok || len(a.keys) != len(b.keys) {
+			return false
+		}
+		for k, v := range a.values {
+			if w, ok := b.values[k]; !ok || !equal(v, w) {
+				return false
+			}
+		}
+		return true
+	case function:
+		return false
+	}
+	return a == b
+}
+
+// toNumber returns the value of the numbers, booleans being numbers like in Python.
+func toNumber(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case int:
+		return float64(v), true
+	case float64:
+		return v, true
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+func compare(a, b interface{}) (int, error) {
+	if x, ok := toNumber(a); ok {
+		if y, ok := toNumber(b); ok {
+			switch {
+			case x < y:
+				return -1, nil
+			case x > y:
+				return 1, nil
+			}
+			return 0, nil
+		}
+	}
+	if x, ok := a.(string); ok {
+		if y, ok := b.(string); ok {
+			return strings.Compare(x, y), nil
+		}
+	}
+	return 0, fmt.Errorf("cannot compare %s and %s", repr(a), repr(b))
+}
+
+func arithmetic(op string, a, b interface{}) (interface{}, error) {
+	switch op {
+	case "+":
+		switch x := a.(type) {
+		case string:
+			if y, ok := b.(string); ok {
+				return x + y, nil
+			}
+		case []interface{}:
+			if y, ok := b.([]interface{}); ok {
+				return append(append([]interface{}(nil), x...), y...), nil
+			}
+		}
+	case "*":
+		if x, ok := a.(string); ok {
+			if n, ok := b.(int); ok && n > 0 {
+				return strings.Repeat(x, n), nil
+			}
+			return "", nil
+		}
+	}
+
+	x, okx := toNumber(a)
+	y, oky := toNumber(b)
+	if !okx || !oky {
+		return nil, fmt.Errorf("unsupported operand types for %s: %s and %s", op, repr(a), repr(b))
+	}
+	_, fa := a.(float64)
+	_, fb := b.(float64)
+	integers := !fa && !fb
+	var r float64
+	switch op {
+	case "+":
+		r = x + y
+	case "-":
+		r = x - y
+	case "*":
+		r = x * y
+	case "**":
+		r = math.Pow(x, y)
+	case "/":
+		if y == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		return x / y, nil
+	case "//", "%":
+		if y == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		r = math.Floor(x / y)
+		if op == "%" {
+			r = x - r*y
+		}
+	}
+	if integers {
+		return int(r), nil
+	}
+	return r, nil
+}
+
+func contains(container, item interface{}) (bool, error) {
+	switch c := container.(type) {
+	case string:
+		s, ok := item.(string)
+		if !ok {
+			return false, fmt.Errorf("'in <string>' requires a string, not %s", repr(item))
+		}
+		return strings.Contains(c, s), nil
+	case []interface{}:
+		for _, v := range c {
+			if equal(v, item) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case *dict:
+		s, ok := item.(string)
+		if !ok {
+			return false, nil
+		}
+		_, found := c.values[s]
+		return found, nil
+	case undefined, nil:
+		return false, nil
+	}
+	return false, fmt.Errorf("%s is not a container", repr(container))
+}
+
+// iterate returns the items a for loop goes through: the items of a list, the keys of a dict or
+// the characters of a string.
+func iterate(v interface{}) ([]interface{}, error) {
+	switch v := v.(type) {
+	case []interface{}:
+		return v, nil
+	case *dict:
+		keys := make([]interface{}, len(v.keys))
+		for i, k := range v.keys {
+			keys[i] = k
+		}
+		return keys, nil
+	case string:
+		var chars []interface{}
+		for _, r := range v {
+			chars = append(chars, string(r))
+		}
+		return chars, nil
+	case undefined, nil:
+		return nil, nil
+	}
+	return nil, fmt.Errorf("%s is not iterable", repr(v))
+}
+
+func getItem(v, key interface{}) interface{} {
+	switch v := v.(type) {
+	case *dict:
+		if k, ok := key.(string); ok {
+			if item, ok := v.values[k]; ok {
+				return item
+			}
+		}
+	case []interface{}:
+		if i, ok := key.(int); ok {
+			if i < 0 {
+				i += len(v)
+			}
+			if i >= 0 && i < len(v) {
+				return v[i]
+			}
+		}
+	case string:
+		if i, ok := key.(int); ok {
+			r := []rune(v)
+			if i < 0 {
+				i += len(r)
+			}
+			if i >= 0 && i < len(r) {
+				return string(r[i])
+			}
+		}
+	}
+	return undefined{}
+}
+
+func getAttr(v interface{}, name string) interface{} {
+	switch v := v.(type) {
+	case *dict:
+		if item, ok := v.values[name]; ok {
+			return item
+		}
+		return dictMethod(v, name)
+	case string:
+		return stringMethod(v, name)
+	}
+	return undefined{}
+}
+
+// slice implements the v[start:stop:step] subscripts, nil bounds being omitted.
+func slice(v interface{}, bounds [3]interface{}) (interface{}, error) {
+	var items []interface{}
+	s, isString := v.(string)
+	if isString {
+		for _, r := range s {
+			items = append(items, string(r))
+		}
+	} else {
+		list, ok := v.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s cannot be sliced", repr(v))
+		}
+		items = list
+	}
+
+	step := 1
+	if bounds[2] != nil {
+		n, ok := bounds[2].(int)
+		if !ok || n == 0 {
+			return nil, fmt.Errorf("invalid slice step")
+		}
+		step = n
+	}
+	n := len(items)
+	bound := func(b interface{}, def int) (int, error) {
+		if b == nil {
+			return def, nil
+		}
+		i, ok := b.(int)
+		if !ok {
+			return 0, fmt.Errorf("slice indices must be integers")
+		}
+		if i < 0 {
+			i += n
+		}
+		lo, hi := 0, n
+		if step < 0 {
+			lo, hi = -1, n-1
+		}
+		if i < lo {
+			i = lo
+		}
+		if i > hi {
+			i = hi
+		}
+		return i, nil
+	}
+	var start, stop int
+	var err error
+	if step > 0 {
+		start, err = bound(bounds[0], 0)
+		if err == nil {
+			stop, err = bound(bounds[1], n)
+		}
+	} else {
+		start, err = bound(bounds[0], n-1)
+		if err == nil {
+			stop, err = bound(bounds[1], -1)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var out []interface{}
+	for i := start; (step > 0 && i < stop) || (step < 0 && i > stop); i += step {
+		out = append(out, items[i])
+	}
+	if !isString {
+		if out == nil {
+			out = []interface{}{}
+		}
+		return out, nil
+	}
+	var sb strings.Builder
+	for _, c := range out {
+		sb.WriteString(c.(string))
+	}
+	return sb.String(), nil
+}
+
+func toJSON(v interface{}, indent string) (string, error) {
+	var buf bytes.Buffer
+	if err := writeJSON(&buf, v, indent, ""); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// writeJSON encodes v like Python's json.dumps, keeping the order of the keys of the dicts.
+func writeJSON(buf *bytes.Buffer, v interface{}, indent, prefix string) error {
+	open := func(c byte, n int) string {
+		buf.WriteByte(c)
+		if indent == "" || n == 0 {
+			return ", "
+		}
+		buf.WriteString("\n" + prefix + indent)
+		return ",\n" + prefix + indent
+	}
+	closing := func(c byte, n int) {
+		if indent != "" && n > 0 {
+			buf.WriteString("\n" + prefix)
+		}
+		buf.WriteByte(c)
+	}
+
+	switch v := v.(type) {
+	case nil, undefined:
+		buf.WriteString("null")
+	case bool:
+		buf.WriteString(strconv.FormatBool(v))
+	case int:
+		buf.WriteString(strconv.Itoa(v))
+	case float64:
+		buf.WriteString(repr(v))
+	case string:
+		enc := json.NewEncoder(buf)
+		enc.SetEscapeHTML(false)
+		if err := enc.Encode(v); err != nil {
+			return err
+		}
+		buf.Truncate(buf.Len() - 1)
+	case []interface{}:
+		sep := open('[', len(v))
+		for i, item := range v {
+			if i > 0 {
+				buf.WriteString(sep)
+			}
+			if err := writeJSON(buf, item, indent, prefix+indent); err != nil {
+				return err
+			}
+		}
+		closing(']', len(v))
+	case *dict:
+		sep := open('{', len(v.keys))
+		for i, k := range v.keys {
+			if i > 0 {
+				buf.WriteString(sep)
+			}
+			if err := writeJSON(buf, k, indent, prefix+indent); err != nil {
+				return err
+			}
+			buf.WriteString(": ")
+			if err := writeJSON(buf, v.values[k], indent, prefix+indent); err != nil {
+				return err
+			}
+		}
+		closing('}', len(v.keys))
+	default:
+		return fmt.Errorf("%s is not JSON serializable", repr(v))
+	}
+	return nil
+}
+
+// arg returns the argument at position i, or the keyword argument name, or def.
+func arg(args []interface{}, kwargs *dict, i int, name string, def interface{}) interface{} {
+	if i < len(args) {
+		return args[i]
+	}
+	if kwargs != nil {
+		if v, ok := kwargs.get(name); ok {
+			return v
+		}
+	}
+	return def
+}
+
+func stringMethod(s, name string) interface{} {
+	strip := func(trim func(string, string) string) function {
+		return func(args []interface{}, kwargs *dict) (interface{}, error) {
+			cutset, ok := arg(args, kwargs, 0, "chars", nil).(string)
+			if !ok {
+				cutset = " \t\r\n"
+			}
+			return trim(s, cutset), nil
+		}
+	}
+	affix := func(has func(string, string) bool) function {
+		return func(args []interface{}, kwargs *dict) (interface{}, error) {
+			switch a := arg(args, kwargs, 0, "prefix", nil).(type) {
+			case string:
+				return has(s, a), nil
+			case []interface{}:
+				for _, item := range a {
+					if p, ok := item.(string); ok && has(s, p) {
+						return true, nil
+					}
+				}
+				return false, nil
+			}
+			return nil, fmt.Errorf("%s expects a string", name)
+		}
+	}
+
+	switch name {
+	case "strip":
+		return strip(strings.Trim)
+	case "lstrip":
+		return strip(strings.TrimLeft)
+	case "rstrip":
+		return strip(strings.TrimRight)
+	case "startswith":
+		return affix(strings.HasPrefix)
+	case "endswith":
+		return affix(strings.HasSuffix)
+	case "upper", "lower", "title", "capitalize":
+		return function(func(args []interface{}, kwargs *dict) (interface{}, error) {
+			return applyFilter(name, s, nil, nil)
+		})
+	case "split":
+		return function(func(args []interface{}, kwargs *dict) (interface{}, error) {
+			var parts []string
+			if sep, ok := arg(args, kwargs, 0, "sep", nil).(string); ok {
+				n := -1
+				if max, ok := arg(args, kwargs, 1, "maxsplit", nil).(int); ok && max >= 0 {
+					n = max + 1
+				}
+				parts = strings.SplitN(s, sep, n)
+			} else {
+				parts = strings.Fields(s)
+			}
+			list := make([]interface{}, len(parts))
+			for i, p := range parts {
+				list[i] = p
+			}
+			return list, nil
+		})
+	case "replace":
+		return function(func(args []interface{}, kwargs *dict) (interface{}, error) {
+			return applyFilter("replace", s, args, kwargs)
+		})
+	case "join":
+		return function(func(args []interface{}, kwargs *dict) (interface{}, error) {
+			return applyFilter("join", arg(args, kwargs, 0, "iterable", nil), []interface{}{s}, nil)
+		})
+	}
+	return undefined{}
+}
+
+func dictMethod(d *dict, name string) interface{} {
+	switch name {
+	case "items":
+		return function(func(args []interface{}, kwargs *dict) (interface{}, error) {
+			return applyFilter("items", d, nil, nil)
+		})
+	case "keys":
+		return function(func(args []interface{}, kwargs *dict) (interface{}, error) {
+			return iterate(d)
+		})
+	case "values":
+		return function(func(args []interface{}, kwargs *dict) (interface{}, error) {
+			values := make([]interface{}, len(d.keys))
+			for i, k := range d.keys {
+				values[i] = d.values[k]
+			}
+			return values, nil
+		})
+	case "get":
+		return function(func(args []interface{}, kwargs *dict) (interface{}, error) {
+			if k, ok := arg(args, kwargs, 0, "key", nil).(string); ok {
+				if v, ok := d.values[k]; ok {
+					return v, nil
+				}
+			}
+			return arg(args, kwargs, 1, "default", nil), nil
+		})
+	}
+	return undefined{}
+}
+
+func applyFilter(name string, v interface{}, args []interface{}, kwargs *dict) (interface{}, error) {
+	switch name {
+	case "trim":
+		return strings.TrimSpace(str(v)), nil
+	case "upper":
+		return strings.ToUpper(str(v)), nil
+	case "lower":
+		return strings.ToLower(str(v)), nil
+	case "capitalize":
+		s := strings.ToLower(str(v))
+		if s == "" {
+			return s, nil
+		}
+		r := []rune(s)
+		return strings.ToUpper(string(r[0])) + string(r[1:]), nil
+	case "title":
+		words := strings.Fields(strings.ToLower(str(v)))
+		for i, w := range words {
+			r := []rune(w)
+			words[i] = strings.ToUpper(string(r[0])) + string(r[1:])
+		}
+		return strings.Join(words, " "), nil
+	case "string":
+		return str(v), nil
+	case "safe", "e", "escape":
+		return v, nil
+	case "length", "count":
+		switch v := v.(type) {
+		case string:
+			return len([]rune(v)), nil
+		case []interface{}:
+			return len(v), nil
+		case *dict:
+			return len(v.keys), nil
+		case undefined, nil:
+			return 0, nil
+		}
+		return nil, fmt.Errorf("%s has no length", repr(v))
+	case "first", "last":
+		items, err := iterate(v)
+		if err != nil || len(items) == 0 {
+			return undefined{}, err
+		}
+		if name == "first" {
+			return items[0], nil
+		}
+		return items[len(items)-1], nil
+	case "list":
+		items, err := iterate(v)
+		return append([]interface{}{}, items...), err
+	case "reverse":
+		if s, ok := v.(string); ok {
+			return slice(s, [3]interface{}{nil, nil, -1})
+		}
+		items, err := iterate(v)
+		if err != nil {
+			return nil, err
+		}
+		return slice(items, [3]interface{}{nil, nil, -1})
+	case "join":
+		items, err := iterate(v)
+		if err != nil {
+			return nil, err
+		}
+		sep, _ := arg(args, kwargs, 0, "d", "").(string)
+		parts := make([]string, len(items))
+		for i, item := range items {
+			if attr, ok := arg(args, kwargs, 1, "attribute", nil).(string); ok {
+				item = getAttr(item, attr)
+			}
+			parts[i] = str(item)
+		}
+		return strings.Join(parts, sep), nil
+	case "default", "d":
+		_, isUndefined := v.(undefined)
+		if isUndefined || (truthy(arg(args, kwargs, 1, "boolean", false)) && !truthy(v)) {
+			return arg(args, kwargs, 0, "default_value", ""), nil
+		}
+		return v, nil
+	case "int":
+		switch n := v.(type) {
+		case int:
+			return n, nil
+		case float64:
+			return int(n), nil
+		case bool:
+			if n {
+				return 1, nil
+			}
+			return 0, nil
+		case string:
+			if i, err := strconv.Atoi(strings.TrimSpace(n)); err == nil {
+				return i, nil
+			}
+		}
+		return arg(args, kwargs, 0, "default", 0), nil
+	case "float":
+		if n, ok := toNumber(v); ok {
+			return n, nil
+		}
+		if s, ok := v.(string); ok {
+			if f, err := strconv.ParseFloat(strings.TrimSpace(s), 64); err == nil {
+				return f, nil
+			}
+		}
+		return arg(args, kwargs, 0, "default", 0.0), nil
+	case "abs":
+		n, ok := toNumber(v)
+		if !ok {
+			return nil, fmt.Errorf("bad operand type for abs: %s", repr(v))
+		}
+		if i, ok := v.(int); ok && i < 0 {
+			return -i, nil
+		} else if ok {
+			return i, nil
+		}
+		return math.Abs(n), nil
+	case "items":
+		d, ok := v.(*dict)
+		if !ok {
+			if _, ok := v.(undefined); ok {
+				return []interface{}{}, nil
+			}
+			return nil, fmt.Errorf("%s is not a mapping", repr(v))
+		}
+		items := make([]interface{}, len(d.keys))
+		for i, k := range d.keys {
+			items[i] = []interface{}{k, d.values[k]}
+		}
+		return items, nil
+	case "replace":
+		old, _ := arg(args, kwargs, 0, "old", "").(string)
+		repl, _ := arg(args, kwargs, 1, "new", "").(string)
+		n := -1
+		if c, ok := arg(args, kwargs, 2, "count", nil).(int); ok {
+			n = c
+		}
+		return strings.Replace(str(v), old, repl, n), nil
+	case "tojson":
+		indent := ""
+		if n, ok := arg(args, kwargs, 0, "indent", nil).(int); ok {
+			indent = strings.Repeat(" ", n)
+		}
+		return toJSON(v, indent)
+	case "selectattr", "rejectattr":
+		items, err := iterate(v)
+		if err != nil {
+			return nil, err
+		}
+		attr, _ := arg(args, nil, 0, "", "").(string)
+		out := []interface{}{}
+		for _, item := range items {
+			value := getAttr(item, attr)
+			ok := truthy(value)
+			if len(args) > 1 {
+				test, _ := args[1].(string)
+				if ok, err = applyTest(test, value, args[2:]); err != nil {
+					return nil, err
+				}
+			}
+			if ok == (name == "selectattr") {
+				out = append(out, item)
+			}
+		}
+		return out, nil
+	case "map":
+		items, err := iterate(v)
+		if err != nil {
+			return nil, err
+		}
+		attr, ok := arg(nil, kwargs, 0, "attribute", nil).(string)
+		out := make([]interface{}, len(items))
+		for i, item := range items {
+			if ok {
+				out[i] = getAttr(item, attr)
+			} else if filter, isFilter := arg(args, nil, 0, "", nil).(string); isFilter {
+				if out[i], err = applyFilter(filter, item, args[1:], nil); err != nil {
+					return nil, err
+				}
+			} else {
+				out[i] = item
+			}
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("unknown filter %q", name)
+}
+
+func applyTest(name string, v interface{}, args []interface{}) (bool, error) {
+	switch name {
+	case "defined":
+		_, isUndefined := v.(undefined)
+		return !isUndefined, nil
+	case "undefined":
+		_, isUndefined := v.(undefined)
+		return isUndefined, nil
+	case "none":
+		return v == nil, nil
+	case "true":
+		return v == true, nil
+	case "false":
+		return v == false, nil
+	case "boolean":
+		_, ok := v.(bool)
+		return ok, nil
+	case "string":
+		_, ok := v.(string)
+		return ok, nil
+	case "number":
+		switch v.(type) {
+		case int, float64:
+			return true, nil
+		}
+		return false, nil
+	case "integer":
+		_, ok := v.(int)
+		return ok, nil
+	case "float":
+		_, ok := v.(float64)
+		return ok, nil
+	case "mapping":
+		_, ok := v.(*dict)
+		return ok, nil
+	case "sequence", "iterable":
+		switch v.(type) {
+		case []interface{}, string, *dict:
+			return true, nil
+		}
+		return false, nil
+	case "callable":
+		_, ok := v.(function)
+		return ok, nil
+	case "equalto", "eq", "==", "sameas":
+		if len(args) != 1 {
+			return false, fmt.Errorf("test %q expects one argument", name)
+		}
+		return equal(v, args[0]), nil
+	case "ne", "!=":
+		if len(args) != 1 {
+			return false, fmt.Errorf("test %q expects one argument", name)
+		}
+		return !equal(v, args[0]), nil
+	case "in":
+		if len(args) != 1 {
+			return false, fmt.Errorf("test %q expects one argument", name)
+		}
+		return contains(args[0], v)
+	case "odd", "even", "divisibleby":
+		n, ok := v.(int)
+		if !ok {
+			return false, nil
+		}
+		switch name {
+		case "odd":
+			return n%2 != 0, nil
+		case "even":
+			return n%2 == 0, nil
+		}
+		d, ok := arg(args, nil, 0, "", nil).(int)
+		if !ok || d == 0 {
+			return false, fmt.Errorf("divisibleby expects a non zero integer")
+		}
+		return n%d == 0, nil
+	}
+	return false, fmt.Errorf("unknown test %q", name)
+}
@@ -1,6 +1,11 @@
 package llama_test
 
 import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+
 	. "github.com/go-skynet/go-llama.cpp"
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
@@ -13,5 +18,137 @@ var _ = Describe("LLama binding", func() {
 			Expect(err).To(HaveOccurred())
 			Expect(model).To(BeNil())
 		})
+
+		It("fails to create a pool with no model", func() {
+			_, err := LoadModel("not-existing")
+			Expect(err).To(HaveOccurred())
+
+			pool, err := NewContextPool(&Model{}, 2)
+			Expect(err).To(HaveOccurred())
+			Expect(pool).To(BeNil())
+		})
+
+		It("reports the size of the weights of a model without contexts", func() {
+			path := filepath.Join(GinkgoT().TempDir(), "model.bin")
+			Expect(os.WriteFile(path, make([]byte, 1234), 0o600)).To(Succeed())
+			model, err := LoadModel(path)
+			Expect(err).ToNot(HaveOccurred())
+
+			stats, err := model.MemoryStats()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(stats).To(Equal(MemoryStats{WeightBytes: 1234}))
+		})
+
+		It("estimates the memory of a context from the header of the model", func() {
+			header := []uint32{0x67676a74, 3, 32000, 4096, 256, 32, 32, 128, 2}
+			b := make([]byte, 4*len(header))
+			for i, v := range header {
+				binary.LittleEndian.PutUint32(b[4*i:], v)
+			}
+			path := filepath.Join(GinkgoT().TempDir(), "model.bin")
+			Expect(os.WriteFile(path, b, 0o600)).To(Succeed())
+
+			stats, err := EstimateMemory(path, SetContext(2048), EnableF16Memory)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(stats.WeightBytes).To(Equal(int64(len(b))))
+			Expect(stats.StateBytes).To(Equal(int64(2*32*2048*4096*2 + 2<<20 + 4*32000)))
+			Expect(stats.ScratchBytes).To(Equal(int64(1792 << 20)))
+
+			Expect(os.WriteFile(path, []byte("nope"), 0o600)).To(Succeed())
+			_, err = EstimateMemory(path)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("Inference", func() {
+		// the tests need a model, they are skipped unless TEST_MODEL is the path of one
+		newModel := func(opts ...ModelOption) *LLama {
+			path := os.Getenv("TEST_MODEL")
+			if path == "" {
+				Skip("TEST_MODEL is not set")
+			}
+			l, err := New(path, append([]ModelOption{SetContext(128)}, opts...)...)
+			Expect(err).ToNot(HaveOccurred())
+			DeferCleanup(l.Free)
+			return l
+		}
+
+		It("fails to load a state shorter than the one of the context", func() {
+			l := newModel()
+			_, err := l.Predict("Hello", SetTokens(4))
+			Expect(err).ToNot(HaveOccurred())
+			state, err := l.SaveState()
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(l.LoadState(state[:len(state)-1])).ToNot(Succeed())
+			Expect(l.LoadState(state)).To(Succeed())
+		})
+
+		It("leaves the context unchanged when importing a truncated sequence", func() {
+			l := newModel()
+			_, err := l.Predict("Hello", SetTokens(4))
+			Expect(err).ToNot(HaveOccurred())
+			seq, err := l.ExportSequence()
+			Expect(err).ToNot(HaveOccurred())
+			usage := l.ContextUsage()
+
+			Expect(l.ImportSequence(seq[:len(seq)-1])).ToNot(Succeed())
+			Expect(l.ImportSequence(append(seq, 0))).ToNot(Succeed())
+			Expect(l.ContextUsage()).To(Equal(usage))
+		})
+
+		It("leaves the hidden special tokens out of the text", func() {
+			l := newModel()
+			bos := map[int]float32{int(l.BOS()): 100}
+			res, err := l.PredictWithResult("Hello", SetTokens(4), SetLogitBiasMap(bos))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res.CompletionTokens).To(Equal(4))
+			Expect(res.Text).To(BeEmpty())
+
+			text, err := l.Predict("Hello", SetTokens(4), SetLogitBiasMap(bos), SetSpecialTokens(true))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(text).To(Equal(strings.Repeat(l.TokenText(l.BOS()), 4)))
+		})
+
+		It("pools the embedding of the first token of the text with PoolingCLS", func() {
+			l := newModel(EnableEmbeddings)
+			hello, err := l.Embeddings("Hello world", SetEmbeddingPooling(PoolingCLS))
+			Expect(err).ToNot(HaveOccurred())
+			goodbye, err := l.Embeddings("Goodbye world", SetEmbeddingPooling(PoolingCLS))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(hello).ToNot(Equal(goodbye))
+		})
+
+		It("reports an empty context once it is reset", func() {
+			l := newModel()
+			_, err := l.Predict("Hello", SetTokens(4))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(l.ContextUsage().Tokens).ToNot(BeZero())
+
+			l.ResetContext()
+			usage := l.ContextUsage()
+			Expect(usage.Tokens).To(BeZero())
+			Expect(usage.Free).To(Equal(usage.Size))
+		})
+
+		It("ends the generation at the token set by SetEOSToken only", func() {
+			l := newModel()
+			eos := SetEOSToken(int(l.NL()))
+			res, err := l.PredictWithResult("Hello", SetTokens(4), eos, SetLogitBiasMap(map[int]float32{int(l.EOS()): 100}))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res.FinishReason).To(Equal(FinishReasonLength))
+			Expect(res.Text).To(BeEmpty())
+
+			nl := SetLogitBiasMap(map[int]float32{int(l.NL()): 100})
+			res, err = l.PredictWithResult("Hello", SetTokens(4), eos, nl)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res.FinishReason).To(Equal(FinishReasonEOS))
+			Expect(res.CompletionTokens).To(Equal(1))
+
+			res, err = l.PredictWithResult("Hello", SetTokens(4), eos, nl, IgnoreEOS, SetStopTokenIDs(int(l.BOS())))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res.FinishReason).To(Equal(FinishReasonLength))
+			Expect(res.Text).ToNot(ContainSubstring("\n"))
+		})
 	})
 })
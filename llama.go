@@ -4,38 +4,443 @@ package llama
 // #cgo LDFLAGS: -L./ -lbinding -lm -lstdc++
 // #cgo darwin LDFLAGS: -framework Accelerate
 // #cgo darwin CXXFLAGS: -std=c++11
+// #include <stdlib.h>
 // #include "binding.h"
 import "C"
 import (
+	"context"
 	"fmt"
+	"io"
+	"math"
+	"os"
 	"strings"
 	"sync"
+	"text/template"
+	"time"
 	"unsafe"
+
+	"github.com/go-skynet/go-llama.cpp/grammar"
+	"github.com/go-skynet/go-llama.cpp/jinja"
 )
 
 type LLama struct {
-	state       unsafe.Pointer
-	embeddings  bool
-	contextSize int
+	state        unsafe.Pointer
+	embeddings   bool
+	contextSize  int
+	systemPrompt bool
+	pooling      Pooling
+
+	// the name of the chat template, see FormatChat
+	chatTemplate string
+	// the template set with SetPromptTemplate, nil to use chatTemplate
+	promptTemplate *template.Template
+	// the template set with SetJinjaTemplate, nil to use chatTemplate
+	jinjaTemplate *jinja.Template
+	// the metrics set with SetMetrics, nil when not collected
+	metrics *Metrics
+	// the tracer set with SetTracer, nil when not traced
+	tracer Tracer
+
+	// the model the context was created from by NewContext, nil when created by New
+	model *Model
+	// the model and the options the context was created with, see Clone
+	modelPath string
+	modelOpts []ModelOption
+
+	// the context evaluating the negative prompts, loaded by the first prediction using
+	// classifier-free guidance, see SetNegativePrompt
+	guidance unsafe.Pointer
+
+	// the special tokens looked up in the vocabulary, see EOT and PAD
+	lookupOnce sync.Once
+	eot, pad   int32
 }
 
 func New(model string, opts ...ModelOption) (*LLama, error) {
 	mo := NewModelOptions(opts...)
+	var promptTemplate *template.Template
+	if mo.PromptTemplate != "" {
+		var err error
+		if promptTemplate, err = parsePromptTemplate(mo.PromptTemplate); err != nil {
+			return nil, err
+		}
+	}
+	var jinjaTemplate *jinja.Template
+	if mo.JinjaTemplate != "" {
+		var err error
+		if jinjaTemplate, err = jinja.Parse(mo.JinjaTemplate); err != nil {
+			return nil, fmt.Errorf("invalid jinja template: %w", err)
+		}
+	}
+
 	modelPath := C.CString(model)
+	defer C.free(unsafe.Pointer(modelPath))
 	result := C.load_model(modelPath, C.int(mo.ContextSize), C.int(mo.Parts), C.int(mo.Seed), C.bool(mo.F16Memory), C.bool(mo.MLock), C.bool(mo.Embeddings))
 	if result == nil {
 		return nil, fmt.Errorf("failed loading model")
 	}
 
-	ll := &LLama{state: result, contextSize: mo.ContextSize, embeddings: mo.Embeddings}
+	ll := &LLama{state: result, contextSize: mo.ContextSize, embeddings: mo.Embeddings, pooling: mo.Pooling,
+		chatTemplate: mo.ChatTemplate, promptTemplate: promptTemplate,
+		jinjaTemplate: jinjaTemplate, metrics: mo.Metrics, tracer: mo.Tracer, modelPath: model, modelOpts: append([]ModelOption(nil), opts...)}
+	if ll.metrics != nil {
+		ll.metrics.addContext(ll)
+	}
 
 	return ll, nil
 }
 
 func (l *LLama) Free() {
+	if l.metrics != nil {
+		l.metrics.removeContext(l)
+	}
+	if l.model != nil {
+		l.model.removeContext(l)
+	}
+	if l.guidance != nil {
+		C.llama_free_model(l.guidance)
+		l.guidance = nil
+	}
 	C.llama_free_model(l.state)
 }
 
+// guidanceContext returns the context evaluating the negative prompts, loading it the first time.
+func (l *LLama) guidanceContext() (unsafe.Pointer, error) {
+	if l.guidance != nil {
+		return l.guidance, nil
+	}
+	mo := NewModelOptions(l.modelOpts...)
+	modelPath := C.CString(l.modelPath)
+	defer C.free(unsafe.Pointer(modelPath))
+	l.guidance = C.load_model(modelPath, C.int(mo.ContextSize), C.int(mo.Parts), C.int(mo.Seed), C.bool(mo.F16Memory), C.bool(mo.MLock), false)
+	if l.guidance == nil {
+		return nil, fmt.Errorf("failed loading the guidance context")
+	}
+	return l.guidance, nil
+}
+
+// SetSystemPrompt evaluates text once and keeps it at the start of the context. It is prepended
+// to the prompts of the following predictions without being evaluated again, and NKeep is raised
+// to its length so context shifts never discard it. The system prompt may use up to half of the
+// context. An empty text removes it.
+func (l *LLama) SetSystemPrompt(text string, opts ...PredictOption) error {
+	po := NewPredictOptions(opts...)
+	params := allocateParams(text, po, nil)
+	defer C.llama_free_params(params)
+
+	ret := C.llama_set_system_prompt(params, l.state)
+	l.systemPrompt = false
+	if ret == 2 {
+		return fmt.Errorf("system prompt is too long")
+	}
+	if ret != 0 {
+		return fmt.Errorf("system prompt evaluation failed")
+	}
+	l.systemPrompt = text != ""
+	return nil
+}
+
+// Tokenize returns the tokens of text, starting with the beginning of stream token when addBOS is
+// set. Predict adds a space in front of its prompt, like the original tokenizer of LLaMA, the
+// tokens of a prompt are those of Tokenize(" "+text, true).
+func (l *LLama) Tokenize(text string, addBOS bool) ([]int32, error) {
+	return l.TokenizeSpecial(text, addBOS, false)
+}
+
+// TokenizeSpecial tokenizes text like Tokenize. With parseSpecial the texts of the special tokens
+// of the vocabulary, like <|im_start|>, are replaced with the tokens instead of being tokenized
+// as text, as chat templates expect.
+func (l *LLama) TokenizeSpecial(text string, addBOS, parseSpecial bool) ([]int32, error) {
+	// there are at most as many tokens as bytes, plus the beginning of stream
+	tokens := make([]int32, len(text)+1)
+	var textPtr *C.char
+	if len(text) > 0 {
+		b := []byte(text)
+		textPtr = (*C.char)(unsafe.Pointer(&b[0]))
+	}
+	n := C.llama_tokenize_string(l.state, textPtr, C.int(len(text)), C.bool(addBOS), C.bool(parseSpecial), (*C.int)(unsafe.Pointer(&tokens[0])), C.int(len(tokens)))
+	if n < 0 {
+		return nil, fmt.Errorf("failed tokenizing text")
+	}
+	return tokens[:int(n)], nil
+}
+
+// BOS returns the beginning of stream token of the model.
+func (l *LLama) BOS() int32 {
+	return int32(C.llama_special_token(l.state, C.SPECIAL_TOKEN_BOS))
+}
+
+// EOS returns the end of stream token of the model.
+func (l *LLama) EOS() int32 {
+	return int32(C.llama_special_token(l.state, C.SPECIAL_TOKEN_EOS))
+}
+
+// EOT returns the end of turn token of chat models, or -1 when the model has none. It is looked
+// up in the vocabulary by the names the model families use, like <|im_end|> or <|eot_id|>.
+func (l *LLama) EOT() int32 {
+	l.lookupSpecialTokens()
+	return l.eot
+}
+
+// NL returns the newline token of the model.
+func (l *LLama) NL() int32 {
+	return int32(C.llama_special_token(l.state, C.SPECIAL_TOKEN_NL))
+}
+
+// PAD returns the padding token of the model, or -1 when the model has none. It is looked up in
+// the vocabulary like EOT.
+func (l *LLama) PAD() int32 {
+	l.lookupSpecialTokens()
+	return l.pad
+}
+
+// lookupSpecialTokens looks the special tokens up once, it goes through the whole vocabulary.
+func (l *LLama) lookupSpecialTokens() {
+	l.lookupOnce.Do(func() {
+		l.eot = int32(C.llama_special_token(l.state, C.SPECIAL_TOKEN_EOT))
+		l.pad = int32(C.llama_special_token(l.state, C.SPECIAL_TOKEN_PAD))
+	})
+}
+
+// VocabSize returns the number of tokens in the vocabulary of the model, their ids go from 0 to
+// VocabSize()-1.
+func (l *LLama) VocabSize() int {
+	return int(C.llama_vocab_size(l.state))
+}
+
+// TokenText returns the text of token i in the vocabulary, e.g. to compute the logit biases or
+// the banned tokens of a whole vocabulary:
+//
+//	bias := map[int]float32{}
+//	for i := 0; i < l.VocabSize(); i++ {
+//		if strings.ContainsAny(l.TokenText(int32(i)), "0123456789") {
+//			bias[i] = -100
+//		}
+//	}
+//	l.Predict(prompt, llama.SetLogitBiasMap(bias))
+//
+// It is the same as TokenToPiece.
+func (l *LLama) TokenText(i int32) string {
+	return l.TokenToPiece(i)
+}
+
+// TokenToPiece returns the text of a token, it is empty for the tokens which are not in the
+// vocabulary. The text of a token may be part of a character, see Detokenize.
+func (l *LLama) TokenToPiece(id int32) string {
+	piece := C.llama_token_piece(l.state, C.int(id))
+	if piece == nil {
+		return ""
+	}
+	return C.GoString(piece)
+}
+
+// PieceToTokens returns the tokens of s without the beginning of stream token, usually a single
+// one when s is the text of a token.
+func (l *LLama) PieceToTokens(s string) []int32 {
+	tokens, _ := l.Tokenize(s, false)
+	return tokens
+}
+
+// IsEOG reports whether the token ends the generation: the end of stream token, or the end of
+// turn token of chat models, see EOT.
+func (l *LLama) IsEOG(id int32) bool {
+	return id == l.EOS() || (id >= 0 && id == l.EOT())
+}
+
+// IsControl reports whether the token is a control token, which has no text of its own like the
+// beginning and end of stream tokens.
+func (l *LLama) IsControl(id int32) bool {
+	if id == l.BOS() || l.IsEOG(id) {
+		return true
+	}
+	return id >= 0 && int(id) < l.VocabSize() && l.TokenToPiece(id) == ""
+}
+
+// IsByte reports whether the token is a raw byte which is not a character on its own, the part of
+// a multi-byte character. Its text must be joined with the next tokens before being shown.
+func (l *LLama) IsByte(id int32) bool {
+	piece := l.TokenToPiece(id)
+	if len(piece) == 1 {
+		return piece[0] >= 0x80
+	}
+	// the vocabularies of some models keep the byte tokens as <0xNN>
+	return len(piece) == 6 && strings.HasPrefix(piece, "<0x") && strings.HasSuffix(piece, ">")
+}
+
+// TokenCount returns the number of tokens of text, like len(Tokenize(text, false)) without
+// building the tokens.
+func (l *LLama) TokenCount(text string) int {
+	if len(text) == 0 {
+		return 0
+	}
+	b := []byte(text)
+	return int(C.llama_token_count(l.state, (*C.char)(unsafe.Pointer(&b[0])), C.int(len(b))))
+}
+
+// Detokenize returns the text of tokens, the inverse of Tokenize. The bytes of the tokens are
+// joined before being converted, so characters split over several tokens are whole in the text.
+func (l *LLama) Detokenize(tokens []int32) (string, error) {
+	if len(tokens) == 0 {
+		return "", nil
+	}
+
+	text := make([]byte, 8*len(tokens))
+	for {
+		n := C.llama_detokenize(l.state, (*C.int)(unsafe.Pointer(&tokens[0])), C.int(len(tokens)), (*C.char)(unsafe.Pointer(&text[0])), C.int(len(text)))
+		if n < 0 {
+			return "", fmt.Errorf("invalid token")
+		}
+		if int(n) <= len(text) {
+			return string(text[:int(n)]), nil
+		}
+		text = make([]byte, int(n))
+	}
+}
+
+// Clone creates a new context of the model holding the same tokens, system prompt and random
+// number generator state, so a conversation can branch without evaluating its history again.
+// The clone loads the weights from the model file again, like the contexts of a Model, and only
+// shares them with l through the page cache when they are memory mapped. It must be released
+// with Free.
+func (l *LLama) Clone() (*LLama, error) {
+	c, err := New(l.modelPath, l.modelOpts...)
+	if err != nil {
+		return nil, err
+	}
+	if C.llama_clone_context(l.state, c.state) != 0 {
+		c.Free()
+		return nil, fmt.Errorf("failed cloning context")
+	}
+	c.systemPrompt = l.systemPrompt
+	if l.model != nil {
+		l.model.addContext(c)
+	}
+	return c, nil
+}
+
+// ResetContext starts a fresh conversation without reloading the model: the tokens held by the
+// context and the system prompt are discarded, ContextUsage then reports an empty context. Of
+// the sampler state only the random number generator outlives a prediction, it is seeded again;
+// the repetition penalties, the mirostat state and the grammar start over with each prediction.
+func (l *LLama) ResetContext() {
+	C.llama_reset_context(l.state)
+	l.systemPrompt = false
+}
+
+// ContextUsage describes how much of the context of a model is used. The context holds a single
+// sequence, the one of the last prediction.
+type ContextUsage struct {
+	// Size is the number of tokens the context can hold.
+	Size int
+	// Tokens is the number of tokens in the KV cache, 0 once the context forgot them, e.g. with
+	// ResetContext.
+	Tokens int
+	// Free is the number of tokens which can be added before the context is shifted.
+	Free int
+	// Reusable is the number of tokens at the start of the context the next prediction does not
+	// evaluate again if its prompt starts with them.
+	Reusable int
+	// SystemPrompt is the number of tokens of the system prompt, see SetSystemPrompt.
+	SystemPrompt int
+}
+
+// ContextUsage returns how much of the context is used, e.g. to decide when to drop a
+// conversation.
+func (l *LLama) ContextUsage() ContextUsage {
+	var usage C.context_usage
+	C.llama_context_usage(l.state, &usage)
+	return ContextUsage{
+		Size:         int(usage.n_ctx),
+		Tokens:       int(usage.n_kv_tokens),
+		Free:         int(usage.n_ctx - usage.n_kv_tokens),
+		Reusable:     int(usage.n_reusable),
+		SystemPrompt: int(usage.n_system),
+	}
+}
+
+// SaveState returns a snapshot of the context: the KV cache, the random number generator and the
+// logits. It can be restored with LoadState, also by another process loading the same model with
+// the same context size.
+func (l *LLama) SaveState() ([]byte, error) {
+	size := C.llama_state_size(l.state)
+	if size == 0 {
+		return nil, fmt.Errorf("the context has no state")
+	}
+	state := make([]byte, int(size))
+	n := C.llama_save_state(l.state, (*C.uint8_t)(unsafe.Pointer(&state[0])))
+	return state[:int(n)], nil
+}
+
+// MemoryStats returns the memory used by the model and the context. The weights are only shared
+// with the other contexts of a Model when they are memory mapped, see Model. The scratch buffers
+// are only known for the sizes of the original LLaMA models, they are reported as 0 for the
+// others.
+func (l *LLama) MemoryStats() (MemoryStats, error) {
+	st, err := os.Stat(l.modelPath)
+	if err != nil {
+		return MemoryStats{}, err
+	}
+	stats := l.contextMemory()
+	stats.WeightBytes = st.Size()
+	return stats, nil
+}
+
+// contextMemory returns the memory allocated for the context.
+func (l *LLama) contextMemory() MemoryStats {
+	stats := MemoryStats{
+		Contexts:     1,
+		StateBytes:   int64(C.llama_state_size(l.state)),
+		ScratchBytes: scratchBytes(l.EmbeddingSize()),
+	}
+	// the guidance context is counted with the context using it
+	if l.guidance != nil {
+		stats.Contexts++
+		stats.StateBytes += int64(C.llama_state_size(l.guidance))
+		stats.ScratchBytes += scratchBytes(l.EmbeddingSize())
+	}
+	return stats
+}
+
+// ExportSequence returns the conversation held by the context: its tokens, its system prompt and
+// the state of the context. The context holds a single sequence, the one of its last prediction.
+// Once imported with ImportSequence, by another context of the same model with the same size or
+// by another process, the conversation continues without being evaluated again.
+func (l *LLama) ExportSequence() ([]byte, error) {
+	size := C.llama_sequence_size(l.state)
+	seq := make([]byte, int(size))
+	n := C.llama_save_sequence(l.state, (*C.uint8_t)(unsafe.Pointer(&seq[0])))
+	return seq[:int(n)], nil
+}
+
+// ImportSequence replaces the conversation held by the context with one returned by
+// ExportSequence. The context is left unchanged when seq is truncated or was exported by a
+// context of another size.
+func (l *LLama) ImportSequence(seq []byte) error {
+	if len(seq) == 0 {
+		return fmt.Errorf("empty sequence")
+	}
+	var hasSystem C.bool
+	ret := C.llama_load_sequence(l.state, (*C.uint8_t)(unsafe.Pointer(&seq[0])), C.size_t(len(seq)), &hasSystem)
+	if ret != 0 {
+		return fmt.Errorf("failed importing sequence")
+	}
+	l.systemPrompt = bool(hasSystem)
+	return nil
+}
+
+// LoadState restores a snapshot of the context taken by SaveState. It fails when the snapshot
+// does not have the size of the state of the context, taken with another context size.
+func (l *LLama) LoadState(state []byte) error {
+	if len(state) == 0 {
+		return fmt.Errorf("empty state")
+	}
+	ret := C.llama_load_state(l.state, (*C.uint8_t)(unsafe.Pointer(&state[0])), C.size_t(len(state)))
+	if ret != 0 {
+		return fmt.Errorf("failed loading state")
+	}
+	return nil
+}
+
 // Token Embeddings
 func (l *LLama) TokenEmbeddings(tokens []int, opts ...PredictOption) ([]float32, error) {
 	if !l.embeddings {
@@ -43,36 +448,28 @@ func (l *LLama) TokenEmbeddings(tokens []int, opts ...PredictOption) ([]float32,
 	}
 
 	po := NewPredictOptions(opts...)
-
-	outSize := po.Tokens
-	if po.Tokens == 0 {
-		outSize = 9999999
-	}
-
-	floats := make([]float32, outSize)
+	floats := make([]float32, l.EmbeddingSize())
 
 	myArray := (*C.int)(C.malloc(C.size_t(len(tokens)) * C.sizeof_int))
+	defer C.free(unsafe.Pointer(myArray))
 
 	// Copy the values from the Go slice to the C array
 	for i, v := range tokens {
 		(*[1<<31 - 1]int32)(unsafe.Pointer(myArray))[i] = int32(v)
 	}
 
-	params := C.llama_allocate_params(C.CString(""), C.int(po.Seed), C.int(po.Threads), C.int(po.Tokens), C.int(po.TopK),
-		C.float(po.TopP), C.float(po.Temperature), C.float(po.Penalty), C.int(po.Repeat),
-		C.bool(po.IgnoreEOS), C.bool(po.F16KV),
-		C.int(po.Batch), C.int(po.NKeep), nil, C.int(0),
-		C.float(po.TailFreeSamplingZ), C.float(po.TypicalP), C.float(po.FrequencyPenalty), C.float(po.PresencePenalty),
-		C.int(po.Mirostat), C.float(po.MirostatETA), C.float(po.MirostatTAU), C.bool(po.PenalizeNL), C.CString(po.LogitBias),
-	)
-	ret := C.get_token_embeddings(params, l.state, myArray, C.int(len(tokens)), (*C.float)(&floats[0]))
-	if ret != 0 {
-		return floats, fmt.Errorf("embedding inference failed")
+	params := allocateParams("", po, nil)
+	defer C.llama_free_params(params)
+	ret := C.get_token_embeddings(params, l.state, myArray, C.int(len(tokens)), (*C.float)(&floats[0]), C.int(l.embeddingPooling(po)))
+	if err := embeddingsErr(ret); err != nil {
+		return floats, err
 	}
-	return floats, nil
+	return postprocessEmbedding(floats, po)
 }
 
-// Embeddings
+// Embeddings evaluates text and returns its embedding, EmbeddingSize floats combining the
+// embeddings of its tokens as set with SetPooling or SetEmbeddingPooling. The model must be
+// loaded with EnableEmbeddings.
 func (l *LLama) Embeddings(text string, opts ...PredictOption) ([]float32, error) {
 	if !l.embeddings {
 		return []float32{}, fmt.Errorf("model loaded without embeddings")
@@ -80,86 +477,827 @@ func (l *LLama) Embeddings(text string, opts ...PredictOption) ([]float32, error
 
 	po := NewPredictOptions(opts...)
 
-	input := C.CString(text)
-	if po.Tokens == 0 {
-		po.Tokens = 99999999
+	floats := make([]float32, l.EmbeddingSize())
+	params := allocateParams(text, po, nil)
+	defer C.llama_free_params(params)
+
+	ret := C.get_embeddings(params, l.state, (*C.float)(&floats[0]), C.int(l.embeddingPooling(po)))
+	if err := embeddingsErr(ret); err != nil {
+		return floats, err
 	}
-	floats := make([]float32, po.Tokens)
-	reverseCount := len(po.StopPrompts)
-	reversePrompt := make([]*C.char, reverseCount)
-	var pass **C.char
-	for i, s := range po.StopPrompts {
-		cs := C.CString(s)
-		reversePrompt[i] = cs
-		pass = &reversePrompt[0]
+	return postprocessEmbedding(floats, po)
+}
+
+// EmbedBatch returns the embeddings of texts like Embeddings. The texts are embedded in a single
+// call sharing the parameters, which saves the overhead of calling Embeddings for each of them.
+// They are evaluated one after the other.
+func (l *LLama) EmbedBatch(texts []string, opts ...PredictOption) ([][]float32, error) {
+	if !l.embeddings {
+		return nil, fmt.Errorf("model loaded without embeddings")
+	}
+	if len(texts) == 0 {
+		return nil, nil
 	}
 
-	params := C.llama_allocate_params(input, C.int(po.Seed), C.int(po.Threads), C.int(po.Tokens), C.int(po.TopK),
-		C.float(po.TopP), C.float(po.Temperature), C.float(po.Penalty), C.int(po.Repeat),
-		C.bool(po.IgnoreEOS), C.bool(po.F16KV),
-		C.int(po.Batch), C.int(po.NKeep), pass, C.int(reverseCount),
-		C.float(po.TailFreeSamplingZ), C.float(po.TypicalP), C.float(po.FrequencyPenalty), C.float(po.PresencePenalty),
-		C.int(po.Mirostat), C.float(po.MirostatETA), C.float(po.MirostatTAU), C.bool(po.PenalizeNL), C.CString(po.LogitBias),
-	)
+	po := NewPredictOptions(opts...)
+	size := l.EmbeddingSize()
+	floats := make([]float32, len(texts)*size)
 
-	ret := C.get_embeddings(params, l.state, (*C.float)(&floats[0]))
-	if ret != 0 {
-		return floats, fmt.Errorf("embedding inference failed")
+	inputs := make([]*C.char, len(texts))
+	for i, t := range texts {
+		inputs[i] = C.CString(t)
 	}
+	defer func() {
+		for _, cs := range inputs {
+			C.free(unsafe.Pointer(cs))
+		}
+	}()
+
+	params := allocateParams("", po, nil)
+	defer C.llama_free_params(params)
+
+	var failed C.int
+	ret := C.get_embeddings_batch(params, l.state, &inputs[0], C.int(len(texts)), (*C.float)(&floats[0]), C.int(l.embeddingPooling(po)), &failed)
+	if err := embeddingsErr(ret); err != nil {
+		return nil, fmt.Errorf("embedding text %d: %w", int(failed), err)
+	}
+
+	embeddings := make([][]float32, len(texts))
+	for i := range embeddings {
+		v, err := postprocessEmbedding(floats[i*size:(i+1)*size:(i+1)*size], po)
+		if err != nil {
+			return nil, err
+		}
+		embeddings[i] = v
+	}
+	return embeddings, nil
+}
+
+// EmbeddingsEnabled tells whether the model was loaded with EnableEmbeddings, which Embeddings
+// requires.
+func (l *LLama) EmbeddingsEnabled() bool {
+	return l.embeddings
+}
+
+// embeddingPooling returns the pooling of the embeddings computed with po.
+func (l *LLama) embeddingPooling(po PredictOptions) Pooling {
+	if po.pooling != nil {
+		return *po.pooling
+	}
+	return l.pooling
+}
+
+// EmbedTokens evaluates text and returns the embedding of each of its tokens instead of pooling
+// them, e.g. for late interaction retrieval or a custom pooling. The options of the embeddings
+// apply to each vector. The model must be loaded with EnableEmbeddings.
+func (l *LLama) EmbedTokens(text string, opts ...PredictOption) ([][]float32, error) {
+	if !l.embeddings {
+		return nil, fmt.Errorf("model loaded without embeddings")
+	}
+
+	po := NewPredictOptions(opts...)
+	params := allocateParams(text, po, nil)
+	defer C.llama_free_params(params)
+
+	// the first call only counts the tokens
+	var n C.int
+	ret := C.get_embeddings_per_token(params, l.state, nil, 0, &n)
+	if ret == 4 {
+		size := l.EmbeddingSize()
+		floats := make([]float32, int(n)*size)
+		ret = C.get_embeddings_per_token(params, l.state, (*C.float)(&floats[0]), n, &n)
+		if ret == 0 {
+			embeddings := make([][]float32, int(n))
+			for i := range embeddings {
+				v, err := postprocessEmbedding(floats[i*size:(i+1)*size:(i+1)*size], po)
+				if err != nil {
+					return nil, err
+				}
+				embeddings[i] = v
+			}
+			return embeddings, nil
+		}
+	}
+	if ret == 0 {
+		// the text has no token, not even the beginning of stream one
+		return [][]float32{}, nil
+	}
+	return nil, embeddingsErr(ret)
+}
 
-	return floats, nil
+// EmbeddingSize returns the number of dimensions of the embeddings of the model.
+func (l *LLama) EmbeddingSize() int {
+	return int(C.llama_embedding_size(l.state))
 }
 
+func embeddingsErr(ret C.int) error {
+	switch ret {
+	case 0:
+		return nil
+	case 2:
+		return fmt.Errorf("the text does not fit in the context")
+	}
+	return fmt.Errorf("embedding inference failed")
+}
+
+// Predict generates the continuation of text. The context keeps the tokens of the previous
+// prediction, only the part of the prompt which differs from them is evaluated, so chats sending
+// the same history again only pay for the new messages.
 func (l *LLama) Predict(text string, opts ...PredictOption) (string, error) {
+	res, err := l.PredictWithResult(text, opts...)
+	if err != nil {
+		return "", err
+	}
+	return res.Text, nil
+}
+
+// PredictWithResult runs a prediction like Predict and also returns the sampled tokens, why the
+// prediction stopped and how long it took.
+func (l *LLama) PredictWithResult(text string, opts ...PredictOption) (*PredictResult, error) {
+	return l.predict(context.Background(), text, opts...)
+}
+
+// PredictTokens runs a prediction like PredictWithResult from a prompt which is already
+// tokenized. The tokens are used as they are, including the beginning of stream token if the
+// model expects one.
+func (l *LLama) PredictTokens(tokens []int32, opts ...PredictOption) (*PredictResult, error) {
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("no prompt tokens given")
+	}
+	opts = append(opts, func(p *PredictOptions) {
+		p.promptTokens = tokens
+	})
+	return l.predict(context.Background(), "", opts...)
+}
+
+// Infill generates the text between prefix and suffix with the fill-in-the-middle tokens of the
+// model, like the ones of Code Llama. They are looked up in the vocabulary of the model unless
+// set with SetInfillTokens.
+func (l *LLama) Infill(prefix, suffix string, opts ...PredictOption) (*PredictResult, error) {
+	opts = append(opts, func(p *PredictOptions) {
+		p.infill = &infillPrompt{Prefix: prefix, Suffix: suffix}
+	})
+	return l.predict(context.Background(), "", opts...)
+}
+
+// PredictChoice constrains the generation to exactly one of the choices, picked greedily, and
+// returns its index along with the sum of the log probabilities of its tokens.
+func (l *LLama) PredictChoice(text string, choices []string, opts ...PredictOption) (int, float32, error) {
+	if len(choices) == 0 {
+		return 0, 0, fmt.Errorf("no choices given")
+	}
+
+	opts = append(opts, Greedy, SetGrammar(grammar.ChoiceGrammar(choices...)))
+	res, err := l.PredictWithResult(text, opts...)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var generated strings.Builder
+	var score float32
+	for _, t := range res.Tokens {
+		generated.WriteString(t.Text)
+		score += t.Logprob
+	}
+	for i, c := range choices {
+		if c == generated.String() {
+			return i, score, nil
+		}
+	}
+	return 0, 0, fmt.Errorf("prediction stopped before completing a choice: %s", res.FinishReason)
+}
+
+// Perplexity returns the perplexity of the model on text, the exponential of the mean negative
+// log likelihood of its tokens, to compare models, quantizations or prompts. Texts longer than
+// the context are scored with a sliding window moved by stride tokens, the tokens of a window
+// already scored by the previous one are only its context. A smaller stride gives each token a
+// longer context but takes more evaluations, a stride of the context size scores disjoint
+// windows like llama.cpp's perplexity tool.
+//
+// The options set the threads and the batch size. The context only returns the logits of the
+// last token evaluated, the scored tokens are evaluated one by one. The tokens the context held
+// are forgotten.
+func (l *LLama) Perplexity(text string, stride int, opts ...PredictOption) (float64, error) {
+	if stride <= 0 || stride > l.contextSize {
+		return 0, fmt.Errorf("the stride must be between 1 and the context size %d", l.contextSize)
+	}
+	tokens, err := l.Tokenize(text, true)
+	if err != nil {
+		return 0, err
+	}
+	if len(tokens) < 2 {
+		return 0, fmt.Errorf("the text has no token to score")
+	}
+
 	po := NewPredictOptions(opts...)
+	var nll C.double
+	var scored C.int
+	if C.llama_perplexity(l.state, (*C.int)(unsafe.Pointer(&tokens[0])), C.int(len(tokens)), C.int(stride), C.int(po.Threads), C.int(po.Batch), &nll, &scored) != 0 {
+		return 0, fmt.Errorf("failed evaluating the text")
+	}
+	return math.Exp(float64(nll) / float64(scored)), nil
+}
+
+// Benchmark measures the speed of prompt processing and of text generation with each
+// combination of the batch sizes and thread counts of opts, like llama-bench, to tune the
+// options of a deployment. The prompt and the generated tokens must fit in the context. The
+// tokens the context held are forgotten.
+func (l *LLama) Benchmark(opts BenchmarkOptions) ([]BenchmarkResult, error) {
+	if opts.PromptTokens == 0 {
+		opts.PromptTokens = 512
+	}
+	if opts.GenTokens == 0 {
+		opts.GenTokens = 128
+	}
+	if len(opts.Batches) == 0 {
+		opts.Batches = []int{512}
+	}
+	if len(opts.Threads) == 0 {
+		opts.Threads = []int{4}
+	}
+	if opts.Repetitions == 0 {
+		opts.Repetitions = 5
+	}
+	if opts.PromptTokens < 0 || opts.GenTokens < 0 || opts.Repetitions < 0 {
+		return nil, fmt.Errorf("the numbers of tokens and repetitions must not be negative")
+	}
+	if opts.PromptTokens+opts.GenTokens > l.contextSize {
+		return nil, fmt.Errorf("%d tokens do not fit in the context of %d tokens", opts.PromptTokens+opts.GenTokens, l.contextSize)
+	}
+
+	var results []BenchmarkResult
+	for _, batch := range opts.Batches {
+		for _, threads := range opts.Threads {
+			if batch <= 0 || batch > 512 || threads <= 0 {
+				return nil, fmt.Errorf("the batch sizes must be between 1 and 512 and the thread counts positive")
+			}
+			var prompt, gen time.Duration
+			for i := 0; i < opts.Repetitions; i++ {
+				var promptUs, genUs C.int64_t
+				if C.llama_bench(l.state, C.int(opts.PromptTokens), C.int(opts.GenTokens), C.int(batch), C.int(threads), &promptUs, &genUs) != 0 {
+					return nil, fmt.Errorf("failed evaluating the tokens")
+				}
+				prompt += time.Duration(promptUs) * time.Microsecond
+				gen += time.Duration(genUs) * time.Microsecond
+			}
+			results = append(results, BenchmarkResult{
+				Batch:                 batch,
+				Threads:               threads,
+				PromptTokensPerSecond: perSecond(opts.PromptTokens*opts.Repetitions, prompt),
+				GenTokensPerSecond:    perSecond(opts.GenTokens*opts.Repetitions, gen),
+			})
+		}
+	}
+	return results, nil
+}
+
+// PredictContext runs a prediction like Predict which is stopped as soon as ctx is done. The text
+// generated so far is returned along with the error of the context.
+func (l *LLama) PredictContext(ctx context.Context, text string, opts ...PredictOption) (string, error) {
+	res, err := l.predict(ctx, text, opts...)
+	if res == nil {
+		return "", err
+	}
+	return res.Text, err
+}
+
+func (l *LLama) predict(ctx context.Context, text string, opts ...PredictOption) (*PredictResult, error) {
+	var span Span
+	if l.tracer != nil {
+		ctx, span = l.tracer.Start(ctx, "llama.predict")
+	}
+	res, err := l.predictChoices(ctx, text, opts...)
+	if l.metrics != nil {
+		l.metrics.observe(res, err)
+	}
+	if span != nil {
+		endPredictSpan(span, res, err)
+	}
+	return res, err
+}
 
-	if po.TokenCallback != nil {
-		setCallback(l.state, po.TokenCallback)
+// predictChoices runs the predictions of the choices requested by opts.
+func (l *LLama) predictChoices(ctx context.Context, text string, opts ...PredictOption) (*PredictResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	po := NewPredictOptions(opts...)
+	if po.Beams > 0 && po.Grammar != "" {
+		return nil, fmt.Errorf("grammars are not supported with beam search")
+	}
+	if po.Beams > 0 && po.NegativePrompt != "" {
+		return nil, fmt.Errorf("negative prompts are not supported with beam search")
+	}
+	numChoices := po.NumChoices
+	if po.BestOf > numChoices {
+		numChoices = po.BestOf
+	}
+	if po.Beams > 0 && numChoices > 1 {
+		return nil, fmt.Errorf("multiple choices are not supported with beam search")
+	}
+
+	if numChoices <= 1 {
+		return l.predictOnce(ctx, text, po, nil, 0)
+	}
+
+	// the choices share the evaluation of the prompt
+	cache := C.llama_new_prompt_cache()
+	defer C.llama_free_prompt_cache(cache)
+
+	var first *PredictResult
+	for i := 0; i < numChoices; i++ {
+		choiceOptions := po
+		if first != nil {
+			choiceOptions.Seed = first.Seed + i
+		}
+		res, err := l.predictOnce(ctx, text, choiceOptions, cache, i)
+		if res != nil {
+			if first == nil {
+				first = res
+			} else {
+				first.Timings = first.Timings.add(res.Timings)
+				first.CompletionTokens += res.CompletionTokens
+			}
+			first.Choices = append(first.Choices, Choice{
+				Text:         res.Text,
+				Reasoning:    res.Reasoning,
+				Tokens:       res.Tokens,
+				FinishReason: res.FinishReason,
+				Seed:         res.Seed,
+			})
+		}
+		if err != nil {
+			return first, err
+		}
+	}
+
+	if po.BestOf > 1 {
+		selectBestChoice(first, po.ChoiceScorer)
+	}
+	return first, nil
+}
+
+// selectBestChoice scores the choices of res and makes the best one the result.
+func selectBestChoice(res *PredictResult, scorer func(Choice) float64) {
+	if scorer == nil {
+		scorer = func(c Choice) float64 { return float64(c.Logprob()) }
+	}
+
+	best := 0
+	for i := range res.Choices {
+		res.Choices[i].Score = scorer(res.Choices[i])
+		if res.Choices[i].Score > res.Choices[best].Score {
+			best = i
+		}
+	}
+
+	c := res.Choices[best]
+	res.Text = c.Text
+	res.Reasoning = c.Reasoning
+	res.Tokens = c.Tokens
+	res.FinishReason = c.FinishReason
+	res.Seed = c.Seed
+}
+
+// predictOnce runs a single prediction, the choice is reported in the token events.
+func (l *LLama) predictOnce(ctx context.Context, text string, po PredictOptions, cache unsafe.Pointer, choice int) (*PredictResult, error) {
+	eventCallback := chainCallbacks(po.TokenCallback, po.TokenLogprobCallback, po.TokenCallbackEx)
+	if eventCallback != nil && choice > 0 {
+		callback := eventCallback
+		eventCallback = func(event TokenEvent) bool {
+			event.Choice = choice
+			return callback(event)
+		}
+	}
+
+	if eventCallback != nil && po.ReasoningStart != "" {
+		split := newReasoningSplitter(po.ReasoningStart, po.ReasoningEnd, text)
+		callback := eventCallback
+		eventCallback = func(event TokenEvent) bool {
+			inside := split.inside
+			reasoning, _ := split.add(event.Text)
+			event.Reasoning = inside || split.inside || reasoning != ""
+			return callback(event)
+		}
+	}
+
+	// the stop words are also checked on the Go side to hold them back from the callbacks
+	var stop *stopMatcher
+	if len(po.StopPrompts) > 0 || len(po.StopRegex) > 0 {
+		var err error
+		stop, err = newStopMatcher(po.StopPrompts, po.StopRegex, eventCallback)
+		if err != nil {
+			return nil, err
+		}
+		eventCallback = stop.tokenCallback
+	}
+
+	// the callbacks are removed however the prediction ends, so the next one on the state does
+	// not call them
+	if eventCallback != nil {
+		setEventCallback(l.state, eventCallback)
+		defer setEventCallback(l.state, nil)
+	}
+	if po.LogitsProcessor != nil {
+		setLogitsProcessor(l.state, po.LogitsProcessor)
+		defer setLogitsProcessor(l.state, nil)
+	}
+	if po.PromptProgress != nil {
+		setPromptProgressCallback(l.state, po.PromptProgress)
+		defer setPromptProgressCallback(l.state, nil)
+	}
+	if l.tracer != nil {
+		t := &predictTrace{tracer: l.tracer, ctx: ctx}
+		setTraceCallback(l.state, t.phase)
+		defer func() {
+			setTraceCallback(l.state, nil)
+			t.end()
+		}()
+		po.trace = true
+	}
+	var rs *randSource
+	if po.RandSource != nil {
+		rs = &randSource{r: po.RandSource}
+		po.Seed = rs.seed()
+		setRandCallback(l.state, rs.float64)
+		defer setRandCallback(l.state, nil)
 	}
 
-	input := C.CString(text)
 	if po.Tokens == 0 {
-		po.Tokens = 99999999
+		po.Tokens = -1
+	}
+	if po.NegativePrompt != "" && po.GuidanceScale != 1 {
+		var err error
+		if po.guidance, err = l.guidanceContext(); err != nil {
+			return nil, err
+		}
 	}
-	out := make([]byte, po.Tokens)
+
+	params := allocateParams(text, po, cache)
+	defer C.llama_free_params(params)
+	stopCancel := cancelOnDone(ctx, params)
+	var result C.llama_predict_result
+	ret := C.llama_predict(params, l.state, nil, C.bool(po.DebugMode), &result)
+	stopCancel()
+	defer C.llama_free_result(&result)
+	if stop != nil {
+		stop.flush()
+	}
+	if ret == 2 {
+		return nil, fmt.Errorf("invalid grammar")
+	}
+	if ret == 3 {
+		return nil, fmt.Errorf("the model has no fill-in-the-middle tokens")
+	}
+	if ret != 0 {
+		return nil, fmt.Errorf("inference failed")
+	}
+	res := C.GoStringN(result.text, result.text_len)
+
+	if po.promptTokens != nil || po.infill != nil || l.systemPrompt {
+		res = res[int(result.prompt_text_len):]
+	} else {
+		res = strings.TrimPrefix(res, " ")
+		res = strings.TrimPrefix(res, text)
+		res = strings.TrimPrefix(res, "\n")
+	}
+
+	for _, s := range po.StopPrompts {
+		res = strings.TrimRight(res, s)
+	}
+
+	finishReason := FinishReason(result.finish_reason)
+	if stop != nil && stop.matched != nil {
+		res = strings.TrimPrefix(*stop.matched, "\n")
+		finishReason = FinishReasonStopWord
+	}
+
+	var reasoning string
+	if po.ReasoningStart != "" {
+		reasoning, res = splitReasoning(res, po.ReasoningStart, po.ReasoningEnd, text)
+	}
+
+	return &PredictResult{
+		Text:             res,
+		Reasoning:        reasoning,
+		Tokens:           resultTokens(&result),
+		PromptTokens:     int(result.n_prompt_tokens),
+		CompletionTokens: int(result.n_predicted),
+		FinishReason:     finishReason,
+		Timings: Timings{
+			PromptEval:       time.Duration(result.t_prompt_us) * time.Microsecond,
+			Predict:          time.Duration(result.t_predict_us) * time.Microsecond,
+			Sample:           time.Duration(result.t_sample_us) * time.Microsecond,
+			PromptEvalTokens: int(result.n_prompt_eval),
+			PredictTokens:    int(result.n_predicted),
+		},
+		Seed:  int(result.seed),
+		Beams: resultBeams(&result),
+	}, predictErr(ctx, rs)
+}
+
+// predictErr returns the error of a completed prediction.
+func predictErr(ctx context.Context, rs *randSource) error {
+	if rs != nil && rs.err != nil {
+		return fmt.Errorf("reading random source: %w", rs.err)
+	}
+	return ctx.Err()
+}
+
+// cancelOnDone cancels the prediction using params when ctx is done. The returned function must
+// be called once the prediction returned, before params are released.
+func cancelOnDone(ctx context.Context, params unsafe.Pointer) func() {
+	if ctx.Done() == nil {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			C.llama_cancel_predict(params)
+		case <-done:
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// PredictStream runs a prediction in the background and sends the sampled tokens over the
+// returned channel. The channel is closed when the prediction completes or fails, a failure is
+// reported by a last token holding the error in Err. Use PredictWithResult to know why a
+// prediction which completed stopped.
+//
+// The channel must be drained, the prediction is blocked until each token is received.
+func (l *LLama) PredictStream(text string, opts ...PredictOption) (<-chan Token, error) {
+	po := NewPredictOptions(opts...)
+	userCallback := po.TokenCallbackEx
+
+	tokens := make(chan Token)
+	opts = append(opts, SetTokenCallbackEx(func(event TokenEvent) bool {
+		tokens <- Token{ID: event.ID, Text: event.Text, Logprob: event.Logprob}
+		if userCallback != nil {
+			return userCallback(event)
+		}
+		return true
+	}))
+
+	go func() {
+		defer close(tokens)
+		if _, err := l.PredictWithResult(text, opts...); err != nil {
+			tokens <- Token{Err: err}
+		}
+	}()
+
+	return tokens, nil
+}
+
+// PredictReader runs a prediction in the background and returns the generated text as a stream.
+// Reading fails with the error of the prediction, if any. Closing the reader stops the
+// prediction.
+func (l *LLama) PredictReader(text string, opts ...PredictOption) (io.ReadCloser, error) {
+	po := NewPredictOptions(opts...)
+	userCallback := po.TokenCallbackEx
+
+	pr, pw := io.Pipe()
+	opts = append(opts, SetTokenCallbackEx(func(event TokenEvent) bool {
+		if _, err := io.WriteString(pw, event.Text); err != nil {
+			return false
+		}
+		if userCallback != nil {
+			return userCallback(event)
+		}
+		return true
+	}))
+
+	go func() {
+		_, err := l.PredictWithResult(text, opts...)
+		pw.CloseWithError(err)
+	}()
+
+	return pr, nil
+}
+
+// resultTokens copies the sampled tokens out of the C++ result.
+func resultTokens(result *C.llama_predict_result) []Token {
+	n := int(result.n_tokens)
+	if n == 0 {
+		return nil
+	}
+
+	ids := unsafe.Slice(result.ids, n)
+	texts := splitPieces(result.pieces, result.piece_lens, n)
+	logprobs := unsafe.Slice(result.logprobs, n)
+
+	nProbs := int(result.n_probs)
+	var topIDs []C.int
+	var topTexts []string
+	var topLogprobs []C.float
+	if nProbs > 0 {
+		topIDs = unsafe.Slice(result.top_ids, n*nProbs)
+		topTexts = splitPieces(result.top_pieces, result.top_piece_lens, n*nProbs)
+		topLogprobs = unsafe.Slice(result.top_logprobs, n*nProbs)
+	}
+
+	tokens := make([]Token, n)
+	for i := range tokens {
+		tokens[i] = Token{ID: int32(ids[i]), Text: texts[i], Logprob: float32(logprobs[i])}
+		for j := i * nProbs; j < (i+1)*nProbs; j++ {
+			// tokens excluded by the grammar or the logit biases are not alternatives
+			if math.IsInf(float64(topLogprobs[j]), -1) {
+				continue
+			}
+			tokens[i].TopLogprobs = append(tokens[i].TopLogprobs, Token{
+				ID:      int32(topIDs[j]),
+				Text:    topTexts[j],
+				Logprob: float32(topLogprobs[j]),
+			})
+		}
+	}
+	return tokens
+}
+
+// resultBeams copies the hypotheses of a beam search out of the C++ result.
+func resultBeams(result *C.llama_predict_result) []Beam {
+	n := int(result.n_beams)
+	if n == 0 {
+		return nil
+	}
+
+	texts := splitPieces(result.beam_texts, result.beam_text_lens, n)
+	counts := unsafe.Slice(result.beam_n_tokens, n)
+	scores := unsafe.Slice(result.beam_scores, n)
+	total := 0
+	for _, c := range counts {
+		total += int(c)
+	}
+	var ids []C.int
+	if total > 0 {
+		ids = unsafe.Slice(result.beam_ids, total)
+	}
+
+	beams := make([]Beam, n)
+	offset := 0
+	for i := range beams {
+		beams[i] = Beam{Text: texts[i], Score: float32(scores[i]), TokenIDs: make([]int32, counts[i])}
+		for j := range beams[i].TokenIDs {
+			beams[i].TokenIDs[j] = int32(ids[offset+j])
+		}
+		offset += int(counts[i])
+	}
+	return beams
+}
+
+// splitPieces splits the concatenated token texts of a result.
+func splitPieces(pieces *C.char, lens *C.int, n int) []string {
+	texts := make([]string, n)
+	offset := 0
+	for i, l := range unsafe.Slice(lens, n) {
+		texts[i] = C.GoStringN((*C.char)(unsafe.Add(unsafe.Pointer(pieces), offset)), l)
+		offset += int(l)
+	}
+	return texts
+}
+
+// allocateParams converts the predict options into the C++ parameters struct, cache may be nil.
+// The caller is responsible for releasing it with llama_free_params.
+func allocateParams(text string, po PredictOptions, cache unsafe.Pointer) unsafe.Pointer {
+	// the C++ parameters copy the strings, they are released once allocated
+	var cstrings []*C.char
+	cstring := func(s string) *C.char {
+		cs := C.CString(s)
+		cstrings = append(cstrings, cs)
+		return cs
+	}
+	defer func() {
+		for _, cs := range cstrings {
+			C.free(unsafe.Pointer(cs))
+		}
+	}()
 
 	reverseCount := len(po.StopPrompts)
 	reversePrompt := make([]*C.char, reverseCount)
 	var pass **C.char
 	for i, s := range po.StopPrompts {
-		cs := C.CString(s)
-		reversePrompt[i] = cs
+		reversePrompt[i] = cstring(s)
 		pass = &reversePrompt[0]
 	}
 
-	params := C.llama_allocate_params(input, C.int(po.Seed), C.int(po.Threads), C.int(po.Tokens), C.int(po.TopK),
-		C.float(po.TopP), C.float(po.Temperature), C.float(po.Penalty), C.int(po.Repeat),
-		C.bool(po.IgnoreEOS), C.bool(po.F16KV),
-		C.int(po.Batch), C.int(po.NKeep), pass, C.int(reverseCount),
-		C.float(po.TailFreeSamplingZ), C.float(po.TypicalP), C.float(po.FrequencyPenalty), C.float(po.PresencePenalty),
-		C.int(po.Mirostat), C.float(po.MirostatETA), C.float(po.MirostatTAU), C.bool(po.PenalizeNL), C.CString(po.LogitBias),
-	)
-	ret := C.llama_predict(params, l.state, (*C.char)(unsafe.Pointer(&out[0])), C.bool(po.DebugMode))
-	if ret != 0 {
-		return "", fmt.Errorf("inference failed")
+	samplerCount := len(po.SamplerOrder)
+	samplers := make([]C.int, samplerCount)
+	var samplerPass *C.int
+	for i, s := range po.SamplerOrder {
+		samplers[i] = C.int(s)
+		samplerPass = &samplers[0]
 	}
-	res := C.GoString((*C.char)(unsafe.Pointer(&out[0])))
 
-	res = strings.TrimPrefix(res, " ")
-	res = strings.TrimPrefix(res, text)
-	res = strings.TrimPrefix(res, "\n")
+	biasCount := len(po.LogitBiasMap)
+	biasTokens := make([]C.int, 0, biasCount)
+	biasValues := make([]C.float, 0, biasCount)
+	var biasTokensPass *C.int
+	var biasValuesPass *C.float
+	for token, bias := range po.LogitBiasMap {
+		biasTokens = append(biasTokens, C.int(token))
+		biasValues = append(biasValues, C.float(bias))
+		biasTokensPass = &biasTokens[0]
+		biasValuesPass = &biasValues[0]
+	}
 
-	for _, s := range po.StopPrompts {
-		res = strings.TrimRight(res, s)
+	textBiasCount := len(po.TokenBias)
+	textBiasKeys := make([]*C.char, 0, textBiasCount)
+	textBiasValues := make([]C.float, 0, textBiasCount)
+	var textBiasKeysPass **C.char
+	var textBiasValuesPass *C.float
+	for text, bias := range po.TokenBias {
+		textBiasKeys = append(textBiasKeys, cstring(text))
+		textBiasValues = append(textBiasValues, C.float(bias))
+		textBiasKeysPass = &textBiasKeys[0]
+		textBiasValuesPass = &textBiasValues[0]
 	}
 
-	C.llama_free_params(params)
+	stopTokenCount := len(po.StopTokenIDs)
+	stopTokens := make([]C.int, stopTokenCount)
+	var stopTokensPass *C.int
+	for i, id := range po.StopTokenIDs {
+		stopTokens[i] = C.int(id)
+		stopTokensPass = &stopTokens[0]
+	}
 
-	if po.TokenCallback != nil {
-		setCallback(l.state, nil)
+	cpuCount := len(po.CPUMask)
+	cpus := make([]C.int, cpuCount)
+	var cpusPass *C.int
+	for i, cpu := range po.CPUMask {
+		cpus[i] = C.int(cpu)
+		cpusPass = &cpus[0]
 	}
 
-	return res, nil
+	bannedCount := len(po.BannedStrings)
+	banned := make([]*C.char, bannedCount)
+	var bannedPass **C.char
+	for i, s := range po.BannedStrings {
+		banned[i] = cstring(s)
+		bannedPass = &banned[0]
+	}
+
+	triggerCount := len(po.GrammarTriggers)
+	triggers := make([]*C.char, triggerCount)
+	var triggersPass **C.char
+	for i, s := range po.GrammarTriggers {
+		triggers[i] = cstring(s)
+		triggersPass = &triggers[0]
+	}
+
+	triggerTokenCount := len(po.GrammarTriggerTokens)
+	triggerTokens := make([]C.int, triggerTokenCount)
+	var triggerTokensPass *C.int
+	for i, id := range po.GrammarTriggerTokens {
+		triggerTokens[i] = C.int(id)
+		triggerTokensPass = &triggerTokens[0]
+	}
+
+	promptTokenCount := len(po.promptTokens)
+	promptTokens := make([]C.int, promptTokenCount)
+	var promptTokensPass *C.int
+	for i, id := range po.promptTokens {
+		promptTokens[i] = C.int(id)
+		promptTokensPass = &promptTokens[0]
+	}
+
+	var infill infillPrompt
+	if po.infill != nil {
+		infill = *po.infill
+	}
+	fimTokens := []C.int{C.int(po.InfillTokens.Prefix), C.int(po.InfillTokens.Suffix), C.int(po.InfillTokens.Middle), C.int(po.InfillTokens.EndOfText)}
+
+	return C.llama_allocate_params(cstring(text), C.int(po.Seed), C.int(po.Threads), C.int(po.Tokens), C.int(po.TopK),
+		C.float(po.TopP), C.float(po.Temperature), C.float(po.Penalty), C.int(po.Repeat),
+		C.bool(po.IgnoreEOS), C.bool(po.F16KV),
+		C.int(po.Batch), C.int(po.NKeep), pass, C.int(reverseCount),
+		C.float(po.TailFreeSamplingZ), C.float(po.TypicalP), C.float(po.FrequencyPenalty), C.float(po.PresencePenalty),
+		C.int(po.Mirostat), C.float(po.MirostatETA), C.float(po.MirostatTAU), C.bool(po.PenalizeNL), cstring(po.LogitBias),
+		C.float(po.MinP), samplerPass, C.int(samplerCount), cstring(po.Grammar),
+		biasTokensPass, biasValuesPass, C.int(biasCount),
+		textBiasKeysPass, textBiasValuesPass, C.int(textBiasCount),
+		C.int(po.Logprobs), C.int64_t(po.MaxDuration.Microseconds()),
+		C.int(po.EOSToken), stopTokensPass, C.int(stopTokenCount),
+		C.int(po.Beams), C.float(po.LengthPenalty), C.bool(po.BeamEarlyStopping),
+		cstring(po.NegativePrompt), C.float(po.GuidanceScale), po.guidance, C.bool(po.Greedy),
+		cache, bannedPass, C.int(bannedCount), C.bool(po.LogitsProcessor != nil), C.bool(po.RandSource != nil),
+		promptTokensPass, C.int(promptTokenCount),
+		C.bool(po.infill != nil), cstring(infill.Prefix), cstring(infill.Suffix), &fimTokens[0],
+		C.bool(po.SpecialTokens), C.float(po.MaxEntropy), C.float(po.MinLogprob),
+		triggersPass, C.int(triggerCount), triggerTokensPass, C.int(triggerTokenCount),
+		cstring(po.PromptCachePath), C.bool(po.PromptCacheRO), C.int(po.AttentionSinks),
+		C.bool(po.AddBOS), C.bool(po.ParseSpecial), C.bool(po.trace), C.int(po.ThreadsBatch),
+		cpusPass, C.int(cpuCount), C.int(po.ThreadPriority), C.int(po.TokenBatch),
+		C.bool(po.PromptProgress != nil), C.float(po.MaxTokensPerSecond),
+	)
 }
 
 // CGo only allows us to use static calls from C to Go, we can't just dynamically pass in func's.
@@ -180,20 +1318,155 @@ func (l *LLama) SetTokenCallback(callback func(token string) bool) {
 }
 
 var (
-	m         sync.Mutex
-	callbacks = map[uintptr]func(string) bool{}
+	m                 sync.Mutex
+	callbacks         = map[uintptr]func(string) bool{}
+	eventCallbacks    = map[uintptr]func(TokenEvent) bool{}
+	logitsCallbacks   = map[uintptr]func(int, []float32){}
+	randCallbacks     = map[uintptr]func() float64{}
+	traceCallbacks    = map[uintptr]func(phase, tokens int, end bool){}
+	progressCallbacks = map[uintptr]func(done, total int){}
 )
 
-//export tokenCallback
-func tokenCallback(statePtr unsafe.Pointer, token *C.char) bool {
+// redirectStderr points the standard error of the process to fd and returns a descriptor of the
+// previous one.
+func redirectStderr(fd uintptr) (int, error) {
+	saved := C.llama_redirect_stderr(C.int(fd))
+	if saved < 0 {
+		return 0, fmt.Errorf("cannot redirect the standard error")
+	}
+	return int(saved), nil
+}
+
+func restoreStderr(saved int) {
+	C.llama_restore_stderr(C.int(saved))
+}
+
+//export logCallback
+func logCallback(level C.int, msg *C.char) {
+	logMessage(LogLevel(level), strings.TrimRight(C.GoString(msg), "\n"))
+}
+
+//export traceCallback
+func traceCallback(statePtr unsafe.Pointer, phase C.int, tokens C.int, end C.bool) {
+	m.Lock()
+	callback, ok := traceCallbacks[uintptr(statePtr)]
+	m.Unlock()
+
+	if ok {
+		callback(int(phase), int(tokens), bool(end))
+	}
+}
+
+// setTraceCallback registers the tracer of a prediction. Pass in a nil callback to remove it.
+func setTraceCallback(statePtr unsafe.Pointer, callback func(phase, tokens int, end bool)) {
 	m.Lock()
 	defer m.Unlock()
 
-	if callback, ok := callbacks[uintptr(statePtr)]; ok {
-		return callback(C.GoString(token))
+	if callback == nil {
+		delete(traceCallbacks, uintptr(statePtr))
+	} else {
+		traceCallbacks[uintptr(statePtr)] = callback
 	}
+}
 
-	return true
+//export promptProgressCallback
+func promptProgressCallback(statePtr unsafe.Pointer, done, total C.int) {
+	m.Lock()
+	callback, ok := progressCallbacks[uintptr(statePtr)]
+	m.Unlock()
+
+	if ok {
+		callback(int(done), int(total))
+	}
+}
+
+// setPromptProgressCallback registers the progress callback of a prediction. Pass in a nil
+// callback to remove it.
+func setPromptProgressCallback(statePtr unsafe.Pointer, callback func(done, total int)) {
+	m.Lock()
+	defer m.Unlock()
+
+	if callback == nil {
+		delete(progressCallbacks, uintptr(statePtr))
+	} else {
+		progressCallbacks[uintptr(statePtr)] = callback
+	}
+}
+
+//export randCallback
+func randCallback(statePtr unsafe.Pointer) C.double {
+	m.Lock()
+	callback, ok := randCallbacks[uintptr(statePtr)]
+	m.Unlock()
+
+	if !ok {
+		return 0
+	}
+	return C.double(callback())
+}
+
+//export logitsCallback
+func logitsCallback(statePtr unsafe.Pointer, step C.int, logits *C.float, n C.int) {
+	m.Lock()
+	callback, ok := logitsCallbacks[uintptr(statePtr)]
+	m.Unlock()
+
+	if ok {
+		callback(int(step), unsafe.Slice((*float32)(unsafe.Pointer(logits)), int(n)))
+	}
+}
+
+//export tokenCallback
+func tokenCallback(statePtr unsafe.Pointer, token *C.char, id C.int, logprob C.float, position C.int, special C.bool) bool {
+	// the callbacks are called without holding the lock, they may block for a while
+	m.Lock()
+	callback := callbacks[uintptr(statePtr)]
+	eventCallback := eventCallbacks[uintptr(statePtr)]
+	m.Unlock()
+
+	return dispatchToken(callback, eventCallback, C.GoString(token), id, logprob, position, special)
+}
+
+//export tokenBatchCallback
+func tokenBatchCallback(statePtr unsafe.Pointer, n C.int, ids *C.int, pieces *C.char, lens *C.int, logprobs *C.float, positions *C.int, specials *C.uchar) C.int {
+	m.Lock()
+	callback := callbacks[uintptr(statePtr)]
+	eventCallback := eventCallbacks[uintptr(statePtr)]
+	m.Unlock()
+
+	count := int(n)
+	texts := splitPieces(pieces, lens, count)
+	idSlice := unsafe.Slice(ids, count)
+	logprobSlice := unsafe.Slice(logprobs, count)
+	positionSlice := unsafe.Slice(positions, count)
+	specialSlice := unsafe.Slice(specials, count)
+	// the tokens following the one a callback stopped at are not passed on, like those the
+	// prediction would not have generated
+	for i := 0; i < count; i++ {
+		if !dispatchToken(callback, eventCallback, texts[i], idSlice[i], logprobSlice[i], positionSlice[i], C.bool(specialSlice[i] != 0)) {
+			return C.int(i)
+		}
+	}
+	return n
+}
+
+// dispatchToken passes a token to the callbacks of a prediction, which may be nil.
+func dispatchToken(callback func(string) bool, eventCallback func(TokenEvent) bool, text string, id C.int, logprob C.float, position C.int, special C.bool) bool {
+	cont := true
+	if callback != nil {
+		cont = callback(text)
+	}
+	if eventCallback != nil {
+		cont = eventCallback(TokenEvent{
+			ID:       int32(id),
+			Text:     text,
+			Logprob:  float32(logprob),
+			Position: int(position),
+			Special:  bool(special),
+		}) && cont
+	}
+
+	return cont
 }
 
 // setCallback can be used to register a token callback for LLama. Pass in a nil callback to
@@ -208,3 +1481,42 @@ func setCallback(statePtr unsafe.Pointer, callback func(string) bool) {
 		callbacks[uintptr(statePtr)] = callback
 	}
 }
+
+// setRandCallback registers the random source of a prediction. Pass in a nil callback to remove
+// the callback.
+func setRandCallback(statePtr unsafe.Pointer, callback func() float64) {
+	m.Lock()
+	defer m.Unlock()
+
+	if callback == nil {
+		delete(randCallbacks, uintptr(statePtr))
+	} else {
+		randCallbacks[uintptr(statePtr)] = callback
+	}
+}
+
+// setLogitsProcessor registers the logits processor of a prediction. Pass in a nil callback to
+// remove the callback.
+func setLogitsProcessor(statePtr unsafe.Pointer, callback func(int, []float32)) {
+	m.Lock()
+	defer m.Unlock()
+
+	if callback == nil {
+		delete(logitsCallbacks, uintptr(statePtr))
+	} else {
+		logitsCallbacks[uintptr(statePtr)] = callback
+	}
+}
+
+// setEventCallback registers the token callback of a prediction. Pass in a nil callback to
+// remove the callback.
+func setEventCallback(statePtr unsafe.Pointer, callback func(TokenEvent) bool) {
+	m.Lock()
+	defer m.Unlock()
+
+	if callback == nil {
+		delete(eventCallbacks, uintptr(statePtr))
+	} else {
+		eventCallbacks[uintptr(statePtr)] = callback
+	}
+}
@@ -0,0 +1,187 @@
+package llama
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// LogLevel is the severity of a message of the bindings. The values must be kept in sync with
+// binding.h.
+type LogLevel int
+
+const (
+	LogLevelDebug LogLevel = iota
+	LogLevelInfo
+	LogLevelWarn
+	LogLevelError
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LogLevelDebug:
+		return "debug"
+	case LogLevelInfo:
+		return "info"
+	case LogLevelWarn:
+		return "warn"
+	case LogLevelError:
+		return "error"
+	default:
+		return "unknown"
+	}
+}
+
+var (
+	logMu    sync.RWMutex
+	logFunc  func(level LogLevel, msg string)
+	logLevel LogLevel
+	// logOut is where the messages are written when there is no logFunc, nil for the standard
+	// error
+	logOut io.Writer
+	// capture reads the standard error while it is captured
+	capture *stderrCapture
+)
+
+// SetLogFunc routes the messages of the bindings, like the failures of the evaluations, to f
+// instead of the standard error. A nil f restores the standard error. With Go 1.21 SetLogger
+// routes them to a *slog.Logger. The messages printed by llama.cpp itself are only routed once
+// captured with SetLogWriter or SetLogLevel.
+func SetLogFunc(f func(level LogLevel, msg string)) {
+	logMu.Lock()
+	defer logMu.Unlock()
+	logFunc = f
+}
+
+// SetLogWriter captures the standard error, where llama.cpp and ggml print their messages, like
+// the information about the model when it is loaded. Its lines are written to w, or passed to
+// the function set with SetLogFunc, as well as the messages of the bindings. A nil w stops the
+// capture and restores the standard error.
+//
+// The standard error is that of the process: the writes of the Go code to os.Stderr are captured
+// too, but not the crash reports of the runtime once the process exits. Capturing is not
+// supported on Windows.
+func SetLogWriter(w io.Writer) error {
+	logMu.Lock()
+	defer logMu.Unlock()
+	if w == nil {
+		stopCapture()
+		logOut = nil
+		return nil
+	}
+	if err := startCapture(); err != nil {
+		return err
+	}
+	logOut = w
+	return nil
+}
+
+// SetLogLevel drops the messages below level, those of the bindings and the lines of the standard
+// error, which it captures like SetLogWriter. The lines of llama.cpp have no level, they are
+// errors when they mention one or a failure, warnings when they mention one and information
+// otherwise. SetLogLevel(LogLevelError) keeps llama.cpp quiet but for its errors.
+func SetLogLevel(level LogLevel) error {
+	logMu.Lock()
+	defer logMu.Unlock()
+	if level > LogLevelDebug {
+		if err := startCapture(); err != nil {
+			return err
+		}
+	}
+	logLevel = level
+	return nil
+}
+
+func logMessage(level LogLevel, msg string) {
+	logMu.RLock()
+	f, minLevel, out := logFunc, logLevel, logOut
+	if out == nil && capture != nil {
+		out = capture.stderr
+	}
+	logMu.RUnlock()
+
+	if level < minLevel {
+		return
+	}
+	if f != nil {
+		f(level, msg)
+		return
+	}
+	if out == nil {
+		out = os.Stderr
+	}
+	fmt.Fprintln(out, msg)
+}
+
+// stderrCapture reads the lines written to the standard error through a pipe.
+type stderrCapture struct {
+	saved int
+	// stderr is the standard error which was captured, it owns saved
+	stderr *os.File
+	w      *os.File
+	done   chan struct{}
+}
+
+// startCapture starts capturing the standard error, logMu must be held.
+func startCapture() error {
+	if capture != nil {
+		return nil
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	saved, err := redirectStderr(w.Fd())
+	if err != nil {
+		r.Close()
+		w.Close()
+		return err
+	}
+
+	c := &stderrCapture{saved: saved, stderr: os.NewFile(uintptr(saved), "stderr"), w: w, done: make(chan struct{})}
+	go func() {
+		defer close(c.done)
+		defer r.Close()
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			line := scanner.Text()
+			logMessage(lineLevel(line), line)
+		}
+	}()
+	capture = c
+	return nil
+}
+
+// stopCapture restores the standard error once the captured lines are logged, logMu must be
+// held.
+func stopCapture() {
+	if capture == nil {
+		return
+	}
+	c := capture
+	restoreStderr(c.saved)
+	c.w.Close()
+
+	// the lines left are logged to the restored standard error
+	capture = nil
+	logMu.Unlock()
+	<-c.done
+	logMu.Lock()
+	c.stderr.Close()
+}
+
+// lineLevel guesses the level of a line printed by llama.cpp.
+func lineLevel(line string) LogLevel {
+	lower := strings.ToLower(line)
+	switch {
+	case strings.Contains(lower, "error") || strings.Contains(lower, "failed"):
+		return LogLevelError
+	case strings.Contains(lower, "warning"):
+		return LogLevelWarn
+	default:
+		return LogLevelInfo
+	}
+}
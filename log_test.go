@@ -0,0 +1,45 @@
+package llama_test
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sync"
+
+	. "github.com/go-skynet/go-llama.cpp"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// syncBuffer is a buffer written by the goroutine reading the captured standard error.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+var _ = Describe("Logging", func() {
+	It("captures the standard error and filters its lines", func() {
+		var out syncBuffer
+		Expect(SetLogWriter(&out)).To(Succeed())
+		Expect(SetLogLevel(LogLevelWarn)).To(Succeed())
+		fmt.Fprintln(os.Stderr, "llama_model_load: loading model")
+		fmt.Fprintln(os.Stderr, "error loading model: boom")
+		// the lines left are logged once the capture stops
+		Expect(SetLogWriter(nil)).To(Succeed())
+		Expect(SetLogLevel(LogLevelDebug)).To(Succeed())
+
+		Expect(out.String()).To(Equal("error loading model: boom\n"))
+	})
+})
@@ -0,0 +1,117 @@
+package llama
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Metrics collects the activity of the contexts created with SetMetrics, for a server to expose
+// them to Prometheus: it is an http.Handler serving the metrics in the text exposition format,
+// e.g. at /metrics. A Metrics is shared by all the contexts of a model or a pool.
+type Metrics struct {
+	mu sync.Mutex
+	// contexts are the contexts reporting their KV cache usage
+	contexts map[*LLama]struct{}
+
+	requests, failures                              int64
+	promptTokens, promptEvalTokens, generatedTokens int64
+	promptEval, predict                             time.Duration
+	queued                                          int64
+}
+
+// NewMetrics creates an empty set of metrics.
+func NewMetrics() *Metrics {
+	return &Metrics{contexts: map[*LLama]struct{}{}}
+}
+
+func (m *Metrics) addContext(l *LLama) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.contexts[l] = struct{}{}
+}
+
+func (m *Metrics) removeContext(l *LLama) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.contexts, l)
+}
+
+// observe records a prediction.
+func (m *Metrics) observe(res *PredictResult, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests++
+	if err != nil {
+		m.failures++
+	}
+	if res != nil {
+		m.promptTokens += int64(res.PromptTokens)
+		m.promptEvalTokens += int64(res.Timings.PromptEvalTokens)
+		m.generatedTokens += int64(res.CompletionTokens)
+		m.promptEval += res.Timings.PromptEval
+		m.predict += res.Timings.Predict
+	}
+}
+
+// queue adds n to the number of predictions waiting for a context.
+func (m *Metrics) queue(n int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.queued += n
+}
+
+// WritePrometheus writes the metrics to w in the Prometheus text exposition format.
+func (m *Metrics) WritePrometheus(w io.Writer) error {
+	m.mu.Lock()
+	requests, failures := m.requests, m.failures
+	promptTokens, promptEvalTokens, generatedTokens := m.promptTokens, m.promptEvalTokens, m.generatedTokens
+	promptEval, predict := m.promptEval, m.predict
+	queued := m.queued
+	contexts := make([]*LLama, 0, len(m.contexts))
+	for l := range m.contexts {
+		contexts = append(contexts, l)
+	}
+	m.mu.Unlock()
+
+	// the usage is read outside of the lock, the contexts may be running predictions
+	var kvTokens, kvSize int
+	for _, l := range contexts {
+		usage := l.ContextUsage()
+		kvTokens += usage.Tokens
+		kvSize += usage.Size
+	}
+
+	metrics := []struct {
+		name, kind, help string
+		value            float64
+	}{
+		{"llama_requests_total", "counter", "Number of predictions.", float64(requests)},
+		{"llama_request_failures_total", "counter", "Number of predictions which failed.", float64(failures)},
+		{"llama_prompt_tokens_total", "counter", "Number of tokens of the prompts.", float64(promptTokens)},
+		{"llama_prompt_eval_tokens_total", "counter", "Number of tokens of the prompts evaluated, without those reused from the context.", float64(promptEvalTokens)},
+		{"llama_generated_tokens_total", "counter", "Number of tokens generated.", float64(generatedTokens)},
+		{"llama_prompt_eval_seconds_total", "counter", "Time spent evaluating the prompts.", promptEval.Seconds()},
+		{"llama_predict_seconds_total", "counter", "Time spent generating the tokens.", predict.Seconds()},
+		{"llama_prompt_tokens_per_second", "gauge", "Mean rate the prompts were evaluated at.", perSecond(int(promptEvalTokens), promptEval)},
+		{"llama_generated_tokens_per_second", "gauge", "Mean rate the tokens were generated at.", perSecond(int(generatedTokens), predict)},
+		{"llama_queue_depth", "gauge", "Number of predictions waiting for a context.", float64(queued)},
+		{"llama_contexts", "gauge", "Number of contexts.", float64(len(contexts))},
+		{"llama_kv_cache_tokens", "gauge", "Number of tokens held by the KV caches of the contexts.", float64(kvTokens)},
+		{"llama_kv_cache_size_tokens", "gauge", "Number of tokens the KV caches of the contexts can hold.", float64(kvSize)},
+	}
+	for _, mt := range metrics {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %g\n", mt.name, mt.help, mt.name, mt.kind, mt.name, mt.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ServeHTTP serves the metrics in the Prometheus text exposition format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WritePrometheus(w)
+}
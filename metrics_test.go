@@ -0,0 +1,19 @@
+package llama_test
+
+import (
+	"net/http/httptest"
+
+	. "github.com/go-skynet/go-llama.cpp"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Metrics", func() {
+	It("serves the metrics in the Prometheus text format", func() {
+		rec := httptest.NewRecorder()
+		NewMetrics().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+		Expect(rec.Header().Get("Content-Type")).To(HavePrefix("text/plain"))
+		Expect(rec.Body.String()).To(ContainSubstring("# TYPE llama_requests_total counter\nllama_requests_total 0\n"))
+		Expect(rec.Body.String()).To(ContainSubstring("llama_queue_depth 0\n"))
+	})
+})
@@ -0,0 +1,191 @@
+package llama
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// Model is a model file contexts are created from with the same options. A context is a LLama
+// with its own KV cache, system prompt and sampler state, New creates a single context.
+//
+// Each context loads the weights from the file again. Only when they are memory mapped, which
+// needs a ggjt file on a platform supporting it, do the contexts share them through the page
+// cache of the file; otherwise each context holds a copy of the weights.
+type Model struct {
+	path string
+	opts []ModelOption
+
+	mu sync.Mutex
+	// contexts are the contexts which were not released, see MemoryStats
+	contexts map[*LLama]struct{}
+}
+
+// LoadModel opens the model at path, the options are the defaults of its contexts.
+func LoadModel(path string, opts ...ModelOption) (*Model, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, fmt.Errorf("failed loading model: %w", err)
+	}
+	return &Model{path: path, opts: opts, contexts: map[*LLama]struct{}{}}, nil
+}
+
+// NewContext creates a context of the model, opts override the options the model was loaded
+// with, e.g. the size of the context. It must be released with Free.
+func (m *Model) NewContext(opts ...ModelOption) (*LLama, error) {
+	all := make([]ModelOption, 0, len(m.opts)+len(opts))
+	all = append(all, m.opts...)
+	all = append(all, opts...)
+	l, err := New(m.path, all...)
+	if err != nil {
+		return nil, err
+	}
+	m.addContext(l)
+	return l, nil
+}
+
+func (m *Model) addContext(l *LLama) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	l.model = m
+	if m.contexts == nil {
+		m.contexts = map[*LLama]struct{}{}
+	}
+	m.contexts[l] = struct{}{}
+}
+
+func (m *Model) removeContext(l *LLama) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.contexts, l)
+}
+
+// MemoryStats returns the memory used by the model and the contexts created from it which were
+// not released yet, a number of contexts growing with the load reveals those which are never
+// released.
+func (m *Model) MemoryStats() (MemoryStats, error) {
+	st, err := os.Stat(m.path)
+	if err != nil {
+		return MemoryStats{}, err
+	}
+	m.mu.Lock()
+	contexts := make([]*LLama, 0, len(m.contexts))
+	for l := range m.contexts {
+		contexts = append(contexts, l)
+	}
+	m.mu.Unlock()
+
+	stats := MemoryStats{WeightBytes: st.Size()}
+	for _, l := range contexts {
+		cs := l.contextMemory()
+		stats.Contexts += cs.Contexts
+		stats.StateBytes += cs.StateBytes
+		stats.ScratchBytes += cs.ScratchBytes
+	}
+	return stats, nil
+}
+
+// MemoryStats describes the memory used by a model and its contexts.
+type MemoryStats struct {
+	// WeightBytes is the size of the weights, counted once. The contexts only share them when
+	// they are memory mapped, see Model, each context holds a copy otherwise.
+	WeightBytes int64
+	// Contexts is the number of contexts.
+	Contexts int
+	// StateBytes is the memory of the states of the contexts: their KV cache, which takes
+	// most of it, and the logits and embeddings of their last token, see SaveState.
+	StateBytes int64
+	// ScratchBytes is the memory of the buffers the contexts evaluate the tokens in.
+	ScratchBytes int64
+}
+
+// Total returns the memory used by the weights and the contexts.
+func (s MemoryStats) Total() int64 {
+	return s.WeightBytes + s.StateBytes + s.ScratchBytes
+}
+
+// EstimateMemory predicts the memory a context of the model at path would use, from the header
+// of the model file, so a configuration which does not fit can be rejected before loading it.
+// The options are those the context would be created with, the size of the context and
+// F16Memory set the size of the KV cache. All the memory is RAM.
+func EstimateMemory(path string, opts ...ModelOption) (MemoryStats, error) {
+	mo := NewModelOptions(opts...)
+	f, err := os.Open(path)
+	if err != nil {
+		return MemoryStats{}, err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return MemoryStats{}, err
+	}
+	hp, err := readHParams(f)
+	if err != nil {
+		return MemoryStats{}, fmt.Errorf("reading %s: %w", path, err)
+	}
+
+	// the keys and values of each layer, plus the overhead llama.cpp allocates with them
+	kvElement := int64(4)
+	if mo.F16Memory {
+		kvElement = 2
+	}
+	state := 2*int64(hp.layers)*int64(mo.ContextSize)*int64(hp.embd)*kvElement + 2<<20
+	// the logits and the embeddings of the last token
+	state += 4 * int64(hp.vocab)
+	if mo.Embeddings {
+		state += 4 * int64(hp.embd)
+	}
+	return MemoryStats{
+		WeightBytes:  st.Size(),
+		Contexts:     1,
+		StateBytes:   state,
+		ScratchBytes: scratchBytes(int(hp.embd)),
+	}, nil
+}
+
+// hparams are the hyperparameters of a model stored after the magic of its file.
+type hparams struct {
+	vocab, embd, mult, heads, layers, rot, ftype uint32
+}
+
+// readHParams reads the header of a ggml, ggmf or ggjt model file.
+func readHParams(r io.Reader) (hparams, error) {
+	var magic uint32
+	if err := binary.Read(r, binary.LittleEndian, &magic); err != nil {
+		return hparams{}, err
+	}
+	switch magic {
+	case 0x67676d6c: // ggml, unversioned
+	case 0x67676d66, 0x67676a74: // ggmf and ggjt
+		var version uint32
+		if err := binary.Read(r, binary.LittleEndian, &version); err != nil {
+			return hparams{}, err
+		}
+	default:
+		return hparams{}, fmt.Errorf("unknown model file magic %#x", magic)
+	}
+	var v [7]uint32
+	if err := binary.Read(r, binary.LittleEndian, &v); err != nil {
+		return hparams{}, err
+	}
+	return hparams{vocab: v[0], embd: v[1], mult: v[2], heads: v[3], layers: v[4], rot: v[5], ftype: v[6]}, nil
+}
+
+// scratchBytes returns the size of the evaluation and scratch buffers llama.cpp allocates for a
+// context of a model with n_embd dimensions, its tables are indexed by the size of the model.
+func scratchBytes(embd int) int64 {
+	const mb = 1 << 20
+	switch embd {
+	case 4096: // 7B
+		return (512 + 512 + 768) * mb
+	case 5120: // 13B
+		return (512 + 512 + 1024) * mb
+	case 6656: // 30B
+		return (512 + 512 + 1280) * mb
+	case 8192: // 65B
+		return (1024 + 1024 + 1536) * mb
+	default:
+		return 0
+	}
+}
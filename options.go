@@ -1,5 +1,11 @@
 package llama
 
+import (
+	"io"
+	"time"
+	"unsafe"
+)
+
 type ModelOptions struct {
 	ContextSize int
 	Parts       int
@@ -7,7 +13,36 @@ type ModelOptions struct {
 	F16Memory   bool
 	MLock       bool
 	Embeddings  bool
-}
+	// ChatTemplate is the name of the template formatting chats, see FormatChat.
+	ChatTemplate string
+	// PromptTemplate is a text/template formatting chats in place of ChatTemplate, see
+	// FormatPromptTemplate.
+	PromptTemplate string
+	// JinjaTemplate is a Jinja chat template formatting chats in place of ChatTemplate, see
+	// SetJinjaTemplate.
+	JinjaTemplate string
+	// Pooling combines the embeddings of the tokens of a text, see Embeddings.
+	Pooling Pooling
+	// Metrics collects the activity of the contexts, see SetMetrics.
+	Metrics *Metrics
+	// Tracer starts the spans of the predictions, see SetTracer.
+	Tracer Tracer
+}
+
+// Pooling selects how the embeddings of the tokens of a text are combined into its embedding.
+type Pooling int
+
+const (
+	// PoolingLast uses the embedding of the last token.
+	PoolingLast Pooling = iota
+	// PoolingMean averages the embeddings of all the tokens. They are evaluated one at a time,
+	// which is slower.
+	PoolingMean
+	// PoolingCLS uses the embedding of the first token of the text, the one following the
+	// beginning of stream token, for the models trained to summarize the text in a leading
+	// classification token.
+	PoolingCLS
+)
 
 type PredictOptions struct {
 	Seed, Threads, Tokens, TopK, Repeat, Batch, NKeep int
@@ -15,6 +50,7 @@ type PredictOptions struct {
 	F16KV                                             bool
 	DebugMode                                         bool
 	StopPrompts                                       []string
+	StopRegex                                         []string
 	IgnoreEOS                                         bool
 
 	TailFreeSamplingZ float64
@@ -26,7 +62,161 @@ type PredictOptions struct {
 	MirostatTAU       float64
 	PenalizeNL        bool
 	LogitBias         string
+	LogitBiasMap      map[int]float32
+	TokenBias         map[string]float32
 	TokenCallback     func(string) bool
+	MinP              float64
+
+	// Logprobs is the number of alternatives reported for each sampled token.
+	Logprobs int
+
+	// MaxDuration limits how long a prediction may run, 0 means no limit.
+	MaxDuration time.Duration
+	// MaxTokensPerSecond limits the rate of the generated tokens, 0 means no limit.
+	MaxTokensPerSecond float32
+	// MaxEntropy stops the generation when the average entropy of the sampled positions rises
+	// above it, 0 disables it.
+	MaxEntropy float32
+	// MinLogprob stops the generation when the sum of the log probabilities of the sampled
+	// tokens falls below it, 0 disables it.
+	MinLogprob float32
+
+	// EOSToken replaces the end of stream token of the model, -1 keeps it.
+	EOSToken int
+	// StopTokenIDs are more tokens ending the generation.
+	StopTokenIDs []int
+	// AddBOS prepends the beginning of stream token to the prompt.
+	AddBOS bool
+	// ParseSpecial replaces the texts of the special tokens in the prompt with the tokens.
+	ParseSpecial bool
+
+	// SpecialTokens shows the special tokens, like the end of stream token, to the token
+	// callbacks and in the result.
+	SpecialTokens bool
+
+	// Beams is the number of hypotheses of a beam search, 0 samples the tokens instead.
+	Beams int
+	// LengthPenalty is the exponent of the length normalization of the beam scores.
+	LengthPenalty float32
+	// BeamEarlyStopping stops the beam search as soon as the best hypothesis is finished.
+	BeamEarlyStopping bool
+
+	// Greedy always samples the most likely token, without applying any sampler.
+	Greedy bool
+
+	// AttentionSinks is the number of tokens at the start of the context kept by context shifts,
+	// it overrides NKeep when more than 0.
+	AttentionSinks int
+
+	// PromptCachePath is a file where the evaluated prompt is saved, to be reused by the next
+	// predictions starting with the same tokens.
+	PromptCachePath string
+	// PromptCacheRO reuses the prompt cache file without updating it.
+	PromptCacheRO bool
+
+	// ThreadsBatch is the number of threads evaluating the prompt, 0 uses Threads.
+	ThreadsBatch int
+	// CPUMask are the CPUs the threads of the prediction run on, all of them when empty.
+	CPUMask []int
+	// ThreadPriority is the priority of the threads of the prediction.
+	ThreadPriority ThreadPriority
+	// TokenBatch is the number of tokens passed at once to the token callbacks, 0 or 1 passes
+	// them as they are sampled.
+	TokenBatch int
+
+	// promptTokens replaces the prompt when set by PredictTokens
+	promptTokens []int32
+	// infill replaces the prompt when set by Infill
+	infill *infillPrompt
+	// trace reports the phases of the prediction to the tracer of the context, see SetTracer
+	trace bool
+	// guidance is the context evaluating the negative prompt, see SetNegativePrompt
+	guidance unsafe.Pointer
+
+	// InfillTokens are the fill-in-the-middle tokens used by Infill.
+	InfillTokens InfillTokens
+
+	// RandSource provides the randomness of the sampling instead of the seed.
+	RandSource io.Reader
+
+	// LogitsProcessor is called with the logits before sampling each token.
+	LogitsProcessor func(step int, logits []float32)
+
+	// PromptProgress is called as the prompt is evaluated.
+	PromptProgress func(done, total int)
+
+	// BannedStrings are never part of the generated text.
+	BannedStrings []string
+
+	// NumChoices is the number of completions generated for the prompt.
+	NumChoices int
+	// BestOf is the number of completions among which the best one is returned.
+	BestOf int
+	// ChoiceScorer ranks the completions with BestOf, higher is better.
+	ChoiceScorer func(Choice) float64
+
+	// NegativePrompt and GuidanceScale configure classifier-free guidance.
+	NegativePrompt string
+	GuidanceScale  float32
+
+	// TokenLogprobCallback is called like TokenCallback with the log probability of the token.
+	TokenLogprobCallback func(token string, logprob float32) bool
+
+	// TokenCallbackEx is called like TokenCallback with the details of the token.
+	TokenCallbackEx func(TokenEvent) bool
+
+	// SamplerOrder is the order in which the samplers are applied when sampling with
+	// temperature. An empty order selects the default chain.
+	SamplerOrder []Sampler
+
+	// Grammar is a GBNF grammar the generated text must conform to.
+	Grammar string
+	// GrammarTriggers and GrammarTriggerTokens make the grammar lazy, it only constrains the
+	// text following one of them.
+	GrammarTriggers      []string
+	GrammarTriggerTokens []int
+
+	// Tools are the tools the model can call with Chat.
+	Tools []Tool
+
+	// ReasoningStart and ReasoningEnd are the tags around the reasoning trace of thinking
+	// models, it is separated from the answer when they are set.
+	ReasoningStart, ReasoningEnd string
+
+	// NormalizeEmbeddings scales the embeddings to unit length.
+	NormalizeEmbeddings bool
+	// EmbeddingDimensions truncates the embeddings to their first dimensions, 0 keeps all of
+	// them.
+	EmbeddingDimensions int
+	// AverageChunks makes EmbedDocument return the mean of the embeddings of the chunks.
+	AverageChunks bool
+	// the pooling overriding the one of the model, see SetEmbeddingPooling
+	pooling *Pooling
+}
+
+// Sampler identifies a stage of the sampling chain. The values must be kept in sync with
+// binding.h.
+type Sampler int
+
+const (
+	SamplerPenalties Sampler = iota
+	SamplerTopK
+	SamplerTailFree
+	SamplerTypical
+	SamplerTopP
+	SamplerMinP
+	SamplerTemperature
+)
+
+// DefaultSamplerOrder is the sampling chain used when no order is set.
+var DefaultSamplerOrder = []Sampler{
+	SamplerPenalties,
+	SamplerTopK,
+	SamplerTailFree,
+	SamplerTypical,
+	SamplerTopP,
+	SamplerMinP,
+	SamplerTemperature,
 }
 
 type PredictOption func(p *PredictOptions)
@@ -34,11 +224,12 @@ type PredictOption func(p *PredictOptions)
 type ModelOption func(p *ModelOptions)
 
 var DefaultModelOptions ModelOptions = ModelOptions{
-	ContextSize: 512,
-	Seed:        0,
-	F16Memory:   false,
-	MLock:       false,
-	Embeddings:  false,
+	ContextSize:  512,
+	Seed:         0,
+	F16Memory:    false,
+	MLock:        false,
+	Embeddings:   false,
+	ChatTemplate: ChatTemplateChatML,
 }
 
 var DefaultOptions PredictOptions = PredictOptions{
@@ -47,7 +238,7 @@ var DefaultOptions PredictOptions = PredictOptions{
 	Tokens:            128,
 	Penalty:           1.1,
 	Repeat:            64,
-	Batch:             8,
+	Batch:             512,
 	NKeep:             64,
 	TopK:              40,
 	TopP:              0.95,
@@ -59,6 +250,25 @@ var DefaultOptions PredictOptions = PredictOptions{
 	Mirostat:          0,
 	MirostatTAU:       5.0,
 	MirostatETA:       0.1,
+	EOSToken:          -1,
+	AddBOS:            true,
+	LengthPenalty:     1.0,
+	GuidanceScale:     1.0,
+	InfillTokens:      InfillTokens{Prefix: -1, Suffix: -1, Middle: -1, EndOfText: -1},
+}
+
+type infillPrompt struct {
+	Prefix string
+	Suffix string
+}
+
+// InfillTokens are the ids of the fill-in-the-middle tokens of a model, -1 looks a token up in
+// the vocabulary.
+type InfillTokens struct {
+	Prefix    int
+	Suffix    int
+	Middle    int
+	EndOfText int
 }
 
 // SetContext sets the context size.
@@ -74,6 +284,39 @@ func SetModelSeed(c int) ModelOption {
 	}
 }
 
+// SetChatTemplate sets the name of the template formatting the chats of the model, see
+// FormatChat.
+func SetChatTemplate(name string) ModelOption {
+	return func(p *ModelOptions) {
+		p.ChatTemplate = name
+	}
+}
+
+// SetChatFormat selects one of the prompt formats known by FormatChat, like "chatml", "llama3" or
+// "mistral-instruct", for the models whose template is not known. It is the same option as
+// SetChatTemplate.
+func SetChatFormat(name string) ModelOption {
+	return SetChatTemplate(name)
+}
+
+// SetJinjaTemplate sets the Jinja chat template formatting the chats of the model in place of
+// the named chat template, e.g. the chat_template of the tokenizer_config.json file of the model.
+// It is rendered by the jinja package with the messages, add_generation_prompt, bos_token and
+// eos_token variables.
+func SetJinjaTemplate(src string) ModelOption {
+	return func(p *ModelOptions) {
+		p.JinjaTemplate = src
+	}
+}
+
+// SetPromptTemplate sets a text/template formatting the chats of the model in place of the named
+// chat template, see FormatPromptTemplate.
+func SetPromptTemplate(tmpl string) ModelOption {
+	return func(p *ModelOptions) {
+		p.PromptTemplate = tmpl
+	}
+}
+
 func SetParts(c int) ModelOption {
 	return func(p *ModelOptions) {
 		p.Parts = c
@@ -84,6 +327,30 @@ var EnableEmbeddings ModelOption = func(p *ModelOptions) {
 	p.Embeddings = true
 }
 
+// SetPooling sets how Embeddings combines the embeddings of the tokens of a text.
+func SetPooling(pooling Pooling) ModelOption {
+	return func(p *ModelOptions) {
+		p.Pooling = pooling
+	}
+}
+
+// SetMetrics makes the contexts record their predictions and their KV cache usage in m, and the
+// schedulers of their pools their queue depth.
+func SetMetrics(m *Metrics) ModelOption {
+	return func(p *ModelOptions) {
+		p.Metrics = m
+	}
+}
+
+// SetTracer makes the contexts start spans with t around their predictions and their phases:
+// the tokenization and the evaluation of the prompt, each evaluation of a batch of tokens and
+// each sampling.
+func SetTracer(t Tracer) ModelOption {
+	return func(p *ModelOptions) {
+		p.Tracer = t
+	}
+}
+
 var EnableF16Memory ModelOption = func(p *ModelOptions) {
 	p.F16Memory = true
 }
@@ -96,6 +363,12 @@ var Debug PredictOption = func(p *PredictOptions) {
 	p.DebugMode = true
 }
 
+// SetPromptCacheReadOnly uses the prompt cache file without updating it, e.g. when it holds a long
+// system prompt shared by many predictions.
+var SetPromptCacheReadOnly PredictOption = func(p *PredictOptions) {
+	p.PromptCacheRO = true
+}
+
 var EnableMLock ModelOption = func(p *ModelOptions) {
 	p.MLock = true
 }
@@ -113,6 +386,60 @@ var IgnoreEOS PredictOption = func(p *PredictOptions) {
 	p.IgnoreEOS = true
 }
 
+// SetReasoningTags separates the reasoning trace written between the start and end tags from the
+// answer: it is reported in the Reasoning field of the result and the token events. The trace is
+// open from the start when the prompt ends with the start tag.
+func SetReasoningTags(start, end string) PredictOption {
+	return func(p *PredictOptions) {
+		p.ReasoningStart = start
+		p.ReasoningEnd = end
+	}
+}
+
+// SetEmbeddingPooling overrides the pooling the model was loaded with for this call, see
+// SetPooling.
+func SetEmbeddingPooling(pooling Pooling) PredictOption {
+	return func(p *PredictOptions) {
+		p.pooling = &pooling
+	}
+}
+
+// SetEmbeddingDimensions truncates the embeddings to their first n dimensions and normalizes
+// them, for the models trained with Matryoshka representation learning whose leading dimensions
+// are an embedding on their own.
+func SetEmbeddingDimensions(n int) PredictOption {
+	return func(p *PredictOptions) {
+		p.EmbeddingDimensions = n
+	}
+}
+
+// SetNormalizeEmbeddings makes Embeddings return vectors of unit length, as expected by the
+// vector stores comparing them with the cosine similarity. The length of a raw vector is
+// returned by NormalizeEmbedding.
+func SetNormalizeEmbeddings(normalize bool) PredictOption {
+	return func(p *PredictOptions) {
+		p.NormalizeEmbeddings = normalize
+	}
+}
+
+// SetAverageChunks makes EmbedDocument return a single embedding of the whole document, the mean
+// of the embeddings of its chunks weighted by their number of tokens.
+func SetAverageChunks(average bool) PredictOption {
+	return func(p *PredictOptions) {
+		p.AverageChunks = average
+	}
+}
+
+// ExtractReasoning separates the reasoning trace of the models writing it between <think> and
+// </think>, like DeepSeek-R1, see SetReasoningTags.
+var ExtractReasoning PredictOption = SetReasoningTags("<think>", "</think>")
+
+// Greedy always samples the most likely token. The penalties and samplers are not applied, the
+// logit biases and the grammar are.
+var Greedy PredictOption = func(p *PredictOptions) {
+	p.Greedy = true
+}
+
 // SetTokenCallback sets the prompts that will stop predictions.
 func SetTokenCallback(fn func(string) bool) PredictOption {
 	return func(p *PredictOptions) {
@@ -120,6 +447,46 @@ func SetTokenCallback(fn func(string) bool) PredictOption {
 	}
 }
 
+// SetTokenLogprobCallback sets a callback which receives every token along with its log
+// probability, see PredictResult for details.
+func SetTokenLogprobCallback(fn func(token string, logprob float32) bool) PredictOption {
+	return func(p *PredictOptions) {
+		p.TokenLogprobCallback = fn
+	}
+}
+
+// SetTokenCallbackEx sets a callback which receives the details of every sampled token.
+func SetTokenCallbackEx(fn func(TokenEvent) bool) PredictOption {
+	return func(p *PredictOptions) {
+		p.TokenCallbackEx = fn
+	}
+}
+
+// SetLogprobs sets the number of most likely alternatives reported with each sampled token in
+// PredictResult.
+func SetLogprobs(n int) PredictOption {
+	return func(p *PredictOptions) {
+		p.Logprobs = n
+	}
+}
+
+// SetMaxTokensPerSecond paces the generation so at most rate tokens are generated each second:
+// after each token, the prediction waits until 1/rate seconds have passed since the previous one
+// before passing it to the token callback. The wait does not keep the CPUs busy, and
+// counts in the prediction time and the MaxDuration. A cancellation stops it. 0 disables it.
+func SetMaxTokensPerSecond(rate float32) PredictOption {
+	return func(p *PredictOptions) {
+		p.MaxTokensPerSecond = rate
+	}
+}
+
+// SetMaxDuration stops predictions running longer than d, they finish with FinishReasonTimeout.
+func SetMaxDuration(d time.Duration) PredictOption {
+	return func(p *PredictOptions) {
+		p.MaxDuration = d
+	}
+}
+
 // SetStopWords sets the prompts that will stop predictions.
 func SetStopWords(stop ...string) PredictOption {
 	return func(p *PredictOptions) {
@@ -127,7 +494,190 @@ func SetStopWords(stop ...string) PredictOption {
 	}
 }
 
-// SetSeed sets the random seed for sampling text generation.
+// SetAddBOS sets whether the beginning of stream token is prepended to the prompt, it is by
+// default. Prompts rendered by a chat template often start with it already.
+func SetAddBOS(add bool) PredictOption {
+	return func(p *PredictOptions) {
+		p.AddBOS = add
+	}
+}
+
+// SetParseSpecial replaces the texts of the special tokens in the prompt, like <|im_start|>, with
+// the tokens instead of tokenizing them as text. See TokenizeSpecial.
+func SetParseSpecial(parse bool) PredictOption {
+	return func(p *PredictOptions) {
+		p.ParseSpecial = parse
+	}
+}
+
+// SetSpecialTokens sets whether the special tokens, like the end of stream token and the stop
+// tokens, are passed to the token callbacks and kept in the result. They are hidden by default.
+func SetSpecialTokens(show bool) PredictOption {
+	return func(p *PredictOptions) {
+		p.SpecialTokens = show
+	}
+}
+
+// SetMaxEntropy stops the generation when the model is no longer confident: when the average
+// entropy, in nats, of the distributions the tokens are sampled from rises above max. The
+// prediction finishes with FinishReasonLowConfidence, without the token that crossed the limit.
+func SetMaxEntropy(max float32) PredictOption {
+	return func(p *PredictOptions) {
+		p.MaxEntropy = max
+	}
+}
+
+// SetMinLogprob stops the generation when the sum of the log probabilities of the sampled tokens
+// falls below min, a negative number. The prediction finishes with FinishReasonLowConfidence,
+// without the token that crossed the limit.
+func SetMinLogprob(min float32) PredictOption {
+	return func(p *PredictOptions) {
+		p.MinLogprob = min
+	}
+}
+
+// SetEOSToken sets the token ending the generation in place of the end of stream token of the
+// model. The end of stream token of the model no longer ends it, it is hidden like the other
+// special tokens.
+func SetEOSToken(id int) PredictOption {
+	return func(p *PredictOptions) {
+		p.EOSToken = id
+	}
+}
+
+// SetStopTokenIDs sets tokens which end the generation like the end of stream token, e.g. the
+// end of turn token of chat models. Their text is not part of the output, see
+// SetSpecialTokens. IgnoreEOS keeps them from being generated, like the end of stream token.
+func SetStopTokenIDs(ids ...int) PredictOption {
+	return func(p *PredictOptions) {
+		p.StopTokenIDs = ids
+	}
+}
+
+// SetBeams generates the text with a beam search keeping n hypotheses instead of sampling. The
+// samplers are not used, the hypotheses are reported in PredictResult.Beams. Every hypothesis
+// keeps a copy of the context state, which takes a lot of memory with large contexts.
+func SetBeams(n int) PredictOption {
+	return func(p *PredictOptions) {
+		p.Beams = n
+	}
+}
+
+// SetLengthPenalty sets the exponent of the length normalization of the beam scores, values
+// above 1 favor longer hypotheses.
+func SetLengthPenalty(penalty float32) PredictOption {
+	return func(p *PredictOptions) {
+		p.LengthPenalty = penalty
+	}
+}
+
+// SetBeamEarlyStopping stops the beam search as soon as the best hypothesis is finished.
+func SetBeamEarlyStopping(stop bool) PredictOption {
+	return func(p *PredictOptions) {
+		p.BeamEarlyStopping = stop
+	}
+}
+
+// SetNegativePrompt sets the prompt used for classifier-free guidance, generations are steered
+// away from what it would produce. It has no effect with a guidance scale of 1. The guidance
+// sequence is evaluated in a second context of the model, loaded from its file by the first
+// prediction using guidance and kept until Free: it takes the memory of another context, and of
+// the weights unless the model is memory-mapped.
+func SetNegativePrompt(prompt string) PredictOption {
+	return func(p *PredictOptions) {
+		p.NegativePrompt = prompt
+	}
+}
+
+// SetGuidanceScale sets the strength of the classifier-free guidance, 1 disables it and higher
+// values steer further away from the negative prompt.
+func SetGuidanceScale(scale float32) PredictOption {
+	return func(p *PredictOptions) {
+		p.GuidanceScale = scale
+	}
+}
+
+// SetNumChoices generates n completions of the prompt, which is only evaluated once. They are
+// reported in PredictResult.Choices, each one is sampled with the next seed.
+func SetNumChoices(n int) PredictOption {
+	return func(p *PredictOptions) {
+		p.NumChoices = n
+	}
+}
+
+// SetBestOf generates n completions of the prompt and returns the one with the highest total log
+// probability, or the highest score given by the scorer set with SetChoiceScorer. All the
+// completions are reported in PredictResult.Choices.
+func SetBestOf(n int) PredictOption {
+	return func(p *PredictOptions) {
+		p.BestOf = n
+	}
+}
+
+// SetChoiceScorer sets how completions are ranked with SetBestOf, higher is better.
+func SetChoiceScorer(scorer func(Choice) float64) PredictOption {
+	return func(p *PredictOptions) {
+		p.ChoiceScorer = scorer
+	}
+}
+
+// SetPromptProgressCallback sets a function called after each batch of the prompt is evaluated,
+// before the first token is generated, with the number of tokens of the prompt evaluated so far
+// and the total. The tokens reused from the context are counted as evaluated, so done may start
+// above 0, and it reaches total when the prompt is evaluated.
+func SetPromptProgressCallback(fn func(done, total int)) PredictOption {
+	return func(p *PredictOptions) {
+		p.PromptProgress = fn
+	}
+}
+
+// SetBannedStrings prevents the model from generating any of the strings, the tokens which
+// would complete one of them are never sampled. The strings are matched exactly, characters case
+// included.
+func SetBannedStrings(banned ...string) PredictOption {
+	return func(p *PredictOptions) {
+		p.BannedStrings = banned
+	}
+}
+
+// SetLogitsProcessor sets a function called before sampling each token with the number of tokens
+// sampled so far and the logits of the vocabulary, after the logit biases are applied. The
+// samplers use the logits as modified by the function. The slice is only valid during the call.
+func SetLogitsProcessor(fn func(step int, logits []float32)) PredictOption {
+	return func(p *PredictOptions) {
+		p.LogitsProcessor = fn
+	}
+}
+
+// SetRandSource draws the sampled tokens with random bytes read from r, e.g. a seeded *rand.Rand
+// shared with the rest of the application or crypto/rand.Reader. The seed is drawn from r too,
+// mirostat sampling still uses the random number generator of the model with that seed.
+func SetRandSource(r io.Reader) PredictOption {
+	return func(p *PredictOptions) {
+		p.RandSource = r
+	}
+}
+
+// SetInfillTokens sets the fill-in-the-middle tokens used by Infill, for models whose tokens are
+// not named <PRE>, <SUF>, <MID> and <EOT>.
+func SetInfillTokens(tokens InfillTokens) PredictOption {
+	return func(p *PredictOptions) {
+		p.InfillTokens = tokens
+	}
+}
+
+// SetStopRegex sets regular expressions that stop predictions once the generated text matches
+// one of them. The text is cut before the match. Unlike the stop words, the start of a match is
+// not held back from the token callbacks: when a match spans several tokens, the tokens before
+// the one completing it have already been passed to them.
+func SetStopRegex(patterns ...string) PredictOption {
+	return func(p *PredictOptions) {
+		p.StopRegex = patterns
+	}
+}
+
+// SetSeed sets the random seed for sampling text generation. With a seed of 0 or less a random
+// one is picked, which is reported in PredictResult.Seed.
 func SetSeed(seed int) PredictOption {
 	return func(p *PredictOptions) {
 		p.Seed = seed
@@ -141,7 +691,77 @@ func SetThreads(threads int) PredictOption {
 	}
 }
 
-// SetTokens sets the number of tokens to generate.
+// SetThreadsBatch sets the number of threads evaluating the prompt, the system prompt and the
+// texts of the embeddings, which are evaluated in batches and may use more threads than the
+// tokens generated one at a time. By default they use the threads set with SetThreads.
+func SetThreadsBatch(threads int) PredictOption {
+	return func(p *PredictOptions) {
+		p.ThreadsBatch = threads
+	}
+}
+
+// ThreadPriority is the scheduling priority of the threads of a prediction. The values must be
+// kept in sync with binding.h.
+type ThreadPriority int
+
+const (
+	// ThreadPriorityNormal keeps the priority of the process.
+	ThreadPriorityNormal ThreadPriority = iota
+	// ThreadPriorityMedium, ThreadPriorityHigh and ThreadPriorityRealtime run the threads with
+	// the FIFO real-time policy, at the priorities llama.cpp uses for these levels.
+	ThreadPriorityMedium
+	ThreadPriorityHigh
+	ThreadPriorityRealtime
+)
+
+// SetCPUMask runs the threads of the prediction on the CPUs cpus, e.g. the performance cores of a
+// big.LITTLE processor or the cores reserved for the model on a shared server. An empty mask
+// runs them on all the CPUs.
+//
+// The threads are started by ggml for each evaluation, they inherit the mask of the thread
+// running the prediction, which is set for its duration. The threads cannot be pinned to one CPU
+// each like the strict placement of llama.cpp. The mask is only supported on Linux.
+func SetCPUMask(cpus []int) PredictOption {
+	return func(p *PredictOptions) {
+		p.CPUMask = cpus
+	}
+}
+
+// SetThreadPriority sets the priority of the threads of the prediction, like SetCPUMask it is
+// inherited by the threads of ggml. Raising the priority needs the CAP_SYS_NICE capability, the
+// prediction runs at the normal priority without it. The priority is only supported on Linux.
+func SetThreadPriority(priority ThreadPriority) PredictOption {
+	return func(p *PredictOptions) {
+		p.ThreadPriority = priority
+	}
+}
+
+// SetTokenBatch passes the sampled tokens to the token callbacks n at a time, with a single call
+// from C into Go for each batch instead of each token, which limits the generation speed of fast
+// models. The callbacks still receive the tokens one by one, but are delayed until the batch is
+// full. When one of them stops the prediction, the result ends before the token it stopped at,
+// like without batches, and the following tokens of the batch are neither passed to the
+// callbacks nor returned. They were generated already, they only cost time.
+func SetTokenBatch(n int) PredictOption {
+	return func(p *PredictOptions) {
+		p.TokenBatch = n
+	}
+}
+
+// SetPromptCachePath sets a file holding the state of the context after evaluating the prompt,
+// like the --prompt-cache option of llama.cpp. The predictions whose prompt starts like the cached
+// one only evaluate the rest of their prompt, the file is updated with the new prompt unless
+// SetPromptCacheReadOnly is set. The file is only valid for the model and context size it was
+// created with.
+func SetPromptCachePath(path string) PredictOption {
+	return func(p *PredictOptions) {
+		p.PromptCachePath = path
+	}
+}
+
+// SetTokens sets the number of tokens to generate. With -1 the generation only stops at the end
+// of stream token, a stop word or another limit, the context is shifted when it is full keeping
+// the first NKeep tokens of the prompt.
 func SetTokens(tokens int) PredictOption {
 	return func(p *PredictOptions) {
 		p.Tokens = tokens
@@ -183,7 +803,9 @@ func SetRepeat(repeat int) PredictOption {
 	}
 }
 
-// SetBatch sets the batch size.
+// SetBatch sets the number of tokens of the prompt evaluated at once, 512 by default. Larger
+// batches evaluate long prompts faster, the compute buffers of llama.cpp limit them to 512
+// tokens.
 func SetBatch(size int) PredictOption {
 	return func(p *PredictOptions) {
 		p.Batch = size
@@ -197,6 +819,16 @@ func SetNKeep(n int) PredictOption {
 	}
 }
 
+// SetAttentionSinks keeps the first n tokens of the context when it is shifted, like the
+// attention sinks of StreamingLLM, so long generations with SetTokens(-1) keep their quality
+// while the rest of the context rolls. A few tokens are enough, it overrides NKeep. The kept
+// window is evaluated again on each shift, the cache cannot be shifted in place.
+func SetAttentionSinks(n int) PredictOption {
+	return func(p *PredictOptions) {
+		p.AttentionSinks = n
+	}
+}
+
 // Create a new PredictOptions object with the given options.
 func NewPredictOptions(opts ...PredictOption) PredictOptions {
 	p := DefaultOptions
@@ -268,3 +900,70 @@ func SetLogitBias(lb string) PredictOption {
 		p.LogitBias = lb
 	}
 }
+
+// SetTokenBias sets a bias for text instead of token IDs. Each key is tokenized with the
+// vocabulary of the loaded model and the bias is added to every resulting token. Keys are
+// tokenized as-is, include the leading space for words that follow other text.
+func SetTokenBias(tb map[string]float32) PredictOption {
+	return func(p *PredictOptions) {
+		p.TokenBias = tb
+	}
+}
+
+// SetLogitBiasMap sets the bias added to the logits of the given token IDs. A bias of
+// float32(math.Inf(-1)) prevents the token from ever being sampled. The biases are applied on
+// top of the one set with SetLogitBias.
+func SetLogitBiasMap(lb map[int]float32) PredictOption {
+	return func(p *PredictOptions) {
+		p.LogitBiasMap = lb
+	}
+}
+
+// SetMinP sets the minimum probability, relative to the most likely token, for a token to be
+// considered.
+func SetMinP(mp float64) PredictOption {
+	return func(p *PredictOptions) {
+		p.MinP = mp
+	}
+}
+
+// SetSamplerOrder sets the order in which the samplers are applied. Samplers not listed
+// are skipped. The order does not apply to greedy or mirostat sampling.
+func SetSamplerOrder(order []Sampler) PredictOption {
+	return func(p *PredictOptions) {
+		p.SamplerOrder = order
+	}
+}
+
+// SetGrammar constrains the generated text to the given GBNF grammar. The grammar must define
+// a root rule.
+func SetGrammar(gbnf string) PredictOption {
+	return func(p *PredictOptions) {
+		p.Grammar = gbnf
+	}
+}
+
+// SetGrammarTriggers makes the grammar lazy: the text is free until one of the words is
+// generated, the grammar then constrains the text following it. This lets a model answer in
+// prose and switch to structured output after a marker like "<tool_call>".
+func SetGrammarTriggers(words ...string) PredictOption {
+	return func(p *PredictOptions) {
+		p.GrammarTriggers = words
+	}
+}
+
+// SetGrammarTriggerTokens makes the grammar lazy like SetGrammarTriggers, it constrains the text
+// following one of the tokens.
+func SetGrammarTriggerTokens(ids ...int) PredictOption {
+	return func(p *PredictOptions) {
+		p.GrammarTriggerTokens = ids
+	}
+}
+
+// SetTools sets the tools the model can call with Chat. The call is constrained by a grammar
+// built from the parameters of the tools, which replaces the grammar set with SetGrammar.
+func SetTools(tools ...Tool) PredictOption {
+	return func(p *PredictOptions) {
+		p.Tools = tools
+	}
+}
@@ -0,0 +1,59 @@
+package llama
+
+import (
+	"context"
+	"fmt"
+)
+
+// ContextPool hands out the contexts of a model to concurrent users. A context can only run one
+// prediction at a time, a pool of contexts lets as many predictions run at once.
+type ContextPool struct {
+	contexts []*LLama
+	free     chan *LLama
+	// metrics are those the contexts were created with, see SetMetrics
+	metrics *Metrics
+}
+
+// NewContextPool creates a pool of n contexts of the model.
+func NewContextPool(m *Model, n int, opts ...ModelOption) (*ContextPool, error) {
+	if n <= 0 {
+		return nil, fmt.Errorf("invalid pool size %d", n)
+	}
+
+	p := &ContextPool{free: make(chan *LLama, n)}
+	for i := 0; i < n; i++ {
+		l, err := m.NewContext(opts...)
+		if err != nil {
+			p.Free()
+			return nil, err
+		}
+		p.contexts = append(p.contexts, l)
+		p.free <- l
+	}
+	p.metrics = p.contexts[0].metrics
+	return p, nil
+}
+
+// Acquire returns a context which is not used, waiting for one to be released if needed. The
+// context keeps the state left by its previous user, like its system prompt, see ResetContext.
+func (p *ContextPool) Acquire(ctx context.Context) (*LLama, error) {
+	select {
+	case l := <-p.free:
+		return l, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Release gives back a context returned by Acquire.
+func (p *ContextPool) Release(l *LLama) {
+	p.free <- l
+}
+
+// Free releases the contexts of the pool, none of them may be in use.
+func (p *ContextPool) Free() {
+	for _, l := range p.contexts {
+		l.Free()
+	}
+	p.contexts = nil
+}
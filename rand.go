@@ -0,0 +1,35 @@
+package llama
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// randSource draws random numbers from the reader set with SetRandSource. The first read error
+// is kept, the numbers drawn afterwards are 0.
+type randSource struct {
+	r   io.Reader
+	buf [8]byte
+	err error
+}
+
+func (s *randSource) uint64() uint64 {
+	if s.err != nil {
+		return 0
+	}
+	if _, err := io.ReadFull(s.r, s.buf[:]); err != nil {
+		s.err = err
+		return 0
+	}
+	return binary.LittleEndian.Uint64(s.buf[:])
+}
+
+// float64 returns a number drawn uniformly from [0, 1).
+func (s *randSource) float64() float64 {
+	return float64(s.uint64()>>11) / (1 << 53)
+}
+
+// seed returns a positive seed.
+func (s *randSource) seed() int {
+	return int(s.uint64()&0x7fffffff) | 1
+}
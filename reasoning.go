@@ -0,0 +1,94 @@
+package llama
+
+import "strings"
+
+// reasoningSplitter separates the reasoning trace written by thinking models between a start and
+// an end tag from the answer following it, as the text is generated.
+type reasoningSplitter struct {
+	start, end string
+
+	// inside is set while the trace is generated
+	inside bool
+	// done is set once the trace ended, the rest of the text is the answer
+	done bool
+	// trim drops the spaces starting the trace or the answer
+	trim    bool
+	pending string
+}
+
+// newReasoningSplitter returns a splitter of the text generated after prompt, the trace is open
+// from the start when the prompt ends with the start tag.
+func newReasoningSplitter(start, end, prompt string) *reasoningSplitter {
+	opened := strings.HasSuffix(strings.TrimRight(prompt, " \t\r\n"), start)
+	return &reasoningSplitter{start: start, end: end, inside: opened, trim: opened}
+}
+
+// add returns the chunks of the trace and of the answer in text. The end of the text which may
+// be the start of a tag is held back.
+func (s *reasoningSplitter) add(text string) (reasoning, answer string) {
+	s.pending += text
+	var r, a strings.Builder
+	for s.pending != "" {
+		switch {
+		case s.done:
+			a.WriteString(s.take(len(s.pending)))
+		case s.inside:
+			if i := strings.Index(s.pending, s.end); i >= 0 {
+				r.WriteString(s.take(i))
+				s.pending = s.pending[len(s.end):]
+				s.inside, s.done, s.trim = false, true, true
+				continue
+			}
+			r.WriteString(s.take(len(s.pending) - partialSuffix(s.pending, s.end)))
+		default:
+			if i := strings.Index(s.pending, s.start); i >= 0 {
+				a.WriteString(s.pending[:i])
+				s.pending = s.pending[i+len(s.start):]
+				s.inside, s.trim = true, true
+				continue
+			}
+			a.WriteString(s.take(len(s.pending) - partialSuffix(s.pending, s.start)))
+		}
+		break
+	}
+	return r.String(), a.String()
+}
+
+// flush returns the chunks held back once the generation is over.
+func (s *reasoningSplitter) flush() (reasoning, answer string) {
+	text := s.take(len(s.pending))
+	if s.inside {
+		return text, ""
+	}
+	return "", text
+}
+
+// take removes the first n bytes of the pending text and returns them, without the leading
+// spaces after a tag.
+func (s *reasoningSplitter) take(n int) string {
+	text := s.pending[:n]
+	s.pending = s.pending[n:]
+	if s.trim {
+		text = strings.TrimLeft(text, " \t\r\n")
+		s.trim = text == ""
+	}
+	return text
+}
+
+// partialSuffix returns the length of the longest end of text which is the start of tag.
+func partialSuffix(text, tag string) int {
+	for n := len(tag) - 1; n > 0; n-- {
+		if strings.HasSuffix(text, tag[:n]) {
+			return n
+		}
+	}
+	return 0
+}
+
+// splitReasoning returns the trace and the answer of the text generated after prompt.
+func splitReasoning(text, start, end, prompt string) (reasoning, answer string) {
+	s := newReasoningSplitter(start, end, prompt)
+	reasoning, answer = s.add(text)
+	r, a := s.flush()
+	return strings.TrimSpace(reasoning + r), answer + a
+}
@@ -0,0 +1,64 @@
+package llama
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/go-skynet/go-llama.cpp/grammar"
+)
+
+// Score is the relevance of a document to a query, see Rerank.
+type Score struct {
+	// Index is the index of the document.
+	Index int
+	// Relevance is the probability the model gives to the document being relevant, from 0 to 1.
+	Relevance float32
+}
+
+// rerankPrompt asks the model whether a document is relevant to a query. The query comes first
+// so the documents share the evaluation of the start of the prompt.
+const rerankPrompt = "Judge whether the document answers the query, answer yes or no.\n\nQuery: %s\nDocument: %s\nRelevant:"
+
+// Rerank scores the relevance of each document to query and returns the scores by decreasing
+// relevance.
+//
+// The documents are scored by the model itself: the relevance is the probability it answers yes,
+// rather than no, when asked whether the document answers the query.
+func (l *LLama) Rerank(query string, documents []string, opts ...PredictOption) ([]Score, error) {
+	opts = append(opts, Greedy, SetTokens(1), SetLogprobs(10), SetGrammar(grammar.ChoiceGrammar(" yes", " no")))
+
+	scores := make([]Score, len(documents))
+	for i, doc := range documents {
+		res, err := l.PredictWithResult(fmt.Sprintf(rerankPrompt, query, doc), opts...)
+		if err != nil {
+			return nil, fmt.Errorf("scoring document %d: %w", i, err)
+		}
+		if len(res.Tokens) == 0 {
+			return nil, fmt.Errorf("scoring document %d: no answer", i)
+		}
+
+		// the answers may start with different tokens, like " yes" or " y"
+		var yes, no float64
+		for _, t := range res.Tokens[0].TopLogprobs {
+			answer := strings.TrimSpace(t.Text)
+			switch {
+			case answer == "":
+			case strings.HasPrefix("yes", answer):
+				yes += math.Exp(float64(t.Logprob))
+			case strings.HasPrefix("no", answer):
+				no += math.Exp(float64(t.Logprob))
+			}
+		}
+		scores[i] = Score{Index: i}
+		if yes+no > 0 {
+			scores[i].Relevance = float32(yes / (yes + no))
+		}
+	}
+
+	sort.SliceStable(scores, func(i, j int) bool {
+		return scores[i].Relevance > scores[j].Relevance
+	})
+	return scores, nil
+}
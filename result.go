@@ -0,0 +1,228 @@
+package llama
+
+import "time"
+
+// Token is a token sampled during a prediction.
+type Token struct {
+	// ID is the id of the token in the vocabulary of the model.
+	ID int32
+	// Text is the text of the token, it may not be valid UTF-8 on its own.
+	Text string
+	// Logprob is the natural logarithm of the probability of the token, before the samplers
+	// are applied.
+	Logprob float32
+	// TopLogprobs are the most likely tokens at this position, ordered by decreasing
+	// probability. They are only reported when enabled with SetLogprobs.
+	TopLogprobs []Token
+	// Err is only set on the last token sent by PredictStream when the prediction failed or was
+	// canceled, the other fields are then empty.
+	Err error
+}
+
+// TokenEvent describes a token passed to the callback set with SetTokenCallbackEx.
+type TokenEvent struct {
+	// ID is the id of the token in the vocabulary of the model.
+	ID int32
+	// Text is the text of the token, it may not be valid UTF-8 on its own.
+	Text string
+	// Logprob is the natural logarithm of the probability of the token.
+	Logprob float32
+	// Position is the number of tokens sampled before this one.
+	Position int
+	// Special is set for control tokens like the end of stream token.
+	Special bool
+	// Reasoning is set for the tokens of the reasoning trace and its tags, see
+	// SetReasoningTags.
+	Reasoning bool
+	// Choice is the index of the completion the token belongs to, see SetNumChoices.
+	Choice int
+}
+
+// FinishReason tells why a prediction stopped.
+type FinishReason int
+
+// The finish reasons, they must be kept in sync with finish_reason in binding.h.
+const (
+	// FinishReasonStopWord means one of the stop words was generated.
+	FinishReasonStopWord FinishReason = iota
+	// FinishReasonEOS means the model generated the end of stream token or the grammar was
+	// completed.
+	FinishReasonEOS
+	// FinishReasonLength means the prediction hit the token limit, the answer may be truncated.
+	FinishReasonLength
+	// FinishReasonCanceled means the token callback stopped the prediction.
+	FinishReasonCanceled
+	// FinishReasonContextFull means the prompt and the generated tokens no longer fit in the
+	// context.
+	FinishReasonContextFull
+	// FinishReasonTimeout means the prediction ran longer than allowed with SetMaxDuration.
+	FinishReasonTimeout
+	// FinishReasonLowConfidence means the model was no longer confident enough, see
+	// SetMaxEntropy and SetMinLogprob.
+	FinishReasonLowConfidence
+)
+
+func (r FinishReason) String() string {
+	switch r {
+	case FinishReasonStopWord:
+		return "stop_word"
+	case FinishReasonEOS:
+		return "eos"
+	case FinishReasonLength:
+		return "length"
+	case FinishReasonCanceled:
+		return "canceled"
+	case FinishReasonContextFull:
+		return "context_full"
+	case FinishReasonTimeout:
+		return "timeout"
+	case FinishReasonLowConfidence:
+		return "low_confidence"
+	default:
+		return "unknown"
+	}
+}
+
+// Complete reports whether the model finished the answer on its own, rather than being cut off.
+func (r FinishReason) Complete() bool {
+	return r == FinishReasonStopWord || r == FinishReasonEOS
+}
+
+// Timings are the time spent in the phases of a prediction.
+type Timings struct {
+	// PromptEval is the time spent evaluating the prompt.
+	PromptEval time.Duration
+	// Predict is the time spent generating the tokens.
+	Predict time.Duration
+	// Sample is the part of Predict spent sampling the tokens rather than evaluating them.
+	Sample time.Duration
+	// PromptEvalTokens is the number of tokens of the prompt evaluated in PromptEval, the
+	// tokens reused from the context or a prompt cache are not evaluated again.
+	PromptEvalTokens int
+	// PredictTokens is the number of tokens generated in Predict.
+	PredictTokens int
+}
+
+// PromptTokensPerSecond returns the rate the prompt was evaluated at, 0 when no token was.
+func (t Timings) PromptTokensPerSecond() float64 {
+	return perSecond(t.PromptEvalTokens, t.PromptEval)
+}
+
+// PredictTokensPerSecond returns the rate the tokens were generated at, 0 when none was.
+func (t Timings) PredictTokensPerSecond() float64 {
+	return perSecond(t.PredictTokens, t.Predict)
+}
+
+func perSecond(n int, d time.Duration) float64 {
+	if n == 0 || d <= 0 {
+		return 0
+	}
+	return float64(n) / d.Seconds()
+}
+
+func (t Timings) add(o Timings) Timings {
+	return Timings{
+		PromptEval:       t.PromptEval + o.PromptEval,
+		Predict:          t.Predict + o.Predict,
+		Sample:           t.Sample + o.Sample,
+		PromptEvalTokens: t.PromptEvalTokens + o.PromptEvalTokens,
+		PredictTokens:    t.PredictTokens + o.PredictTokens,
+	}
+}
+
+// BenchmarkOptions configure Benchmark, the zero values pick the defaults of llama-bench.
+type BenchmarkOptions struct {
+	// PromptTokens is the number of tokens of the prompt processing test, 512 by default.
+	PromptTokens int
+	// GenTokens is the number of tokens of the text generation test, 128 by default.
+	GenTokens int
+	// Batches are the batch sizes the prompt is evaluated with, 512 by default.
+	Batches []int
+	// Threads are the numbers of threads to test, 4 by default.
+	Threads []int
+	// Repetitions is the number of runs of each configuration, their times are averaged. It is
+	// 5 by default.
+	Repetitions int
+}
+
+// BenchmarkResult is the speed of a configuration measured by Benchmark.
+type BenchmarkResult struct {
+	Batch, Threads int
+	// PromptTokensPerSecond is the rate the prompt was processed at.
+	PromptTokensPerSecond float64
+	// GenTokensPerSecond is the rate the tokens were generated at.
+	GenTokensPerSecond float64
+}
+
+// PredictResult is the outcome of a prediction.
+type PredictResult struct {
+	// Text is the generated text.
+	Text string
+	// Reasoning is the reasoning trace removed from Text, see SetReasoningTags.
+	Reasoning string
+	// Tokens are the sampled tokens, the special tokens are only included with SetSpecialTokens.
+	Tokens []Token
+	// PromptTokens is the number of tokens in the prompt.
+	PromptTokens int
+	// CompletionTokens is the number of tokens generated, including the special tokens left
+	// out of Tokens.
+	CompletionTokens int
+	// FinishReason tells why the prediction stopped.
+	FinishReason FinishReason
+	// Timings are the time spent evaluating the prompt and generating the tokens. With several
+	// choices, they and CompletionTokens add up those of all the choices.
+	Timings Timings
+	// Seed is the seed used for sampling, a random one is picked when none is set.
+	Seed int
+	// Beams are the hypotheses of a beam search, best first. Text and Tokens are those of the
+	// first one.
+	Beams []Beam
+	// Choices are the completions requested with SetNumChoices or SetBestOf. The other fields
+	// describe the first one, or the best one with SetBestOf.
+	Choices []Choice
+}
+
+// Choice is one of the completions of a prompt.
+type Choice struct {
+	// Text is the generated text.
+	Text string
+	// Reasoning is the reasoning trace removed from Text, see SetReasoningTags.
+	Reasoning string
+	// Tokens are the sampled tokens.
+	Tokens []Token
+	// FinishReason tells why the completion stopped.
+	FinishReason FinishReason
+	// Seed is the seed used for sampling the completion.
+	Seed int
+	// Score is the score of the completion when picking the best one with SetBestOf.
+	Score float64
+}
+
+// Logprob returns the sum of the log probabilities of the tokens of the completion.
+func (c Choice) Logprob() float32 {
+	var sum float32
+	for _, t := range c.Tokens {
+		sum += t.Logprob
+	}
+	return sum
+}
+
+// Beam is a hypothesis found by a beam search.
+type Beam struct {
+	// Text is the generated text.
+	Text string
+	// TokenIDs are the ids of the generated tokens.
+	TokenIDs []int32
+	// Score is the sum of the log probabilities of the tokens, divided by the number of tokens
+	// raised to the length penalty.
+	Score float32
+}
+
+// TokenIDs returns the ids of the sampled tokens.
+func (r *PredictResult) TokenIDs() []int32 {
+	ids := make([]int32, len(r.Tokens))
+	for i, t := range r.Tokens {
+		ids[i] = t.ID
+	}
+	return ids
+}
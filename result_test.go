@@ -0,0 +1,50 @@
+package llama_test
+
+import (
+	"time"
+
+	. "github.com/go-skynet/go-llama.cpp"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("PredictResult", func() {
+	Context("FinishReason", func() {
+		It("tells complete answers from truncated ones", func() {
+			Expect(FinishReasonStopWord.Complete()).To(BeTrue())
+			Expect(FinishReasonEOS.Complete()).To(BeTrue())
+			Expect(FinishReasonLength.Complete()).To(BeFalse())
+			Expect(FinishReasonCanceled.Complete()).To(BeFalse())
+			Expect(FinishReasonContextFull.Complete()).To(BeFalse())
+			Expect(FinishReasonLowConfidence.Complete()).To(BeFalse())
+		})
+
+		It("has a name", func() {
+			Expect(FinishReasonLength.String()).To(Equal("length"))
+			Expect(FinishReason(42).String()).To(Equal("unknown"))
+		})
+	})
+
+	Context("TokenIDs", func() {
+		It("returns the ids of the tokens", func() {
+			r := &PredictResult{Tokens: []Token{{ID: 1, Text: "a"}, {ID: 7, Text: "b"}}}
+			Expect(r.TokenIDs()).To(Equal([]int32{1, 7}))
+		})
+	})
+
+	Context("Timings", func() {
+		It("computes the token rates", func() {
+			t := Timings{PromptEval: 500 * time.Millisecond, PromptEvalTokens: 100, Predict: 2 * time.Second, PredictTokens: 40}
+			Expect(t.PromptTokensPerSecond()).To(BeNumerically("~", 200))
+			Expect(t.PredictTokensPerSecond()).To(BeNumerically("~", 20))
+			Expect(Timings{}.PredictTokensPerSecond()).To(BeZero())
+		})
+	})
+
+	Context("Choice", func() {
+		It("sums the log probabilities of the tokens", func() {
+			c := Choice{Tokens: []Token{{Logprob: -0.5}, {Logprob: -1.25}}}
+			Expect(c.Logprob()).To(BeNumerically("~", -1.75))
+		})
+	})
+})
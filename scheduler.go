@@ -0,0 +1,172 @@
+package llama
+
+import (
+	"context"
+	"sync"
+)
+
+// Scheduler is a request queue in front of a pool: the generations submitted by many users wait
+// for a free context, in the order they are submitted, and each runs alone on the context it
+// gets. The contexts acquired from the pool by other users are not part of that order.
+//
+// The generations are not batched together, throughput scales with the number of contexts of the
+// pool and the threads available to them.
+type Scheduler struct {
+	pool *ContextPool
+
+	mu sync.Mutex
+	// queue are the generations waiting for a slot, first submitted first
+	queue []*slotRequest
+	// dispatching tells whether a dispatch goroutine hands out the slots to the queue
+	dispatching bool
+}
+
+// slotRequest is a generation waiting for a slot.
+type slotRequest struct {
+	ctx  context.Context
+	slot chan *LLama
+	// gone is set under the lock of the scheduler once the generation stopped waiting
+	gone bool
+}
+
+// NewScheduler creates a scheduler running the generations on the contexts of pool.
+func NewScheduler(pool *ContextPool) *Scheduler {
+	return &Scheduler{pool: pool}
+}
+
+// Generation is a prediction submitted to a Scheduler.
+type Generation struct {
+	tokens chan Token
+	done   chan struct{}
+	result *PredictResult
+	err    error
+}
+
+// Submit queues a prediction of prompt, it starts once a slot is free. Canceling ctx stops the
+// prediction, or removes it from the queue.
+func (s *Scheduler) Submit(ctx context.Context, prompt string, opts ...PredictOption) *Generation {
+	g := &Generation{tokens: make(chan Token), done: make(chan struct{})}
+
+	po := NewPredictOptions(opts...)
+	userCallback := po.TokenCallbackEx
+	opts = append(opts, SetTokenCallbackEx(func(event TokenEvent) bool {
+		select {
+		case g.tokens <- Token{ID: event.ID, Text: event.Text, Logprob: event.Logprob}:
+		case <-ctx.Done():
+			return false
+		}
+		if userCallback != nil {
+			return userCallback(event)
+		}
+		return true
+	}))
+
+	go func() {
+		defer close(g.done)
+		defer close(g.tokens)
+
+		metrics := s.pool.metrics
+		if metrics != nil {
+			metrics.queue(1)
+		}
+		l, err := s.acquire(ctx)
+		if metrics != nil {
+			metrics.queue(-1)
+		}
+		if err != nil {
+			g.err = err
+			return
+		}
+		defer s.pool.Release(l)
+
+		g.result, g.err = l.predict(ctx, prompt, opts...)
+	}()
+
+	return g
+}
+
+// acquire queues a request for a slot and waits until the dispatcher hands one out, or ctx is
+// done.
+func (s *Scheduler) acquire(ctx context.Context) (*LLama, error) {
+	return s.wait(s.enqueue(ctx))
+}
+
+// enqueue adds a request for a slot at the end of the queue.
+func (s *Scheduler) enqueue(ctx context.Context) *slotRequest {
+	r := &slotRequest{ctx: ctx, slot: make(chan *LLama, 1)}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.queue = append(s.queue, r)
+	if !s.dispatching {
+		s.dispatching = true
+		go s.dispatch()
+	}
+	return r
+}
+
+// wait waits until the dispatcher hands a slot out to r, or its context is done.
+func (s *Scheduler) wait(r *slotRequest) (*LLama, error) {
+	select {
+	case l := <-r.slot:
+		return l, nil
+	case <-r.ctx.Done():
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		// the slot may have been handed out in the meantime
+		select {
+		case l := <-r.slot:
+			s.pool.Release(l)
+		default:
+		}
+		r.gone = true
+		return nil, r.ctx.Err()
+	}
+}
+
+// dispatch hands out the free slots to the queued requests in order, it returns once the queue
+// is empty.
+func (s *Scheduler) dispatch() {
+	for {
+		s.mu.Lock()
+		if len(s.queue) == 0 {
+			s.dispatching = false
+			s.mu.Unlock()
+			return
+		}
+		r := s.queue[0]
+		s.queue = s.queue[1:]
+		gone := r.gone
+		s.mu.Unlock()
+		if gone {
+			continue
+		}
+
+		l, err := s.pool.Acquire(r.ctx)
+		if err != nil {
+			// the request is done waiting on its own
+			continue
+		}
+		s.mu.Lock()
+		if r.gone {
+			s.pool.Release(l)
+		} else {
+			r.slot <- l
+		}
+		s.mu.Unlock()
+	}
+}
+
+// Tokens returns the channel the sampled tokens are sent over, it is closed when the generation
+// completes or fails. The generation is blocked until each token is received or Wait is called.
+func (g *Generation) Tokens() <-chan Token {
+	return g.tokens
+}
+
+// Wait waits for the generation to complete, discarding the tokens which were not received, and
+// returns its result.
+func (g *Generation) Wait() (*PredictResult, error) {
+	for range g.tokens {
+	}
+	<-g.done
+	return g.result, g.err
+}
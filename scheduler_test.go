@@ -0,0 +1,59 @@
+package llama_test
+
+import (
+	"context"
+	"sync"
+
+	. "github.com/go-skynet/go-llama.cpp"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Scheduler", func() {
+	It("hands out the slots in the order the generations are submitted", func() {
+		pool := NewFakePool(1)
+		s := NewScheduler(pool)
+		first, err := s.Enqueue(context.Background())()
+		Expect(err).ToNot(HaveOccurred())
+
+		var mu sync.Mutex
+		var order []int
+		var wg sync.WaitGroup
+		for i := 0; i < 5; i++ {
+			wait := s.Enqueue(context.Background())
+			wg.Add(1)
+			go func(i int) {
+				defer GinkgoRecover()
+				defer wg.Done()
+				l, err := wait()
+				Expect(err).ToNot(HaveOccurred())
+				mu.Lock()
+				order = append(order, i)
+				mu.Unlock()
+				pool.Release(l)
+			}(i)
+		}
+		pool.Release(first)
+		wg.Wait()
+		Expect(order).To(Equal([]int{0, 1, 2, 3, 4}))
+	})
+
+	It("skips the generations which stopped waiting", func() {
+		pool := NewFakePool(1)
+		s := NewScheduler(pool)
+		first, err := s.Enqueue(context.Background())()
+		Expect(err).ToNot(HaveOccurred())
+
+		ctx, cancel := context.WithCancel(context.Background())
+		canceled := s.Enqueue(ctx)
+		next := s.Enqueue(context.Background())
+		cancel()
+		_, err = canceled()
+		Expect(err).To(MatchError(context.Canceled))
+
+		pool.Release(first)
+		l, err := next()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(l).To(BeIdenticalTo(first))
+	})
+})
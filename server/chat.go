@@ -0,0 +1,254 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	llama "github.com/go-skynet/go-llama.cpp"
+)
+
+// messageContent is the content of a message, a string or a list of parts of which only the
+// text ones are kept.
+type messageContent string
+
+func (c *messageContent) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*c = messageContent(s)
+		return nil
+	}
+	var parts []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	}
+	if err := json.Unmarshal(b, &parts); err != nil {
+		return errors.New("expected a string or a list of content parts")
+	}
+	var sb strings.Builder
+	for _, p := range parts {
+		if p.Type != "text" {
+			return errors.New("unsupported content part " + p.Type)
+		}
+		sb.WriteString(p.Text)
+	}
+	*c = messageContent(sb.String())
+	return nil
+}
+
+type functionCall struct {
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+}
+
+type toolCall struct {
+	Index    *int         `json:"index,omitempty"`
+	ID       string       `json:"id"`
+	Type     string       `json:"type"`
+	Function functionCall `json:"function"`
+}
+
+type chatMessage struct {
+	Role             string         `json:"role,omitempty"`
+	Content          messageContent `json:"content"`
+	ReasoningContent string         `json:"reasoning_content,omitempty"`
+	ToolCalls        []toolCall     `json:"tool_calls,omitempty"`
+}
+
+type tool struct {
+	Type     string `json:"type"`
+	Function struct {
+		Name        string          `json:"name"`
+		Description string          `json:"description"`
+		Parameters  json.RawMessage `json:"parameters"`
+	} `json:"function"`
+}
+
+type chatRequest struct {
+	samplingRequest
+	Messages      []chatMessage `json:"messages"`
+	Tools         []tool        `json:"tools"`
+	StreamOptions struct {
+		IncludeUsage bool `json:"include_usage"`
+	} `json:"stream_options"`
+}
+
+// messages converts the messages of the request to those of the bindings.
+func (r chatRequest) messages() []llama.Message {
+	messages := make([]llama.Message, len(r.Messages))
+	for i, m := range r.Messages {
+		messages[i] = llama.Message{Role: m.Role, Content: string(m.Content)}
+		for _, call := range m.ToolCalls {
+			messages[i].ToolCalls = append(messages[i].ToolCalls, llama.ToolCall{
+				Name:      call.Function.Name,
+				Arguments: json.RawMessage(call.Function.Arguments),
+			})
+		}
+	}
+	return messages
+}
+
+// tools converts the functions of the request to the tools of the bindings.
+func (r chatRequest) tools() ([]llama.Tool, error) {
+	var tools []llama.Tool
+	for _, t := range r.Tools {
+		if t.Type != "function" {
+			return nil, errors.New("unsupported tool type " + t.Type)
+		}
+		tools = append(tools, llama.Tool{
+			Name:        t.Function.Name,
+			Description: t.Function.Description,
+			Parameters:  t.Function.Parameters,
+		})
+	}
+	return tools, nil
+}
+
+type chatChoice struct {
+	Index        int          `json:"index"`
+	Message      *chatMessage `json:"message,omitempty"`
+	Delta        *chatMessage `json:"delta,omitempty"`
+	FinishReason *string      `json:"finish_reason"`
+}
+
+type chatResponse struct {
+	ID      string       `json:"id"`
+	Object  string       `json:"object"`
+	Created int64        `json:"created"`
+	Model   string       `json:"model"`
+	Choices []chatChoice `json:"choices"`
+	Usage   *usage       `json:"usage,omitempty"`
+}
+
+// handleChatCompletions generates the next message of the assistant with the chat template of
+// the contexts. The calls of tools are streamed in the last chunk, once they are complete.
+func (s *Server) handleChatCompletions(w http.ResponseWriter, r *http.Request) {
+	var req chatRequest
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+	if len(req.Messages) == 0 {
+		writeError(w, http.StatusBadRequest, errors.New("messages are required"))
+		return
+	}
+	if req.N > 1 {
+		writeError(w, http.StatusBadRequest, errors.New("n must be 1 for chat completions"))
+		return
+	}
+	tools, err := req.tools()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	var total usage
+	opts := append(req.options(),
+		llama.SetPromptProgressCallback(func(done, n int) {
+			total.PromptTokens = n
+		}),
+		llama.SetTokenCallbackEx(func(llama.TokenEvent) bool {
+			total.CompletionTokens++
+			return true
+		}),
+	)
+	if len(tools) > 0 {
+		opts = append(opts, llama.SetTools(tools...))
+	}
+
+	l, err := s.pool.Acquire(r.Context())
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	defer s.pool.Release(l)
+
+	deltas, err := l.ChatStream(r.Context(), req.messages(), opts...)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	resp := chatResponse{ID: s.newID("chatcmpl"), Created: created(), Model: s.model}
+	if req.Stream {
+		resp.Object = "chat.completion.chunk"
+		s.streamChat(w, resp, deltas, &total, req.StreamOptions.IncludeUsage)
+		return
+	}
+
+	resp.Object = "chat.completion"
+	answer := &chatMessage{Role: "assistant"}
+	var content strings.Builder
+	for d := range deltas {
+		content.WriteString(d.Content)
+		answer.ReasoningContent += d.Reasoning
+		if !d.Done {
+			continue
+		}
+		if d.Err != nil {
+			writeError(w, http.StatusInternalServerError, d.Err)
+			return
+		}
+		answer.Content = messageContent(strings.TrimSpace(content.String()))
+		answer.ToolCalls = s.toolCalls(d.ToolCalls, false)
+		reason := chatFinishReason(d)
+		total.TotalTokens = total.PromptTokens + total.CompletionTokens
+		resp.Choices = []chatChoice{{Message: answer, FinishReason: &reason}}
+		resp.Usage = &total
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// streamChat sends the deltas of the answer as chunks of resp.
+func (s *Server) streamChat(w http.ResponseWriter, resp chatResponse, deltas <-chan llama.ChatDelta, total *usage, includeUsage bool) {
+	stream := newEventStream(w)
+	// the deltas are drained even when the client went away, until the generation stops
+	for d := range deltas {
+		chunk := resp
+		delta := &chatMessage{Role: d.Role, Content: messageContent(d.Content), ReasoningContent: d.Reasoning}
+		choice := chatChoice{Delta: delta}
+		if d.Done {
+			if d.Err != nil {
+				stream.send(newErrorResponse(http.StatusInternalServerError, d.Err))
+				continue
+			}
+			delta.ToolCalls = s.toolCalls(d.ToolCalls, true)
+			reason := chatFinishReason(d)
+			choice.FinishReason = &reason
+		} else if d.ToolCall != nil || (d.Role == "" && d.Content == "" && d.Reasoning == "") {
+			continue
+		}
+		chunk.Choices = []chatChoice{choice}
+		stream.send(chunk)
+		if d.Done && d.Err == nil {
+			if includeUsage {
+				total.TotalTokens = total.PromptTokens + total.CompletionTokens
+				chunk.Choices = []chatChoice{}
+				chunk.Usage = total
+				stream.send(chunk)
+			}
+			stream.done()
+		}
+	}
+}
+
+// toolCalls converts the calls of tools parsed from the answer, streamed calls have an index.
+func (s *Server) toolCalls(calls []llama.ToolCall, streamed bool) []toolCall {
+	var out []toolCall
+	for i, call := range calls {
+		c := toolCall{ID: s.newID("call"), Type: "function", Function: functionCall{Name: call.Name, Arguments: string(call.Arguments)}}
+		if streamed {
+			index := i
+			c.Index = &index
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+func chatFinishReason(d llama.ChatDelta) string {
+	if len(d.ToolCalls) > 0 {
+		return "tool_calls"
+	}
+	return finishReason(d.FinishReason)
+}
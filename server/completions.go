@@ -0,0 +1,103 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+
+	llama "github.com/go-skynet/go-llama.cpp"
+)
+
+type completionRequest struct {
+	samplingRequest
+	Prompt stringList `json:"prompt"`
+}
+
+type completionChoice struct {
+	Text         string      `json:"text"`
+	Index        int         `json:"index"`
+	Logprobs     interface{} `json:"logprobs"`
+	FinishReason *string     `json:"finish_reason"`
+}
+
+type completionResponse struct {
+	ID      string             `json:"id"`
+	Object  string             `json:"object"`
+	Created int64              `json:"created"`
+	Model   string             `json:"model"`
+	Choices []completionChoice `json:"choices"`
+	Usage   *usage             `json:"usage,omitempty"`
+}
+
+// handleCompletions completes the prompts of the request, with n choices each. The choices of
+// the prompts follow each other, like in the responses of OpenAI.
+func (s *Server) handleCompletions(w http.ResponseWriter, r *http.Request) {
+	var req completionRequest
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+	if len(req.Prompt) == 0 {
+		writeError(w, http.StatusBadRequest, errors.New("prompt is required"))
+		return
+	}
+	n := req.N
+	if n <= 0 {
+		n = 1
+	}
+	opts := req.options()
+	if n > 1 {
+		opts = append(opts, llama.SetNumChoices(n))
+	}
+
+	resp := completionResponse{ID: s.newID("cmpl"), Object: "text_completion", Created: created(), Model: s.model}
+	var stream *eventStream
+	if req.Stream {
+		stream = newEventStream(w)
+	}
+	var total usage
+	for i, prompt := range req.Prompt {
+		popts := opts
+		if stream != nil {
+			first := i * n
+			popts = append(popts[:len(popts):len(popts)], llama.SetTokenCallbackEx(func(event llama.TokenEvent) bool {
+				chunk := resp
+				chunk.Choices = []completionChoice{{Text: event.Text, Index: first + event.Choice}}
+				return stream.send(chunk)
+			}))
+		}
+
+		res, err := s.scheduler.Submit(r.Context(), prompt, popts...).Wait()
+		if err != nil {
+			if stream != nil {
+				stream.send(newErrorResponse(http.StatusInternalServerError, err))
+			} else {
+				writeError(w, http.StatusInternalServerError, err)
+			}
+			return
+		}
+
+		choices := res.Choices
+		if len(choices) == 0 {
+			choices = []llama.Choice{{Text: res.Text, FinishReason: res.FinishReason}}
+		}
+		for j, c := range choices {
+			reason := finishReason(c.FinishReason)
+			choice := completionChoice{Index: i*n + j, FinishReason: &reason}
+			if stream == nil {
+				choice.Text = c.Text
+			}
+			resp.Choices = append(resp.Choices, choice)
+		}
+		total.PromptTokens += res.PromptTokens
+		total.CompletionTokens += res.CompletionTokens
+	}
+	total.TotalTokens = total.PromptTokens + total.CompletionTokens
+	resp.Usage = &total
+
+	if stream == nil {
+		writeJSON(w, http.StatusOK, resp)
+		return
+	}
+	// the last chunk tells why each choice stopped
+	stream.send(resp)
+	stream.done()
+}
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+
+	llama "github.com/go-skynet/go-llama.cpp"
+)
+
+type embeddingRequest struct {
+	Model          string     `json:"model"`
+	Input          stringList `json:"input"`
+	Dimensions     int        `json:"dimensions"`
+	EncodingFormat string     `json:"encoding_format"`
+}
+
+type embedding struct {
+	Object    string    `json:"object"`
+	Index     int       `json:"index"`
+	Embedding []float32 `json:"embedding"`
+}
+
+type embeddingResponse struct {
+	Object string      `json:"object"`
+	Data   []embedding `json:"data"`
+	Model  string      `json:"model"`
+	Usage  usage       `json:"usage"`
+}
+
+// handleEmbeddings embeds the texts of the request, the embeddings are normalized like those of
+// OpenAI.
+func (s *Server) handleEmbeddings(w http.ResponseWriter, r *http.Request) {
+	var req embeddingRequest
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+	if len(req.Input) == 0 {
+		writeError(w, http.StatusBadRequest, errors.New("input is required"))
+		return
+	}
+	if req.EncodingFormat != "" && req.EncodingFormat != "float" {
+		writeError(w, http.StatusBadRequest, errors.New("unsupported encoding format "+req.EncodingFormat))
+		return
+	}
+
+	l, err := s.pool.Acquire(r.Context())
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	defer s.pool.Release(l)
+
+	opts := []llama.PredictOption{llama.SetNormalizeEmbeddings(true)}
+	if req.Dimensions > 0 {
+		opts = append(opts, llama.SetEmbeddingDimensions(req.Dimensions))
+	}
+	embeddings, err := l.EmbedBatch(req.Input, opts...)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	resp := embeddingResponse{Object: "list", Model: s.model}
+	for i, e := range embeddings {
+		resp.Data = append(resp.Data, embedding{Object: "embedding", Index: i, Embedding: e})
+		resp.Usage.PromptTokens += l.TokenCount(req.Input[i])
+	}
+	resp.Usage.TotalTokens = resp.Usage.PromptTokens
+	writeJSON(w, http.StatusOK, resp)
+}
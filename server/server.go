@@ -0,0 +1,247 @@
+// Package server serves a model over the HTTP API of OpenAI, so the clients written for it can
+// use a local model instead: completions, chat completions, streamed as server-sent events, and
+// embeddings.
+//
+//	pool, err := llama.NewContextPool(model, 4, llama.SetChatTemplate(llama.ChatTemplateChatML))
+//	if err != nil {
+//		return err
+//	}
+//	http.ListenAndServe(":8080", server.New(pool, "local"))
+//
+// The fields of the requests the bindings have no equivalent for are ignored.
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	llama "github.com/go-skynet/go-llama.cpp"
+)
+
+// Server answers the requests of the API with the contexts of a pool, each context running one
+// request at a time.
+type Server struct {
+	pool      *llama.ContextPool
+	scheduler *llama.Scheduler
+	model     string
+	mux       *http.ServeMux
+	ids       atomic.Int64
+}
+
+// New creates a server running the requests on the contexts of pool, model is the name of the
+// model listed by /v1/models and reported in the responses. The chat completions use the chat
+// template of the contexts, the embeddings need contexts created with EnableEmbeddings.
+func New(pool *llama.ContextPool, model string) *Server {
+	s := &Server{pool: pool, scheduler: llama.NewScheduler(pool), model: model, mux: http.NewServeMux()}
+	s.mux.HandleFunc("/v1/models", s.handleModels)
+	s.mux.HandleFunc("/v1/completions", s.handleCompletions)
+	s.mux.HandleFunc("/v1/chat/completions", s.handleChatCompletions)
+	s.mux.HandleFunc("/v1/embeddings", s.handleEmbeddings)
+	return s
+}
+
+// ServeHTTP implements http.Handler.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+type model struct {
+	ID      string `json:"id"`
+	Object  string `json:"object"`
+	Created int64  `json:"created"`
+	OwnedBy string `json:"owned_by"`
+}
+
+type modelList struct {
+	Object string  `json:"object"`
+	Data   []model `json:"data"`
+}
+
+func (s *Server) handleModels(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	writeJSON(w, http.StatusOK, modelList{
+		Object: "list",
+		Data:   []model{{ID: s.model, Object: "model", OwnedBy: "local"}},
+	})
+}
+
+// newID returns a new identifier of a response starting with prefix.
+func (s *Server) newID(prefix string) string {
+	return fmt.Sprintf("%s-%d", prefix, s.ids.Add(1))
+}
+
+// decodeRequest decodes the JSON body of a POST request into v, it writes the error response
+// and returns false when it fails.
+func decodeRequest(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return false
+	}
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %w", err))
+		return false
+	}
+	return true
+}
+
+// stringList is a string or a list of strings, like the prompts and the stop words.
+type stringList []string
+
+func (l *stringList) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*l = stringList{s}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(b, &list); err != nil {
+		return errors.New("expected a string or a list of strings")
+	}
+	*l = list
+	return nil
+}
+
+// samplingRequest holds the fields shared by the completion requests.
+type samplingRequest struct {
+	Model            string     `json:"model"`
+	MaxTokens        *int       `json:"max_tokens"`
+	Temperature      *float64   `json:"temperature"`
+	TopP             *float64   `json:"top_p"`
+	Seed             *int       `json:"seed"`
+	Stop             stringList `json:"stop"`
+	PresencePenalty  float64    `json:"presence_penalty"`
+	FrequencyPenalty float64    `json:"frequency_penalty"`
+	N                int        `json:"n"`
+	Stream           bool       `json:"stream"`
+}
+
+// options returns the options of the prediction of the request, the defaults of the bindings
+// are kept for the fields which are not set.
+func (r samplingRequest) options() []llama.PredictOption {
+	var opts []llama.PredictOption
+	if r.MaxTokens != nil {
+		opts = append(opts, llama.SetTokens(*r.MaxTokens))
+	}
+	if r.Temperature != nil {
+		if *r.Temperature == 0 {
+			opts = append(opts, llama.Greedy)
+		} else {
+			opts = append(opts, llama.SetTemperature(*r.Temperature))
+		}
+	}
+	if r.TopP != nil {
+		opts = append(opts, llama.SetTopP(*r.TopP))
+	}
+	if r.Seed != nil {
+		opts = append(opts, llama.SetSeed(*r.Seed))
+	}
+	if len(r.Stop) > 0 {
+		opts = append(opts, llama.SetStopWords(r.Stop...))
+	}
+	if r.PresencePenalty != 0 {
+		opts = append(opts, llama.SetPresencePenalty(r.PresencePenalty))
+	}
+	if r.FrequencyPenalty != 0 {
+		opts = append(opts, llama.SetFrequencyPenalty(r.FrequencyPenalty))
+	}
+	return opts
+}
+
+type usage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens,omitempty"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+// finishReason returns the reason of the API for a finish reason of the bindings.
+func finishReason(r llama.FinishReason) string {
+	switch r {
+	case llama.FinishReasonLength, llama.FinishReasonContextFull, llama.FinishReasonTimeout:
+		return "length"
+	default:
+		return "stop"
+	}
+}
+
+func created() int64 {
+	return time.Now().Unix()
+}
+
+type apiError struct {
+	Message string `json:"message"`
+	Type    string `json:"type"`
+}
+
+type errorResponse struct {
+	Error apiError `json:"error"`
+}
+
+func newErrorResponse(status int, err error) errorResponse {
+	typ := "server_error"
+	if status < http.StatusInternalServerError {
+		typ = "invalid_request_error"
+	}
+	return errorResponse{Error: apiError{Message: err.Error(), Type: typ}}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, newErrorResponse(status, err))
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// eventStream writes server-sent events.
+type eventStream struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+	err     error
+}
+
+// newEventStream starts the event stream of the response.
+func newEventStream(w http.ResponseWriter) *eventStream {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	return &eventStream{w: w, flusher: flusher}
+}
+
+// send writes the event holding v as JSON, it returns false once writing failed, when the client
+// went away.
+func (e *eventStream) send(v interface{}) bool {
+	b, err := json.Marshal(v)
+	if err != nil {
+		e.err = err
+		return false
+	}
+	return e.write("data: " + string(b) + "\n\n")
+}
+
+// done writes the event ending the stream.
+func (e *eventStream) done() {
+	e.write("data: [DONE]\n\n")
+}
+
+func (e *eventStream) write(data string) bool {
+	if e.err != nil {
+		return false
+	}
+	if _, e.err = e.w.Write([]byte(data)); e.err != nil {
+		return false
+	}
+	if e.flusher != nil {
+		e.flusher.Flush()
+	}
+	return true
+}
@@ -0,0 +1,54 @@
+package server_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	. "github.com/go-skynet/go-llama.cpp/server"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Server", func() {
+	// the requests are rejected before they need a context
+	srv := New(nil, "local")
+
+	do := func(method, path, body string) (int, map[string]interface{}) {
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+		var resp map[string]interface{}
+		Expect(json.Unmarshal(rec.Body.Bytes(), &resp)).To(Succeed())
+		return rec.Code, resp
+	}
+
+	It("lists the model", func() {
+		code, resp := do(http.MethodGet, "/v1/models", "")
+		Expect(code).To(Equal(http.StatusOK))
+		Expect(resp["data"]).To(ConsistOf(HaveKeyWithValue("id", "local")))
+	})
+
+	It("rejects invalid requests with the errors of the API", func() {
+		for _, c := range []struct {
+			method, path, body string
+			code               int
+		}{
+			{http.MethodGet, "/v1/completions", "", http.StatusMethodNotAllowed},
+			{http.MethodPost, "/v1/completions", "{", http.StatusBadRequest},
+			{http.MethodPost, "/v1/completions", `{"prompt": 1}`, http.StatusBadRequest},
+			{http.MethodPost, "/v1/completions", `{"max_tokens": 8}`, http.StatusBadRequest},
+			{http.MethodPost, "/v1/chat/completions", `{"messages": []}`, http.StatusBadRequest},
+			{http.MethodPost, "/v1/chat/completions", `{"messages": [{"role": "user", "content": "hi"}], "n": 2}`, http.StatusBadRequest},
+			{http.MethodPost, "/v1/chat/completions", `{"messages": [{"role": "user", "content": [{"type": "image_url"}]}]}`, http.StatusBadRequest},
+			{http.MethodPost, "/v1/chat/completions", `{"messages": [{"role": "user", "content": "hi"}], "tools": [{"type": "retrieval"}]}`, http.StatusBadRequest},
+			{http.MethodPost, "/v1/embeddings", `{"input": []}`, http.StatusBadRequest},
+			{http.MethodPost, "/v1/embeddings", `{"input": "hi", "encoding_format": "base64"}`, http.StatusBadRequest},
+		} {
+			code, resp := do(c.method, c.path, c.body)
+			Expect(code).To(Equal(c.code), c.path+" "+c.body)
+			Expect(resp["error"]).To(HaveKeyWithValue("type", "invalid_request_error"))
+			Expect(resp["error"]).To(HaveKey("message"))
+		}
+	})
+})
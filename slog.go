@@ -0,0 +1,33 @@
+//go:build go1.21
+
+package llama
+
+import (
+	"context"
+	"log/slog"
+)
+
+// SetLogger routes the messages of the bindings to logger, with the levels of slog. A nil
+// logger restores the standard error, see SetLogFunc.
+func SetLogger(logger *slog.Logger) {
+	if logger == nil {
+		SetLogFunc(nil)
+		return
+	}
+	SetLogFunc(func(level LogLevel, msg string) {
+		logger.Log(context.Background(), slogLevel(level), msg)
+	})
+}
+
+func slogLevel(level LogLevel) slog.Level {
+	switch level {
+	case LogLevelDebug:
+		return slog.LevelDebug
+	case LogLevelInfo:
+		return slog.LevelInfo
+	case LogLevelWarn:
+		return slog.LevelWarn
+	default:
+		return slog.LevelError
+	}
+}
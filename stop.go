@@ -0,0 +1,151 @@
+package llama
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// stopMatcher stops a prediction as soon as the generated text contains one of the stop words
+// or matches one of the stop regular expressions. Tokens which may be the start of a stop word
+// are held back from the callback until it is known whether they are part of it.
+type stopMatcher struct {
+	words    []string
+	patterns []*regexp.Regexp
+	callback func(TokenEvent) bool
+
+	text strings.Builder
+	// pending are the tokens held back from the callback, they are the end of text
+	pending []TokenEvent
+	// matched is the generated text before the match, once there is one
+	matched *string
+}
+
+// newStopMatcher returns a stopMatcher which passes the tokens on to callback, which may be
+// nil.
+func newStopMatcher(words, patterns []string, callback func(TokenEvent) bool) (*stopMatcher, error) {
+	s := &stopMatcher{callback: callback}
+	for _, w := range words {
+		if w != "" {
+			s.words = append(s.words, w)
+		}
+	}
+	for _, p := range patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid stop regex %q: %w", p, err)
+		}
+		s.patterns = append(s.patterns, re)
+	}
+	return s, nil
+}
+
+// tokenCallback is the token callback to register for the prediction.
+func (s *stopMatcher) tokenCallback(event TokenEvent) bool {
+	s.text.WriteString(event.Text)
+	s.pending = append(s.pending, event)
+	text := s.text.String()
+
+	if idx := s.matchIndex(text); idx >= 0 {
+		before := text[:idx]
+		s.matched = &before
+		s.forward(idx, true)
+		return false
+	}
+
+	return s.forward(s.holdIndex(text), false)
+}
+
+// flush passes the tokens still held back on to the callback, it must be called once the
+// prediction returned.
+func (s *stopMatcher) flush() {
+	if s.matched == nil {
+		s.forward(s.text.Len(), false)
+	}
+}
+
+// matchIndex returns where the first match in text starts, or -1.
+func (s *stopMatcher) matchIndex(text string) int {
+	idx := -1
+	for _, w := range s.words {
+		if i := strings.Index(text, w); i >= 0 && (idx < 0 || i < idx) {
+			idx = i
+		}
+	}
+	for _, re := range s.patterns {
+		if loc := re.FindStringIndex(text); loc != nil && (idx < 0 || loc[0] < idx) {
+			idx = loc[0]
+		}
+	}
+	return idx
+}
+
+// holdIndex returns where the longest end of text which is the start of a stop word begins.
+func (s *stopMatcher) holdIndex(text string) int {
+	hold := len(text)
+	for _, w := range s.words {
+		for n := len(w) - 1; n > 0; n-- {
+			if n <= len(text) && len(text)-n < hold && strings.HasSuffix(text, w[:n]) {
+				hold = len(text) - n
+				break
+			}
+		}
+	}
+	return hold
+}
+
+// forward passes the pending tokens ending before end on to the callback. With partial, the
+// text of the token containing end is passed on up to end.
+func (s *stopMatcher) forward(end int, partial bool) bool {
+	start := s.text.Len()
+	for _, t := range s.pending {
+		start -= len(t.Text)
+	}
+
+	cont := true
+	n := 0
+	for _, t := range s.pending {
+		tokenEnd := start + len(t.Text)
+		if tokenEnd > end {
+			if partial && start < end {
+				t.Text = t.Text[:end-start]
+				cont = s.call(t) && cont
+			}
+			break
+		}
+		cont = s.call(t) && cont
+		start = tokenEnd
+		n++
+	}
+	s.pending = s.pending[n:]
+	return cont
+}
+
+func (s *stopMatcher) call(event TokenEvent) bool {
+	if s.callback == nil {
+		return true
+	}
+	return s.callback(event)
+}
+
+// chainCallbacks merges the token callbacks of a prediction, any of them may be nil. It returns
+// nil when there are none.
+func chainCallbacks(callback func(string) bool, logprobCallback func(string, float32) bool, exCallback func(TokenEvent) bool) func(TokenEvent) bool {
+	if callback == nil && logprobCallback == nil && exCallback == nil {
+		return nil
+	}
+
+	return func(event TokenEvent) bool {
+		cont := true
+		if callback != nil {
+			cont = callback(event.Text)
+		}
+		if logprobCallback != nil {
+			cont = logprobCallback(event.Text, event.Logprob) && cont
+		}
+		if exCallback != nil {
+			cont = exCallback(event) && cont
+		}
+		return cont
+	}
+}
@@ -0,0 +1,83 @@
+package llama_test
+
+import (
+	. "github.com/go-skynet/go-llama.cpp"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Stop words", func() {
+	It("holds back the tokens which may start a stop word", func() {
+		for _, c := range []struct {
+			name            string
+			words, patterns []string
+			tokens          []string
+			forwarded       []string
+			matched         interface{}
+		}{
+			{
+				name:      "a stop word split across tokens",
+				words:     []string{"STOP"},
+				tokens:    []string{"Hello", " ST", "OP", " ignored"},
+				forwarded: []string{"Hello", " "},
+				matched:   "Hello ",
+			},
+			{
+				name:      "a start of a stop word which is not one",
+				words:     []string{"STOP"},
+				tokens:    []string{"Hello", " ST", "ay", "!"},
+				forwarded: []string{"Hello", " ST", "ay", "!"},
+				matched:   nil,
+			},
+			{
+				name:      "the tokens held back at the end of the generation",
+				words:     []string{"STOP"},
+				tokens:    []string{"Hello", " S", "T"},
+				forwarded: []string{"Hello", " S", "T"},
+				matched:   nil,
+			},
+			{
+				name:      "a stop word inside a token",
+				words:     []string{"STOP"},
+				tokens:    []string{"Hello", " theSTOPend"},
+				forwarded: []string{"Hello", " the"},
+				matched:   "Hello the",
+			},
+			{
+				name:      "the first of several stop words",
+				words:     []string{"B", "A"},
+				tokens:    []string{"xAyB"},
+				forwarded: []string{"x"},
+				matched:   "x",
+			},
+			{
+				name:      "a stop regex inside a token",
+				patterns:  []string{`\n\d+\.`},
+				tokens:    []string{"One", "\n2. Two"},
+				forwarded: []string{"One"},
+				matched:   "One",
+			},
+			{
+				name:      "a stop regex spanning tokens, whose first token is not held back",
+				patterns:  []string{`\n\d+\.`},
+				tokens:    []string{"One", "\n", "2.", " Two"},
+				forwarded: []string{"One", "\n"},
+				matched:   "One",
+			},
+		} {
+			forwarded, matched, err := MatchStop(c.words, c.patterns, c.tokens)
+			Expect(err).ToNot(HaveOccurred(), c.name)
+			Expect(forwarded).To(Equal(c.forwarded), c.name)
+			if c.matched == nil {
+				Expect(matched).To(BeNil(), c.name)
+			} else {
+				Expect(matched).To(HaveValue(Equal(c.matched)), c.name)
+			}
+		}
+	})
+
+	It("rejects invalid stop regexes", func() {
+		_, _, err := MatchStop(nil, []string{"("}, nil)
+		Expect(err).To(HaveOccurred())
+	})
+})
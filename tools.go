@@ -0,0 +1,109 @@
+package llama
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/go-skynet/go-llama.cpp/grammar"
+)
+
+// toolCallTag is the marker the model writes before calling a tool.
+const toolCallTag = "<tool_call>"
+
+// Tool is a function the model can call in a chat, see SetTools.
+type Tool struct {
+	// Name is the name the model calls the tool with.
+	Name string
+	// Description tells the model what the tool does.
+	Description string
+	// Parameters is the JSON schema of the arguments of the tool, an object when empty.
+	Parameters json.RawMessage
+}
+
+// ToolCall is a call of a tool generated by the model.
+type ToolCall struct {
+	// Name is the name of the called tool.
+	Name string `json:"name"`
+	// Arguments is the JSON object of the arguments, it matches the parameters of the tool.
+	Arguments json.RawMessage `json:"arguments"`
+}
+
+// toolsPrompt is the system prompt describing tools to the model.
+func toolsPrompt(tools []Tool) (string, error) {
+	var sb strings.Builder
+	sb.WriteString("You can call the following tools:\n")
+	for _, t := range tools {
+		desc, err := json.Marshal(struct {
+			Name        string          `json:"name"`
+			Description string          `json:"description,omitempty"`
+			Parameters  json.RawMessage `json:"parameters"`
+		}{t.Name, t.Description, toolParameters(t)})
+		if err != nil {
+			return "", fmt.Errorf("invalid parameters of tool %q: %w", t.Name, err)
+		}
+		sb.Write(desc)
+		sb.WriteString("\n")
+	}
+	sb.WriteString("To call a tool, answer with " + toolCallTag + ` followed by a JSON object with the name of the tool and its arguments, e.g. ` +
+		toolCallTag + `{"name": "tool", "arguments": {}}`)
+	return sb.String(), nil
+}
+
+// toolsGrammar is the grammar of the calls of tools, following toolCallTag.
+func toolsGrammar(tools []Tool) (string, error) {
+	// the schema is written by hand so the name comes before the arguments
+	var schema bytes.Buffer
+	schema.WriteString(`{"oneOf": [`)
+	for i, t := range tools {
+		name, err := json.Marshal(t.Name)
+		if err != nil {
+			return "", err
+		}
+		if i > 0 {
+			schema.WriteString(", ")
+		}
+		fmt.Fprintf(&schema, `{"type": "object", "properties": {"name": {"const": %s}, "arguments": %s}, "required": ["name", "arguments"]}`,
+			name, toolParameters(t))
+	}
+	schema.WriteString(`]}`)
+	return grammar.SchemaToGrammar(schema.Bytes())
+}
+
+func toolParameters(t Tool) json.RawMessage {
+	if len(t.Parameters) == 0 {
+		return json.RawMessage(`{"type": "object"}`)
+	}
+	return t.Parameters
+}
+
+// parseToolCalls splits the text generated with tools into the message and the call of a tool.
+func parseToolCalls(text string) (string, []ToolCall, error) {
+	i := strings.Index(text, toolCallTag)
+	if i < 0 {
+		return text, nil, nil
+	}
+	var call ToolCall
+	if err := json.Unmarshal([]byte(text[i+len(toolCallTag):]), &call); err != nil {
+		return text[:i], nil, fmt.Errorf("invalid tool call: %w", err)
+	}
+	return text[:i], []ToolCall{call}, nil
+}
+
+// withToolCalls returns messages with the calls of tools written into the content of the
+// messages, the way the model generates them.
+func withToolCalls(messages []Message) ([]Message, error) {
+	out := make([]Message, len(messages))
+	for i, m := range messages {
+		out[i] = m
+		for _, call := range m.ToolCalls {
+			b, err := json.Marshal(call)
+			if err != nil {
+				return nil, fmt.Errorf("invalid tool call: %w", err)
+			}
+			out[i].Content += toolCallTag + string(b)
+		}
+	}
+	return out, nil
+}
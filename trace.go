@@ -0,0 +1,86 @@
+package llama
+
+import "context"
+
+// Tracer starts the spans of the predictions of a context, see SetTracer. It adapts a tracing
+// library to the bindings, e.g. with OpenTelemetry Start calls the Start method of a
+// trace.Tracer and SetAttribute converts the value with attribute.Int or attribute.String.
+type Tracer interface {
+	// Start starts a span named name, a child of the span of ctx.
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is a span started by a Tracer.
+type Span interface {
+	// SetAttribute sets an attribute of the span, its value is an int or a string.
+	SetAttribute(key string, value interface{})
+	End()
+}
+
+// traceSpanNames are the names of the spans of the phases of a prediction, indexed by
+// trace_phase in binding.h.
+var traceSpanNames = [...]string{"llama.tokenize", "llama.prompt_eval", "llama.decode", "llama.sample"}
+
+const (
+	tracePromptEval = 1
+	traceDecode     = 2
+)
+
+// predictTrace starts the spans of the phases of a prediction as they are reported by
+// llama_predict.
+type predictTrace struct {
+	tracer Tracer
+	// ctx is the context of the span of the prediction
+	ctx context.Context
+	// promptCtx is the context of the span of the evaluation of the prompt, the parent of the
+	// evaluations of its batches
+	promptCtx context.Context
+	spans     [len(traceSpanNames)]Span
+}
+
+func (t *predictTrace) phase(phase, tokens int, end bool) {
+	if phase < 0 || phase >= len(t.spans) {
+		return
+	}
+	if end {
+		if s := t.spans[phase]; s != nil {
+			s.SetAttribute("llama.tokens", tokens)
+			s.End()
+			t.spans[phase] = nil
+		}
+		return
+	}
+
+	parent := t.ctx
+	if phase == traceDecode && t.spans[tracePromptEval] != nil {
+		parent = t.promptCtx
+	}
+	ctx, s := t.tracer.Start(parent, traceSpanNames[phase])
+	if phase == tracePromptEval {
+		t.promptCtx = ctx
+	}
+	t.spans[phase] = s
+}
+
+// end ends the spans left open by a prediction which stopped early.
+func (t *predictTrace) end() {
+	for i := len(t.spans) - 1; i >= 0; i-- {
+		if t.spans[i] != nil {
+			t.spans[i].End()
+			t.spans[i] = nil
+		}
+	}
+}
+
+// endPredictSpan ends the span of a prediction with its outcome.
+func endPredictSpan(span Span, res *PredictResult, err error) {
+	if res != nil {
+		span.SetAttribute("llama.prompt_tokens", res.PromptTokens)
+		span.SetAttribute("llama.completion_tokens", res.CompletionTokens)
+		span.SetAttribute("llama.finish_reason", res.FinishReason.String())
+	}
+	if err != nil {
+		span.SetAttribute("error", err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,59 @@
+package llama
+
+import "fmt"
+
+// TruncateStrategy selects the part of a prompt TruncateToFit keeps.
+type TruncateStrategy int
+
+const (
+	// TruncateKeepHead keeps the beginning of the prompt.
+	TruncateKeepHead TruncateStrategy = iota
+	// TruncateKeepTail keeps the end of the prompt, e.g. the last messages of a chat.
+	TruncateKeepTail
+	// TruncateMiddleOut keeps the beginning and the end of the prompt, dropping the middle.
+	TruncateMiddleOut
+)
+
+// TruncateToFit trims prompt so it fits in the context with reserve tokens left for the answer.
+// It returns the kept text and the dropped one, which is empty when the prompt already fits.
+// With TruncateMiddleOut the kept text is the beginning of the prompt directly followed by its
+// end.
+func (l *LLama) TruncateToFit(prompt string, reserve int, strategy TruncateStrategy) (kept, dropped string, err error) {
+	// the prompt of a prediction also holds the beginning of stream token and a leading space
+	budget := l.ContextUsage().Size - reserve - 2
+	if budget <= 0 {
+		return "", prompt, fmt.Errorf("no room left for the prompt")
+	}
+
+	tokens, err := l.Tokenize(prompt, false)
+	if err != nil {
+		return "", "", err
+	}
+	if len(tokens) <= budget {
+		return prompt, "", nil
+	}
+
+	var keptTokens, droppedTokens []int32
+	switch strategy {
+	case TruncateKeepHead:
+		keptTokens, droppedTokens = tokens[:budget], tokens[budget:]
+	case TruncateKeepTail:
+		cut := len(tokens) - budget
+		keptTokens, droppedTokens = tokens[cut:], tokens[:cut]
+	case TruncateMiddleOut:
+		head := budget / 2
+		tail := len(tokens) - (budget - head)
+		keptTokens = append(append([]int32(nil), tokens[:head]...), tokens[tail:]...)
+		droppedTokens = tokens[head:tail]
+	default:
+		return "", "", fmt.Errorf("unknown truncate strategy %d", strategy)
+	}
+
+	if kept, err = l.Detokenize(keptTokens); err != nil {
+		return "", "", err
+	}
+	if dropped, err = l.Detokenize(droppedTokens); err != nil {
+		return "", "", err
+	}
+	return kept, dropped, nil
+}